@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"dev.grab-a-byte.network/internal/server"
+)
+
+// devNames are the names the development certificate is valid for.
+var devNames = []string{"localhost"}
+var devIPs = []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}
+
+// renewBefore regenerates certificates this close to expiring.
+const renewBefore = 30 * 24 * time.Hour
+
+// devCertificate returns a certificate for local HTTPS, signed by a local
+// development CA. Both are cached in dir and only regenerated when missing,
+// close to expiry or, for the leaf, no longer signed by the cached CA.
+func devCertificate(dir string) (server.CertFile, string, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return server.CertFile{}, "", err
+	}
+
+	caPath := filepath.Join(dir, "ca.pem")
+	caKeyPath := filepath.Join(dir, "ca-key.pem")
+	leaf := server.CertFile{CertFile: filepath.Join(dir, "localhost.pem"), KeyFile: filepath.Join(dir, "localhost-key.pem")}
+
+	ca, caKey, err := loadPair(caPath, caKeyPath)
+	if err != nil || !fresh(ca) {
+		ca, caKey, err = createCert(caPath, caKeyPath, nil, nil)
+		if err != nil {
+			return server.CertFile{}, "", fmt.Errorf("creating development CA: %w", err)
+		}
+	}
+
+	cert, _, err := loadPair(leaf.CertFile, leaf.KeyFile)
+	if err != nil || !fresh(cert) || cert.CheckSignatureFrom(ca) != nil || !coversDevNames(cert) {
+		_, _, err = createCert(leaf.CertFile, leaf.KeyFile, ca, caKey)
+		if err != nil {
+			return server.CertFile{}, "", fmt.Errorf("creating development certificate: %w", err)
+		}
+	}
+
+	return leaf, caPath, nil
+}
+
+func fresh(cert *x509.Certificate) bool {
+	return time.Now().Add(renewBefore).Before(cert.NotAfter)
+}
+
+func coversDevNames(cert *x509.Certificate) bool {
+	for _, name := range devNames {
+		if !slices.Contains(cert.DNSNames, name) {
+			return false
+		}
+	}
+	for _, ip := range devIPs {
+		if !slices.ContainsFunc(cert.IPAddresses, ip.Equal) {
+			return false
+		}
+	}
+	return true
+}
+
+func loadPair(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("unexpected key type")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// createCert writes a new key and certificate. Without a parent it creates
+// the CA, otherwise a localhost leaf signed by parent whose file also holds
+// the CA so clients get the whole chain.
+func createCert(certPath, keyPath string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+	}
+	if parent == nil {
+		template.Subject = pkix.Name{CommonName: "httpserver development CA", Organization: []string{"httpserver dev"}}
+		template.NotAfter = time.Now().AddDate(10, 0, 0)
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.MaxPathLenZero = true
+		parent, parentKey = template, key
+	} else {
+		template.Subject = pkix.Name{CommonName: "localhost", Organization: []string{"httpserver dev"}}
+		// Browsers reject leaf certificates valid for more than 398 days
+		template.NotAfter = time.Now().AddDate(0, 0, 397)
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = devNames
+		template.IPAddresses = devIPs
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if !template.IsCA {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: parent.Raw})...)
+	}
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.WriteFile(certPath, certPEM, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
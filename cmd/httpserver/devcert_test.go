@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dev.grab-a-byte.network/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readLeaf parses the leaf certificate and checks it chains to the CA at
+// caPath.
+func readLeaf(t *testing.T, files server.CertFile, caPath string) *x509.Certificate {
+	t.Helper()
+	ca, _, err := loadPair(caPath, filepath.Join(filepath.Dir(caPath), "ca-key.pem"))
+	require.NoError(t, err)
+	leaf, _, err := loadPair(files.CertFile, files.KeyFile)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: roots})
+	require.NoError(t, err)
+	return leaf
+}
+
+func TestDevCertificate(t *testing.T) {
+	dir := t.TempDir()
+
+	// Test: A CA and a leaf for every local name are created
+	files, caPath, err := devCertificate(dir)
+	require.NoError(t, err)
+	leaf := readLeaf(t, files, caPath)
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		assert.NoError(t, leaf.VerifyHostname(host), host)
+	}
+
+	// Test: Cached files are reused
+	_, _, err = devCertificate(dir)
+	require.NoError(t, err)
+	assert.Equal(t, leaf.SerialNumber, readLeaf(t, files, caPath).SerialNumber)
+
+	// Test: A leaf close to expiry is replaced
+	ca, caKey, err := loadPair(caPath, filepath.Join(dir, "ca-key.pem"))
+	require.NoError(t, err)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	expiring := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     devNames,
+		IPAddresses:  devIPs,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, expiring, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644))
+	require.NoError(t, os.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	_, _, err = devCertificate(dir)
+	require.NoError(t, err)
+	renewed := readLeaf(t, files, caPath)
+	assert.NotEqual(t, int64(1), renewed.SerialNumber.Int64())
+	assert.True(t, fresh(renewed))
+
+	// Test: A new CA means a new leaf signed by it
+	require.NoError(t, os.Remove(caPath))
+	_, _, err = devCertificate(dir)
+	require.NoError(t, err)
+	newCA, _, err := loadPair(caPath, filepath.Join(dir, "ca-key.pem"))
+	require.NoError(t, err)
+	assert.NotEqual(t, ca.SerialNumber, newCA.SerialNumber)
+	assert.NotEqual(t, renewed.SerialNumber, readLeaf(t, files, caPath).SerialNumber)
+}
@@ -1,130 +1,525 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"dev.grab-a-byte.network/internal/accesslog"
+	"dev.grab-a-byte.network/internal/compress"
+	"dev.grab-a-byte.network/internal/errorpage"
 	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/jsonio"
+	"dev.grab-a-byte.network/internal/metrics"
+	"dev.grab-a-byte.network/internal/proxy"
+	"dev.grab-a-byte.network/internal/proxyproto"
 	"dev.grab-a-byte.network/internal/request"
 	"dev.grab-a-byte.network/internal/response"
 	"dev.grab-a-byte.network/internal/server"
+	"dev.grab-a-byte.network/internal/sse"
+	"dev.grab-a-byte.network/internal/upstream"
+	"dev.grab-a-byte.network/internal/websocket"
 )
 
 const port = 42069
 
+// shutdownTimeout is how long open connections get to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+var listenHost = flag.String("host", "", "address to listen on, all interfaces when empty")
+var unixSocket = flag.String("unix", "", "listen on a unix domain socket at this path instead of TCP")
+var proxyProtocol = flag.String("proxy-protocol", "", "comma separated CIDRs of load balancers trusted to send a PROXY protocol header")
+
+var forwardProxy = flag.Bool("forward-proxy", false, "act as a forward proxy for absolute form and CONNECT requests")
+
+var errorPagesDir = flag.String("error-pages", "", "directory of html/template error pages named by status code or class, e.g. 404.html or 5xx.html")
+
+var accessLogPath = flag.String("access-log", "", "file to write the access log to, stdout when empty")
+var accessLogFormat = flag.String("access-log-format", "combined", "access log format: common, combined or json")
+var accessLogMaxSize = flag.Int64("access-log-max-size", 100<<20, "rotate the access log file once it reaches this many bytes")
+
+var metricsPath = flag.String("metrics-path", "/metrics", "path serving Prometheus metrics")
+
+var h2c = flag.Bool("h2c", false, "also serve cleartext HTTP/2, by prior knowledge or an Upgrade: h2c request")
+
+var tlsCerts []server.CertFile
+var clientAuth = flag.String("client-auth", "none", "client certificate mode with -tls: none, request, require or verify-if-given")
+var devTLS = flag.Bool("dev-tls", false, "serve TLS with a generated certificate for localhost, signed by a local development CA")
+var devTLSDir = flag.String("dev-tls-dir", "", "where -dev-tls keeps its CA and certificate, defaults to the user cache directory")
+var clientCAs = flag.String("client-ca", "", "comma separated PEM files of CAs trusted to sign client certificates")
+
+func init() {
+	flag.Func("tls", "serve TLS with the certificate and key `cert.pem,key.pem`, repeat for more names selected by SNI", func(value string) error {
+		certFile, keyFile, ok := strings.Cut(value, ",")
+		if !ok {
+			return fmt.Errorf("expected cert.pem,key.pem")
+		}
+		tlsCerts = append(tlsCerts, server.CertFile{CertFile: certFile, KeyFile: keyFile})
+		return nil
+	})
+}
+
+var httpbin = upstream.New("httpbin", "https://httpbin.org", upstream.DefaultPolicy)
+
+// maxHttpbinBody bounds request bodies proxied to httpbin, which are held
+// in memory for retries
+const maxHttpbinBody = 16 << 20
+
+var errorPages = errorpage.Default
+
 func main() {
-	server, err := server.Serve(
-		port,
-		func(w *response.Writer, req *request.Request) {
-			path := req.RequestLine.RequestTarget
-			defaultHeaders := response.GetDefaultHeaders(0)
-			if strings.Contains(path, "/yourproblem") {
-				defaultHeaders.Set("Content-Length", fmt.Sprintf("%d", len(badRequestHtml)))
-				w.WriteStatusLine(400)
-				w.WriteHeaders(defaultHeaders)
-				w.WriteBody([]byte(badRequestHtml))
+	flag.Parse()
+	if *errorPagesDir != "" {
+		pages, err := errorpage.Load(*errorPagesDir)
+		if err != nil {
+			log.Fatalf("Error loading error pages: %v", err)
+		}
+		errorPages = pages
+	}
+
+	logFormat, err := accesslog.ParseFormat(*accessLogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var logOutput io.Writer = os.Stdout
+	if *accessLogPath != "" {
+		logFile, err := accesslog.OpenFile(*accessLogPath, *accessLogMaxSize, 5)
+		if err != nil {
+			log.Fatalf("Error opening access log: %v", err)
+		}
+		defer logFile.Close()
+		logOutput = logFile
+	}
+
+	registry := metrics.NewRegistry()
+	// Requests can arrive as soon as the listener is served, which is
+	// before the server is known here
+	var current atomic.Pointer[server.Server]
+	stats := func() server.Stats {
+		srv := current.Load()
+		if srv == nil {
+			return server.Stats{}
+		}
+		return srv.Stats()
+	}
+	handler := server.Chain(func(w *response.Writer, req *request.Request) {
+		if *forwardProxy && req.RequestLine.IsProxyRequest() {
+			proxy.Handle(w, req)
+			return
+		}
+		if req.RequestLine.TargetForm == request.TargetAuthority {
+			errorPages.Write(w, req, &server.HandlerError{
+				StatusCode:   int(response.STATUS_METHOD_NOT_ALLOWED),
+				ErrorMessage: "This server is not a proxy.",
+			})
+			return
+		}
+
+		path := req.RequestLine.Path
+		defaultHeaders := response.GetDefaultHeaders(0)
+		if strings.Contains(path, "/yourproblem") {
+			errorPages.Write(w, req, &server.HandlerError{
+				StatusCode:   int(response.STATUS_BAD_REQUEST),
+				ErrorMessage: "Your request honestly kinda sucked.",
+			})
+			return
+		}
+		if strings.Contains(path, "/myproblem") {
+			errorPages.Write(w, req, &server.HandlerError{
+				StatusCode:   int(response.STATUS_INTERNAL_SERVER_ERROR),
+				ErrorMessage: "Okay, you know what? This one is on me.",
+			})
+			return
+		}
+
+		if strings.Contains(path, "/video") {
+			bytes, err := os.ReadFile("../.././assets/vim.mp4")
+			if err != nil {
+				slog.Info("unable to read video", "err", err)
 				return
 			}
-			if strings.Contains(path, "/myproblem") {
-				defaultHeaders.Set("Content-Length", fmt.Sprintf("%d", len(internalServerErrorHtml)))
-				w.WriteStatusLine(500)
-				w.WriteHeaders(defaultHeaders)
-				w.WriteBody([]byte(internalServerErrorHtml))
-				return
+			defaultHeaders.Set("Content-Length", fmt.Sprintf("%d",len(bytes)))
+			defaultHeaders.Set("Content-Type", "video/mp4")
+			w.WriteStatusLine(200)
+			w.WriteHeaders(defaultHeaders)
+			w.WriteBody(bytes)
+			return
+		}
+
+		if after, ok := strings.CutPrefix(path, "/httpbin/"); ok {
+			proxyHttpbin(w, req, after)
+			return
+		}
+
+		if path == "/ws/stats" {
+			streamStats(w, req, stats)
+			return
+		}
+
+		if path == "/events/stats" {
+			sendStatsEvents(w, req, stats)
+			return
+		}
+
+		if path == "/upload" && req.RequestLine.Method == "POST" {
+			handleUpload(w, req)
+			return
+		}
+
+		if path == "/stats" {
+			jsonio.Write(w, response.STATUS_OK, stats())
+			return
+		}
+
+		defaultHeaders.Set("Content-Length", fmt.Sprintf("%d", len(okHtml)))
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(defaultHeaders)
+		w.WriteBody([]byte(okHtml))
+	},
+		accesslog.Middleware(accesslog.Options{Format: logFormat, Output: logOutput}),
+		metrics.Middleware(registry, metrics.Options{
+			Path:   *metricsPath,
+			Routes: []string{"/", "/httpbin", "/video", "/upload", "/stats", "/ws", "/events", "/yourproblem", "/myproblem"},
+		}),
+		compress.Middleware(compress.Options{}),
+	)
+	if *devTLS {
+		dir := *devTLSDir
+		if dir == "" {
+			cacheDir, cacheErr := os.UserCacheDir()
+			if cacheErr != nil {
+				log.Fatalf("Error finding cache directory, use -dev-tls-dir: %v", cacheErr)
+			}
+			dir = filepath.Join(cacheDir, "httpserver", "dev-tls")
+		}
+		cert, caPath, devErr := devCertificate(dir)
+		if devErr != nil {
+			log.Fatalf("Error creating development certificate: %v", devErr)
+		}
+		tlsCerts = append(tlsCerts, cert)
+		log.Printf("Serving development certificate, trust the CA at %s to avoid warnings", caPath)
+	}
+	// Registered before listening, a restart signal sent as soon as the
+	// listener exists would otherwise kill the process
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, restartSignals...)...)
+	inherited, err := server.InheritedListeners()
+	if err != nil {
+		log.Fatalf("Error using inherited listeners: %v", err)
+	}
+	var listener net.Listener
+	switch {
+	case len(inherited) > 0:
+		// Socket activated by systemd, or handed over by a restart
+		listener = inherited[0]
+	case *unixSocket != "":
+		listener, err = server.ListenUnix(*unixSocket, 0o660)
+	default:
+		listener, err = server.ListenTCP(*listenHost, port)
+	}
+	if err != nil {
+		log.Fatalf("Error listening: %v", err)
+	}
+	// Restarts hand over the raw listener, the wrapper only exists in here
+	serving := listener
+	if *proxyProtocol != "" {
+		var trusted []netip.Prefix
+		for _, cidr := range strings.Split(*proxyProtocol, ",") {
+			prefix, cidrErr := netip.ParsePrefix(strings.TrimSpace(cidr))
+			if cidrErr != nil {
+				log.Fatalf("Error parsing -proxy-protocol: %v", cidrErr)
 			}
+			trusted = append(trusted, prefix)
+		}
+		serving = proxyproto.NewListener(listener, trusted)
+	}
+	opts := []server.Option{server.WithStreamingBodies(1 << 20)}
+	var srv *server.Server
+	if len(tlsCerts) > 0 {
+		authMode, authErr := server.ParseClientAuth(*clientAuth)
+		if authErr != nil {
+			log.Fatal(authErr)
+		}
+		tlsOpts := server.TLSOptions{
+			Certificates:   tlsCerts,
+			ReloadInterval: 30 * time.Second,
+			ClientAuth:     authMode,
+		}
+		if *clientCAs != "" {
+			tlsOpts.ClientCAFiles = strings.Split(*clientCAs, ",")
+		}
+		srv, err = server.ServeTLSListener(serving, handler, tlsOpts, opts...)
+	} else {
+		if *h2c {
+			opts = append(opts, server.WithH2C())
+		}
+		srv = server.ServeListener(serving, handler, opts...)
+	}
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+	// Only now can a restarting parent stop, everything above may still fail
+	server.NotifyReady()
+	srv.RegisterStats("upstream.httpbin", func() any { return httpbin.Stats() })
+	metrics.RegisterServer(registry, srv.Stats)
+	current.Store(srv)
+	log.Println("Server started on", listener.Addr())
 
-			if strings.Contains(path, "/video") {
-				bytes, err := os.ReadFile("../.././assets/vim.mp4")
-				if err != nil {
-					slog.Info("%s", err)
-					return
-				}
-				defaultHeaders.Set("Content-Length", fmt.Sprintf("%d",len(bytes)))
-				defaultHeaders.Set("Content-Type", "video/mp4")
-				w.WriteStatusLine(200)
-				w.WriteHeaders(defaultHeaders)
-				w.WriteBody(bytes)
+	for {
+		sig := <-sigChan
+		if !slices.Contains(restartSignals, sig) {
+			break
+		}
+		process, restartErr := server.Reexec(listener)
+		if restartErr == nil {
+			log.Printf("Restarted as pid %d, draining connections", process.Pid)
+			break
+		}
+		log.Printf("Error restarting, still serving: %v", restartErr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Connections still open after %s were closed", shutdownTimeout)
+	}
+	log.Println("Server gracefully stopped")
+}
+
+// httpbinHeader is the end-to-end part of the client's request header.
+func httpbinHeader(req *request.Request) http.Header {
+	header := http.Header{}
+	for key, value := range proxy.StripHopByHop(req.Headers) {
+		switch key {
+		// Host and length are set for the upstream request itself, and the
+		// transport only decodes bodies when it picked the encoding
+		case "host", "content-length", "accept-encoding":
+			continue
+		}
+		header.Set(key, value)
+	}
+	return header
+}
+
+// proxyHttpbin streams the upstream response back as a chunked body with
+// content hash trailers. Nothing is written until the upstream has answered
+// so failures can still be reported with a proper status code.
+func proxyHttpbin(w *response.Writer, req *request.Request, path string) {
+	body := req.Body
+	if req.IsStreamed() {
+		// Retries resend the body, so a streamed one is read in full first
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.BodyReader(), maxHttpbinBody+1))
+		if err != nil {
+			return
+		}
+		if len(body) > maxHttpbinBody {
+			errorPages.Write(w, req, &server.HandlerError{
+				StatusCode:   int(response.STATUS_PAYLOAD_TOO_LARGE),
+				ErrorMessage: "Bodies sent to httpbin are limited to 16 MiB.",
+			})
+			return
+		}
+	}
+	res, err := httpbin.Do(req.Context(), req.RequestLine.Method, path, httpbinHeader(req), body)
+	if err != nil {
+		var openErr *upstream.OpenError
+		if errors.As(err, &openErr) {
+			w.OnWriteHeaders(func(_ response.StatusCode, h headers.Headers) {
+				h.Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(openErr.RetryAfter.Seconds()))))
+			})
+			errorPages.Write(w, req, &server.HandlerError{
+				StatusCode:   int(response.STATUS_SERVICE_UNAVAILABLE),
+				ErrorMessage: "httpbin is unavailable, try again later.",
+			})
+			return
+		}
+
+		status := response.STATUS_BAD_GATEWAY
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = response.STATUS_GATEWAY_TIMEOUT
+		}
+		errorPages.Write(w, req, &server.HandlerError{
+			StatusCode:   int(status),
+			ErrorMessage: "httpbin did not answer.",
+		})
+		return
+	}
+	defer res.Body.Close()
+
+	defaultHeaders := response.GetDefaultHeaders(0)
+	w.WriteStatusLine(response.StatusCode(res.StatusCode))
+	defaultHeaders.Remove("Content-Length")
+	defaultHeaders.Set("Transfer-Encoding", "chunked")
+	defaultHeaders.Set("Trailer", "X-Content-SHA256, X-Content-Length")
+	if contentType := res.Header.Get("Content-Type"); contentType != "" {
+		defaultHeaders.Set("Content-Type", contentType)
+	}
+	w.WriteHeaders(defaultHeaders)
+
+	buf := make([]byte, 1024)
+	total := strings.Builder{}
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			total.Write(buf[:n])
+			w.WriteChunkedBody(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Without the last chunk the client can tell the body is cut short
+			log.Printf("Error reading httpbin response for %s: %v", path, err)
+			return
+		}
+	}
+	w.WriteChunkedBodyDone()
+	content := total.String()
+	contentLen := len(content)
+	contentSha := sha256.Sum256([]byte(content))
+
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Content-SHA256", fmt.Sprintf("%x", contentSha))
+	trailers.Set("X-Content-Length", fmt.Sprintf("%d", contentLen))
+	w.WriteTrailers(trailers)
+}
+
+type uploadedPart struct {
+	Field    string `json:"field"`
+	FileName string `json:"filename,omitempty"`
+	Size     int64  `json:"size"`
+}
+
+// handleUpload reads a multipart/form-data upload part by part and reports
+// what was received. Parts are discarded once counted.
+func handleUpload(w *response.Writer, req *request.Request) {
+	writeError := func(statusCode response.StatusCode, err error) {
+		errorPages.Write(w, req, &server.HandlerError{StatusCode: int(statusCode), ErrorMessage: err.Error()})
+	}
+
+	mr, err := req.MultipartReader(request.MultipartOptions{MaxTotalSize: 1 << 30})
+	if err != nil {
+		writeError(response.STATUS_UNSUPPORTED_MEDIA, err)
+		return
+	}
+
+	parts := []uploadedPart{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, request.ERROR_PART_TOO_LARGE) || errors.Is(err, request.ERROR_FORM_TOO_LARGE) {
+			writeError(response.STATUS_PAYLOAD_TOO_LARGE, err)
+			return
+		}
+		if err != nil {
+			writeError(response.STATUS_BAD_REQUEST, err)
+			return
+		}
+		parts = append(parts, uploadedPart{Field: part.FormName, FileName: part.FileName, Size: part.Size})
+		part.Remove()
+	}
+
+	jsonio.Write(w, response.STATUS_OK, parts)
+}
+
+// streamStats upgrades to a websocket and pushes a stats snapshot every
+// second until the client goes away.
+func streamStats(w *response.Writer, req *request.Request, stats func() server.Stats) {
+	conn, err := websocket.Upgrade(w, req, websocket.Options{})
+	if err != nil {
+		return
+	}
+
+	// The reader sees the close frame or a failure first and stops the
+	// writer through done
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
 				return
 			}
+		}
+	}()
 
-			if after, ok := strings.CutPrefix(path, "/httpbin/"); ok {
-				w.WriteStatusLine(response.STATUS_OK)
-				defaultHeaders.Remove("Content-Length")
-				defaultHeaders.Set("Transfer-Encoding", "chunked")
-				defaultHeaders.Set("Trailer", "X-Content-SHA256, X-Content-Length")
-				w.WriteHeaders(defaultHeaders)
-				proxied := "https://httpbin.org/" + after
-				res, err := http.Get(proxied)
+	go func() {
+		// A failed write leaves the reader blocked until the connection
+		// goes, so take it down
+		defer conn.Close(websocket.CloseGoingAway, "")
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				body, err := json.Marshal(stats())
 				if err != nil {
-					return
+					continue
 				}
-				buf := make([]byte, 1024)
-				total := strings.Builder{}
-				for {
-					n, err := res.Body.Read(buf)
-					if err != nil {
-						break
-					}
-					total.Write(buf[:n])
-					w.WriteChunkedBody(buf[:n])
+				err = conn.WriteMessage(websocket.OpText, body)
+				if err != nil {
+					return
 				}
-				w.WriteChunkedBodyDone()
-				content := total.String()
-				contentLen := len(content)
-				contentSha := sha256.Sum256([]byte(content))
-
-				trailers := headers.NewHeaders()
-				trailers.Set("X-Content-SHA256", fmt.Sprintf("%x", contentSha))
-				trailers.Set("X-Content-Length", fmt.Sprintf("%d", contentLen))
-				w.WriteTrailers(trailers)
-				return
 			}
+		}
+	}()
+}
 
-			defaultHeaders.Set("Content-Length", fmt.Sprintf("%d", len(okHtml)))
-			w.WriteStatusLine(500)
-			w.WriteHeaders(defaultHeaders)
-			w.WriteBody([]byte(okHtml))
-		},
-	)
+// sendStatsEvents is the server-sent events counterpart of streamStats. Event
+// ids count up so a reconnecting client carries on from where it left off.
+func sendStatsEvents(w *response.Writer, req *request.Request, stats func() server.Stats) {
+	stream, err := sse.NewStream(w, req, sse.Options{})
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		return
 	}
-	defer server.Close()
-	log.Println("Server started on port", port)
+	defer stream.Close()
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-	log.Println("Server gracefully stopped")
+	id, _ := strconv.Atoi(stream.LastEventID())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stream.Done():
+			return
+		case <-ticker.C:
+			body, err := json.Marshal(stats())
+			if err != nil {
+				continue
+			}
+			id++
+			err = stream.Send(sse.Event{ID: strconv.Itoa(id), Event: "stats", Data: string(body)})
+			if err != nil {
+				return
+			}
+		}
+	}
 }
 
-const badRequestHtml = `<html>
-  <head>
-    <title>400 Bad Request</title>
-  </head>
-  <body>
-    <h1>Bad Request</h1>
-    <p>Your request honestly kinda sucked.</p>
-  </body>
-</html>`
-
-const internalServerErrorHtml = `<html>
-  <head>
-    <title>500 Internal Server Error</title>
-  </head>
-  <body>
-    <h1>Internal Server Error</h1>
-    <p>Okay, you know what? This one is on me.</p>
-  </body>
-</html>`
-
 const okHtml = `<html>
   <head>
     <title>200 OK</title>
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// restartSignals is empty where there is no SIGUSR2.
+var restartSignals []os.Signal
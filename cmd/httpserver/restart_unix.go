@@ -0,0 +1,12 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignals hand the listener over to a freshly started copy of the
+// binary, see server.Reexec.
+var restartSignals = []os.Signal{syscall.SIGUSR2}
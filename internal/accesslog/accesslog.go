@@ -0,0 +1,184 @@
+package accesslog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"dev.grab-a-byte.network/internal/server"
+)
+
+type Format int
+
+const (
+	// FormatCommon is the Apache Common Log Format.
+	FormatCommon Format = iota
+	// FormatCombined is Common followed by the Referer and User-Agent.
+	FormatCombined
+	// FormatJSON writes one slog JSON record per request with every field.
+	FormatJSON
+)
+
+// ParseFormat accepts the names used on the command line: common, combined
+// and json.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "common":
+		return FormatCommon, nil
+	case "combined":
+		return FormatCombined, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("unknown access log format %q", name)
+}
+
+type Options struct {
+	Format Format
+	// Output receives the log lines, defaults to os.Stdout. Use OpenFile
+	// for a file that rotates by size.
+	Output io.Writer
+	// Logger, when set, is used for FormatJSON instead of a JSON handler on
+	// Output, so records can go through an existing slog setup.
+	Logger *slog.Logger
+}
+
+// Entry is everything recorded about one request.
+type Entry struct {
+	Time       time.Time
+	Method     string
+	Target     string
+	Proto      string
+	Status     int
+	Bytes      int64
+	Duration   time.Duration
+	RemoteAddr string
+	Referer    string
+	UserAgent  string
+	RequestID  string
+}
+
+// clfTime is the timestamp layout of the Common Log Format.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// Common formats e as a Common Log Format line, without the newline.
+func (e Entry) Common() string {
+	return fmt.Sprintf("%s - - [%s] %q %d %s",
+		orDash(host(e.RemoteAddr)),
+		e.Time.Format(clfTime),
+		e.Method+" "+e.Target+" "+e.Proto,
+		e.Status,
+		bytesField(e.Bytes),
+	)
+}
+
+// Combined formats e as a Combined Log Format line, without the newline.
+func (e Entry) Combined() string {
+	return fmt.Sprintf("%s %q %q", e.Common(), orDash(e.Referer), orDash(e.UserAgent))
+}
+
+func (e Entry) attrs() []slog.Attr {
+	return []slog.Attr{
+		slog.String("method", e.Method),
+		slog.String("target", e.Target),
+		slog.String("proto", e.Proto),
+		slog.Int("status", e.Status),
+		slog.Int64("bytes", e.Bytes),
+		slog.Duration("duration", e.Duration),
+		slog.String("remote_addr", e.RemoteAddr),
+		slog.String("referer", e.Referer),
+		slog.String("user_agent", e.UserAgent),
+		slog.String("request_id", e.RequestID),
+	}
+}
+
+func host(addr string) string {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return h
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// bytesField is %b of Apache, a dash rather than 0 for an empty body.
+func bytesField(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// Middleware logs every request once the handler has returned, or panicked.
+// It should be the outermost middleware so the byte count reflects what was
+// sent.
+func Middleware(opts Options) server.Middleware {
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.New(slog.NewJSONHandler(opts.Output, nil))
+	}
+	// Lines from concurrent requests must not interleave
+	mu := &sync.Mutex{}
+	write := func(e Entry) {
+		switch opts.Format {
+		case FormatJSON:
+			logger.LogAttrs(context.Background(), slog.LevelInfo, "request", e.attrs()...)
+		case FormatCombined:
+			mu.Lock()
+			fmt.Fprintln(opts.Output, e.Combined())
+			mu.Unlock()
+		default:
+			mu.Lock()
+			fmt.Fprintln(opts.Output, e.Common())
+			mu.Unlock()
+		}
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			started := time.Now()
+			returned := false
+			defer func() {
+				status := w.StatusCode()
+				// The server answers a panic with a 500 once it reaches it
+				if !returned && status == 0 {
+					status = response.STATUS_INTERNAL_SERVER_ERROR
+				}
+				e := Entry{
+					Time:       started,
+					Method:     req.RequestLine.Method,
+					Target:     req.RequestLine.RequestTarget,
+					Proto:      "HTTP/" + req.RequestLine.HttpVersion,
+					Status:     int(status),
+					Bytes:      w.BytesWritten(),
+					Duration:   time.Since(started),
+					RemoteAddr: req.RemoteAddr,
+					RequestID:  req.ID(),
+				}
+				e.Referer, _ = req.Headers.Get("Referer")
+				e.UserAgent, _ = req.Headers.Get("User-Agent")
+				write(e)
+			}()
+			next(w, req)
+			returned = true
+		}
+	}
+}
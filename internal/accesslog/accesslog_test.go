@@ -0,0 +1,142 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"dev.grab-a-byte.network/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntryFormats(t *testing.T) {
+	e := Entry{
+		Time:       time.Date(2000, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60)),
+		Method:     "GET",
+		Target:     "/apache_pb.gif",
+		Proto:      "HTTP/1.1",
+		Status:     200,
+		Bytes:      2326,
+		RemoteAddr: "127.0.0.1:51234",
+		Referer:    "http://www.example.com/start.html",
+		UserAgent:  "Mozilla/4.08 [en] (Win98; I ;Nav)",
+	}
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326`, e.Common())
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`, e.Combined())
+
+	// Test: Missing values are dashes
+	e = Entry{Time: e.Time, Method: "HEAD", Target: "/", Proto: "HTTP/1.1", Status: 204}
+	assert.Equal(t, `- - - [10/Oct/2000:13:55:36 -0700] "HEAD / HTTP/1.1" 204 - "-" "-"`, e.Combined())
+}
+
+func serve(t *testing.T, opts Options) {
+	t.Helper()
+	serveWith(t, opts, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.STATUS_CREATED)
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		w.WriteBody([]byte("hello"))
+	})
+}
+
+func serveWith(t *testing.T, opts Options, handler server.Handler) {
+	t.Helper()
+	req := &request.Request{
+		Headers:     headers.NewHeaders(),
+		RequestLine: request.RequestLine{Method: "POST", RequestTarget: "/things?x=1", HttpVersion: "1.1"},
+		RemoteAddr:  "[::1]:4000",
+	}
+	req.Headers.Set("User-Agent", "curl/8.0")
+
+	Middleware(opts)(handler)(response.NewWriter(&strings.Builder{}), req)
+}
+
+func TestMiddleware(t *testing.T) {
+	// Test: Combined line with the body size
+	out := &bytes.Buffer{}
+	serve(t, Options{Format: FormatCombined, Output: out})
+	line := out.String()
+	assert.True(t, strings.HasPrefix(line, "::1 - - ["), line)
+	assert.Contains(t, line, `"POST /things?x=1 HTTP/1.1" 201 5 "-" "curl/8.0"`+"\n")
+
+	// Test: JSON record has every field
+	out.Reset()
+	serve(t, Options{Format: FormatJSON, Output: out})
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, "request", record["msg"])
+	assert.Equal(t, "POST", record["method"])
+	assert.Equal(t, float64(201), record["status"])
+	assert.Equal(t, float64(5), record["bytes"])
+	assert.Equal(t, "[::1]:4000", record["remote_addr"])
+	assert.Equal(t, "curl/8.0", record["user_agent"])
+	assert.Contains(t, record, "duration")
+	assert.Contains(t, record, "request_id")
+
+	// Test: Panicking handlers are logged with the 500 the server sends
+	out.Reset()
+	assert.Panics(t, func() {
+		serveWith(t, Options{Format: FormatCommon, Output: out}, func(w *response.Writer, req *request.Request) {
+			panic("boom")
+		})
+	})
+	assert.Contains(t, out.String(), `"POST /things?x=1 HTTP/1.1" 500 -`)
+}
+
+func TestParseFormat(t *testing.T) {
+	format, err := ParseFormat("JSON")
+	require.NoError(t, err)
+	assert.Equal(t, FormatJSON, format)
+	_, err = ParseFormat("xml")
+	assert.Error(t, err)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := OpenFile(path, 10, 2)
+	require.NoError(t, err)
+	defer rf.Close()
+
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		_, err := rf.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	read := func(name string) string {
+		content, err := os.ReadFile(name)
+		require.NoError(t, err)
+		return string(content)
+	}
+	assert.Equal(t, "dddddd\n", read(path))
+	assert.Equal(t, "cccccc\n", read(path+".1"))
+	assert.Equal(t, "bbbbbb\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: A failed rotation keeps writing to the current file
+	path = filepath.Join(t.TempDir(), "access.log")
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "in-the-way"), 0o755))
+	rf, err = OpenFile(path, 10, 1)
+	require.NoError(t, err)
+	defer rf.Close()
+	_, err = rf.Write([]byte("aaaaaa\n"))
+	require.NoError(t, err)
+	n, err := rf.Write([]byte("bbbbbb\n"))
+	assert.Error(t, err)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, "aaaaaa\nbbbbbb\n", read(path))
+
+	// Test: Rotation picks up again once it can
+	require.NoError(t, os.RemoveAll(path+".1"))
+	_, err = rf.Write([]byte("cccccc\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "cccccc\n", read(path))
+	assert.Equal(t, "aaaaaa\nbbbbbb\n", read(path+".1"))
+}
@@ -0,0 +1,193 @@
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/negotiate"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"dev.grab-a-byte.network/internal/server"
+)
+
+type Options struct {
+	// MinSize is the smallest Content-Length worth compressing. Responses
+	// without a Content-Length are always candidates. Zero means
+	// DefaultMinSize.
+	MinSize int
+	// Level is passed to the gzip and zlib writers, zero means the
+	// library default.
+	Level int
+}
+
+const DefaultMinSize = 1024
+
+// skipTypes are media types that are already compressed, matched by prefix.
+var skipTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+	"application/pdf",
+	"application/octet-stream",
+	// Event streams are flushed per event, buffering them in a compressor
+	// would hold events back
+	"text/event-stream",
+}
+
+// Middleware compresses response bodies with gzip or deflate when the client
+// accepts it and the response is worth compressing.
+func Middleware(opts Options) server.Middleware {
+	if opts.MinSize == 0 {
+		opts.MinSize = DefaultMinSize
+	}
+	if opts.Level == 0 {
+		opts.Level = gzip.DefaultCompression
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			// A successful CONNECT response is followed by a raw tunnel
+			if req.RequestLine.Method == "CONNECT" {
+				next(w, req)
+				return
+			}
+
+			acceptEncoding, _ := req.Headers.Get("Accept-Encoding")
+			encoding := Negotiate(acceptEncoding)
+			isHead := req.RequestLine.Method == "HEAD"
+
+			w.OnWriteHeaders(func(statusCode response.StatusCode, h headers.Headers) {
+				if !compressible(statusCode, h) {
+					return
+				}
+				negotiate.AddVary(h, "Accept-Encoding")
+
+				if encoding == "" || isHead || tooSmall(h, opts.MinSize) {
+					return
+				}
+
+				h.Set("Content-Encoding", encoding)
+				h.Remove("Content-Length")
+				h.Set("Transfer-Encoding", "chunked")
+				w.EncodeBody(func(dst io.Writer) io.WriteCloser {
+					return newEncoder(encoding, dst, opts.Level)
+				})
+			})
+
+			next(w, req)
+		}
+	}
+}
+
+func newEncoder(encoding string, w io.Writer, level int) io.WriteCloser {
+	if encoding == "deflate" {
+		zw, err := zlib.NewWriterLevel(w, level)
+		if err != nil {
+			return zlib.NewWriter(w)
+		}
+		return zw
+	}
+	gw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return gzip.NewWriter(w)
+	}
+	return gw
+}
+
+func compressible(statusCode response.StatusCode, h headers.Headers) bool {
+	if statusCode < 200 || statusCode == response.STATUS_NO_CONTENT || statusCode == response.STATUS_NOT_MODIFIED {
+		return false
+	}
+	if _, ok := h.Get("Content-Encoding"); ok {
+		return false
+	}
+	contentType, _ := h.Get("Content-Type")
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if contentType == "image/svg+xml" {
+		return true
+	}
+	for _, prefix := range skipTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func tooSmall(h headers.Headers, minSize int) bool {
+	value, ok := h.Get("Content-Length")
+	if !ok {
+		return false
+	}
+	length, err := strconv.Atoi(value)
+	return err == nil && length < minSize
+}
+
+// Negotiate picks gzip or deflate from an Accept-Encoding value, preferring
+// the higher q-value and gzip on a tie. It returns an empty string when the
+// response should be sent uncompressed.
+func Negotiate(acceptEncoding string) string {
+	qualities := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, q := parseQuality(part)
+		if name == "" {
+			continue
+		}
+		if name == "*" {
+			wildcard = q
+			continue
+		}
+		qualities[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, name := range []string{"gzip", "deflate"} {
+		q, ok := qualities[name]
+		if !ok && name == "gzip" {
+			q, ok = qualities["x-gzip"]
+		}
+		if !ok {
+			if wildcard < 0 {
+				continue
+			}
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+
+	return best
+}
+
+// parseQuality splits a list element such as "gzip;q=0.8" into a lowercase
+// token and its weight, defaulting to 1.
+func parseQuality(element string) (string, float64) {
+	name, params, _ := strings.Cut(element, ";")
+	name = strings.ToLower(strings.TrimSpace(name))
+	q := 1.0
+	for _, param := range strings.Split(params, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok || strings.ToLower(strings.TrimSpace(key)) != "q" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			return "", 0
+		}
+		q = parsed
+	}
+	return name, q
+}
@@ -0,0 +1,123 @@
+package compress
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiate(t *testing.T) {
+	assert.Equal(t, "gzip", Negotiate("gzip, deflate, br"))
+	assert.Equal(t, "deflate", Negotiate("gzip;q=0.5, deflate"))
+	assert.Equal(t, "gzip", Negotiate("*"))
+	assert.Equal(t, "deflate", Negotiate("*;q=0.5, gzip;q=0"))
+	assert.Equal(t, "", Negotiate("br"))
+	assert.Equal(t, "", Negotiate(""))
+	assert.Equal(t, "", Negotiate("gzip;q=0"))
+	assert.Equal(t, "gzip", Negotiate("x-gzip"))
+}
+
+func serve(t *testing.T, acceptEncoding string, handler func(w *response.Writer)) *http.Response {
+	t.Helper()
+	builder := &strings.Builder{}
+	w := response.NewWriter(builder)
+	req := &request.Request{Headers: headers.NewHeaders(), RequestLine: request.RequestLine{Method: "GET"}}
+	if acceptEncoding != "" {
+		req.Headers.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	Middleware(Options{MinSize: 16})(func(w *response.Writer, req *request.Request) {
+		handler(w)
+	})(w, req)
+
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(builder.String())), nil)
+	require.NoError(t, err)
+	return res
+}
+
+func writeBody(body string, contentType string) func(w *response.Writer) {
+	return func(w *response.Writer) {
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("Content-Type", contentType)
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	body := strings.Repeat("compress me please ", 50)
+
+	// Test: Fixed length body is gzipped and sent chunked
+	res := serve(t, "gzip", writeBody(body, "text/html"))
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	gr, err := gzip.NewReader(res.Body)
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(gr)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(decoded))
+
+	// Test: Deflate
+	res = serve(t, "deflate", writeBody(body, "application/json"))
+	assert.Equal(t, "deflate", res.Header.Get("Content-Encoding"))
+	zr, err := zlib.NewReader(res.Body)
+	require.NoError(t, err)
+	decoded, err = io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(decoded))
+
+	// Test: Small bodies are left alone but still vary
+	res = serve(t, "gzip", writeBody("tiny", "text/html"))
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.Equal(t, int64(4), res.ContentLength)
+
+	// Test: Already compressed types are left alone
+	res = serve(t, "gzip", writeBody(body, "video/mp4"))
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Empty(t, res.Header.Get("Vary"))
+
+	// Test: Client without gzip support
+	res = serve(t, "", writeBody(body, "text/html"))
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	raw, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(raw))
+}
+
+func TestMiddlewareChunkedWithTrailers(t *testing.T) {
+	res := serve(t, "gzip", func(w *response.Writer) {
+		h := response.GetDefaultHeaders(0)
+		h.Remove("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Content-Length")
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("first chunk, "))
+		w.WriteChunkedBody([]byte("second chunk"))
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Content-Length", "25")
+		w.WriteTrailers(trailers)
+	})
+
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	gr, err := gzip.NewReader(res.Body)
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(gr)
+	require.NoError(t, err)
+	assert.Equal(t, "first chunk, second chunk", string(decoded))
+	assert.Equal(t, "25", res.Trailer.Get("X-Content-Length"))
+}
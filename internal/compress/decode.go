@@ -0,0 +1,126 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"dev.grab-a-byte.network/internal/server"
+)
+
+var ERROR_UNSUPPORTED_ENCODING = errors.New("unsupported content encoding")
+var ERROR_BODY_TOO_LARGE = errors.New("decoded body too large")
+
+type DecodeOptions struct {
+	// MaxSize bounds the decoded body so a small compressed upload can't
+	// expand into something huge. Zero means DefaultMaxDecodedSize.
+	MaxSize int64
+}
+
+const DefaultMaxDecodedSize = 10 << 20
+
+// DecodeRequest transparently decodes request bodies sent with a gzip or
+// deflate Content-Encoding. Handlers see the decoded bytes in Body and no
+// Content-Encoding header. Unsupported encodings are answered with 415 and
+// bodies that decode past MaxSize with 413.
+func DecodeRequest(opts DecodeOptions) server.Middleware {
+	if opts.MaxSize == 0 {
+		opts.MaxSize = DefaultMaxDecodedSize
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			contentEncoding, ok := req.Headers.Get("Content-Encoding")
+			if !ok {
+				next(w, req)
+				return
+			}
+
+			encoded := req.Body
+			var err error
+			if req.IsStreamed() {
+				// Decoding needs the whole body, which can't be any larger
+				// than the decoded limit either
+				encoded, err = io.ReadAll(io.LimitReader(req.BodyReader(), opts.MaxSize+1))
+				if err == nil && int64(len(encoded)) > opts.MaxSize {
+					err = ERROR_BODY_TOO_LARGE
+				}
+			}
+			var body []byte
+			if err == nil {
+				body, err = Decode(encoded, contentEncoding, opts.MaxSize)
+			}
+			if err != nil {
+				h := response.GetDefaultHeaders(0)
+				statusCode := response.STATUS_BAD_REQUEST
+				switch {
+				case errors.Is(err, ERROR_UNSUPPORTED_ENCODING):
+					statusCode = response.STATUS_UNSUPPORTED_MEDIA
+					h.Set("Accept-Encoding", "gzip, deflate")
+				case errors.Is(err, ERROR_BODY_TOO_LARGE):
+					statusCode = response.STATUS_PAYLOAD_TOO_LARGE
+				}
+				w.WriteStatusLine(statusCode)
+				w.WriteHeaders(h)
+				return
+			}
+
+			req.SetBody(body)
+			req.Headers.Remove("Content-Encoding")
+			req.Headers.Set("Content-Length", strconv.Itoa(len(body)))
+			next(w, req)
+		}
+	}
+}
+
+// Decode undoes every coding listed in contentEncoding, last applied first,
+// reading at most maxSize decoded bytes.
+func Decode(body []byte, contentEncoding string, maxSize int64) ([]byte, error) {
+	codings := strings.Split(contentEncoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+		if coding == "" || coding == "identity" {
+			continue
+		}
+
+		reader, err := newDecoder(coding, body)
+		if err != nil {
+			return nil, err
+		}
+
+		decoded, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(decoded)) > maxSize {
+			return nil, ERROR_BODY_TOO_LARGE
+		}
+		body = decoded
+	}
+
+	return body, nil
+}
+
+func newDecoder(coding string, body []byte) (io.ReadCloser, error) {
+	switch coding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// deflate is meant to be zlib wrapped but some clients send a raw
+		// deflate stream, so fall back when there is no zlib header
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err == nil {
+			return zr, nil
+		}
+		return flate.NewReader(bytes.NewReader(body)), nil
+	}
+	return nil, ERROR_UNSUPPORTED_ENCODING
+}
@@ -0,0 +1,117 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	_, err := gw.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	// Test: gzip
+	body, err := Decode(gzipped(t, "hello"), "gzip", 100)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: zlib wrapped deflate
+	buf := &bytes.Buffer{}
+	zw := zlib.NewWriter(buf)
+	zw.Write([]byte("zlib"))
+	zw.Close()
+	body, err = Decode(buf.Bytes(), "deflate", 100)
+	require.NoError(t, err)
+	assert.Equal(t, "zlib", string(body))
+
+	// Test: raw deflate
+	buf = &bytes.Buffer{}
+	fw, _ := flate.NewWriter(buf, flate.DefaultCompression)
+	fw.Write([]byte("raw"))
+	fw.Close()
+	body, err = Decode(buf.Bytes(), "deflate", 100)
+	require.NoError(t, err)
+	assert.Equal(t, "raw", string(body))
+
+	// Test: Stacked codings are undone in reverse
+	body, err = Decode(gzipped(t, string(gzipped(t, "twice"))), "gzip, identity, gzip", 100)
+	require.NoError(t, err)
+	assert.Equal(t, "twice", string(body))
+
+	// Test: Limit applies to the decoded size
+	bomb := gzipped(t, strings.Repeat("0", 1<<20))
+	assert.Less(t, len(bomb), 4096)
+	_, err = Decode(bomb, "gzip", 1024)
+	require.ErrorIs(t, err, ERROR_BODY_TOO_LARGE)
+
+	// Test: Unsupported coding
+	_, err = Decode([]byte("x"), "br", 100)
+	require.ErrorIs(t, err, ERROR_UNSUPPORTED_ENCODING)
+}
+
+func TestDecodeRequest(t *testing.T) {
+	run := func(encoding string, body []byte) (string, *request.Request) {
+		builder := &strings.Builder{}
+		req := &request.Request{Headers: headers.NewHeaders(), Body: body}
+		req.Headers.Set("Content-Encoding", encoding)
+		var seen *request.Request
+		DecodeRequest(DecodeOptions{MaxSize: 64})(func(w *response.Writer, req *request.Request) {
+			seen = req
+		})(response.NewWriter(builder), req)
+		return builder.String(), seen
+	}
+
+	// Test: Handler sees the decoded body
+	out, seen := run("gzip", gzipped(t, "decoded"))
+	assert.Empty(t, out)
+	require.NotNil(t, seen)
+	assert.Equal(t, "decoded", string(seen.Body))
+	_, ok := seen.Headers.Get("Content-Encoding")
+	assert.False(t, ok)
+
+	// Test: Streamed bodies are read and decoded the same way
+	line := request.RequestLine{Method: "POST", RequestTarget: "/", HttpVersion: "1.1"}
+	h := headers.NewHeaders()
+	h.Set("Content-Encoding", "gzip")
+	streamed, err := request.NewRequest(line, h, nil, bytes.NewReader(gzipped(t, "streamed")))
+	require.NoError(t, err)
+	seen = nil
+	DecodeRequest(DecodeOptions{MaxSize: 64})(func(w *response.Writer, req *request.Request) {
+		seen = req
+	})(response.NewWriter(&strings.Builder{}), streamed)
+	require.NotNil(t, seen)
+	assert.False(t, seen.IsStreamed())
+	body, err := io.ReadAll(seen.BodyReader())
+	require.NoError(t, err)
+	assert.Equal(t, "streamed", string(body))
+
+	// Test: Unsupported encodings get 415
+	out, seen = run("br", []byte("x"))
+	assert.Nil(t, seen)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 415 Unsupported Media Type\r\n"))
+
+	// Test: Oversized bodies get 413
+	out, seen = run("gzip", gzipped(t, strings.Repeat("a", 65)))
+	assert.Nil(t, seen)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 "))
+
+	// Test: Corrupt bodies get 400
+	out, _ = run("gzip", []byte("not gzip"))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 "))
+}
@@ -0,0 +1,157 @@
+package cookie
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ERROR_INVALID_NAME = errors.New("invalid cookie name")
+var ERROR_INVALID_VALUE = errors.New("invalid cookie value")
+var ERROR_INVALID_ATTRIBUTE = errors.New("invalid cookie attribute")
+
+// timeFormat is the IMF-fixdate format required for Expires.
+const timeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+type SameSite int
+
+const (
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+// Cookie is a single cookie as sent by a client or set by the server.
+// Only Name and Value are populated for cookies parsed from a request.
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path    string
+	Domain  string
+	Expires time.Time
+	// MaxAge of zero leaves the attribute out, a negative value deletes the
+	// cookie by sending Max-Age=0.
+	MaxAge      int
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+// Parse reads the cookie-pairs of a Cookie header as described by RFC 6265
+// section 5.4. Malformed pairs are skipped.
+func Parse(header string) []*Cookie {
+	cookies := []*Cookie{}
+	for _, part := range strings.Split(header, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || !validName(name) {
+			continue
+		}
+		quoted := len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"'
+		if quoted {
+			value = value[1 : len(value)-1]
+		}
+		// Browsers send quoted values with spaces in them as they are
+		if !validValue(value) && !(quoted && validValue(strings.ReplaceAll(value, " ", ""))) {
+			continue
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: value})
+	}
+	return cookies
+}
+
+// Valid reports whether the cookie can be serialised as a Set-Cookie value.
+func (c *Cookie) Valid() error {
+	if !validName(c.Name) {
+		return ERROR_INVALID_NAME
+	}
+	if !validValue(c.Value) {
+		return ERROR_INVALID_VALUE
+	}
+	if strings.ContainsAny(c.Path, ";\r\n") || strings.ContainsAny(c.Domain, "; \r\n") {
+		return ERROR_INVALID_ATTRIBUTE
+	}
+	if c.SameSite == SameSiteNone && !c.Secure {
+		return fmt.Errorf("%w: SameSite=None requires Secure", ERROR_INVALID_ATTRIBUTE)
+	}
+	if c.Partitioned && !c.Secure {
+		return fmt.Errorf("%w: Partitioned requires Secure", ERROR_INVALID_ATTRIBUTE)
+	}
+	return nil
+}
+
+// String returns the Set-Cookie field value for the cookie.
+func (c *Cookie) String() string {
+	builder := strings.Builder{}
+	builder.WriteString(c.Name)
+	builder.WriteByte('=')
+	builder.WriteString(c.Value)
+
+	if c.Path != "" {
+		fmt.Fprintf(&builder, "; Path=%s", c.Path)
+	}
+	if c.Domain != "" {
+		fmt.Fprintf(&builder, "; Domain=%s", strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		fmt.Fprintf(&builder, "; Expires=%s", c.Expires.UTC().Format(timeFormat))
+	}
+	if c.MaxAge > 0 {
+		builder.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		builder.WriteString("; Max-Age=0")
+	}
+	if c.Secure {
+		builder.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		builder.WriteString("; HttpOnly")
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		builder.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		builder.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		builder.WriteString("; SameSite=None")
+	}
+	if c.Partitioned {
+		builder.WriteString("; Partitioned")
+	}
+
+	return builder.String()
+}
+
+var tokenSpecialChars = "!#$%&'*+-.^_`|~"
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		switch {
+		case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9':
+		case strings.IndexByte(tokenSpecialChars, b) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validValue checks for cookie-octets: visible US-ASCII excluding DQUOTE,
+// comma, semicolon and backslash.
+func validValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		if b < 0x21 || b > 0x7E || b == '"' || b == ',' || b == ';' || b == '\\' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package cookie
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	// Test: Standard cookie header
+	cookies := Parse("session=abc123; theme=dark")
+	require.Len(t, cookies, 2)
+	assert.Equal(t, "session", cookies[0].Name)
+	assert.Equal(t, "abc123", cookies[0].Value)
+	assert.Equal(t, "theme", cookies[1].Name)
+	assert.Equal(t, "dark", cookies[1].Value)
+
+	// Test: Quoted values, which may contain spaces
+	cookies = Parse(`a="quoted"; b="two words";c=2`)
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "quoted", cookies[0].Value)
+	assert.Equal(t, "two words", cookies[1].Value)
+	assert.Equal(t, "c", cookies[2].Name)
+
+	// Test: Spaces only separate pairs after a semicolon
+	cookies = Parse("b=1 c=2")
+	assert.Empty(t, cookies)
+
+	// Test: Invalid pairs are skipped
+	cookies = Parse("noequals; bad@name=1; ok=yes; also=bad\\value")
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "ok", cookies[0].Name)
+
+	// Test: Empty values are allowed
+	cookies = Parse("empty=")
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "", cookies[0].Value)
+}
+
+func TestString(t *testing.T) {
+	c := &Cookie{
+		Name:        "id",
+		Value:       "a3fWa",
+		Path:        "/",
+		Domain:      ".example.com",
+		Expires:     time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC),
+		MaxAge:      3600,
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteNone,
+		Partitioned: true,
+	}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, "id=a3fWa; Path=/; Domain=example.com; Expires=Wed, 21 Oct 2015 07:28:00 GMT; Max-Age=3600; Secure; HttpOnly; SameSite=None; Partitioned", c.String())
+
+	// Test: Deleting a cookie
+	c = &Cookie{Name: "id", MaxAge: -1, SameSite: SameSiteLax}
+	assert.Equal(t, "id=; Max-Age=0; SameSite=Lax", c.String())
+
+	// Test: Validation
+	require.ErrorIs(t, (&Cookie{Name: "bad name"}).Valid(), ERROR_INVALID_NAME)
+	require.ErrorIs(t, (&Cookie{Name: "a", Value: "x;y"}).Valid(), ERROR_INVALID_VALUE)
+	require.ErrorIs(t, (&Cookie{Name: "a", SameSite: SameSiteNone}).Valid(), ERROR_INVALID_ATTRIBUTE)
+	require.ErrorIs(t, (&Cookie{Name: "a", Partitioned: true}).Valid(), ERROR_INVALID_ATTRIBUTE)
+}
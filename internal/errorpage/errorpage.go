@@ -0,0 +1,172 @@
+package errorpage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/jsonio"
+	"dev.grab-a-byte.network/internal/negotiate"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+)
+
+var ERROR_INVALID_PAGE_NAME = errors.New("error page must be named after a status code or class, e.g. 404 or 4xx")
+
+var offers = negotiate.Offers{
+	Types: []string{"text/html", "application/problem+json", "application/json", "text/plain"},
+}
+
+// pageName matches the keys of a page set: a status code such as 404 or a
+// class such as 5xx.
+var pageName = regexp.MustCompile(`^[1-5]([0-9]{2}|xx)$`)
+
+// Data is passed to every error page template.
+type Data struct {
+	StatusCode int
+	Title      string
+	Message    string
+	RequestID  string
+	Method     string
+	Path       string
+}
+
+// Pages renders HTML error responses from templates keyed by status code or
+// class. The most specific template wins: 404, then 4xx, then the built-in
+// page, so every status has something sensible.
+type Pages struct {
+	templates map[string]*template.Template
+}
+
+// Default only has the built-in page.
+var Default = &Pages{templates: map[string]*template.Template{}}
+
+var builtin = template.Must(template.New("builtin").Parse(`<html>
+  <head>
+    <title>{{.StatusCode}} {{.Title}}</title>
+  </head>
+  <body>
+    <h1>{{.Title}}</h1>
+    <p>{{.Message}}</p>
+    {{- if .RequestID}}
+    <p><small>Request ID: {{.RequestID}}</small></p>
+    {{- end}}
+  </body>
+</html>`))
+
+// Parse creates a page set from template sources keyed by page name.
+func Parse(sources map[string]string) (*Pages, error) {
+	p := &Pages{templates: map[string]*template.Template{}}
+	for name, source := range sources {
+		name = strings.ToLower(name)
+		if !pageName.MatchString(name) {
+			return nil, fmt.Errorf("%w: %q", ERROR_INVALID_PAGE_NAME, name)
+		}
+		tmpl, err := template.New(name).Parse(source)
+		if err != nil {
+			return nil, err
+		}
+		p.templates[name] = tmpl
+	}
+	return p, nil
+}
+
+// Load reads every .html file in dir, named after the page it provides,
+// e.g. 404.html or 5xx.html.
+func Load(dir string) (*Pages, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+
+	sources := map[string]string{}
+	for _, path := range paths {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sources[strings.TrimSuffix(filepath.Base(path), ".html")] = string(source)
+	}
+	return Parse(sources)
+}
+
+func (p *Pages) lookup(statusCode int) *template.Template {
+	if tmpl, ok := p.templates[fmt.Sprintf("%d", statusCode)]; ok {
+		return tmpl
+	}
+	if tmpl, ok := p.templates[fmt.Sprintf("%dxx", statusCode/100)]; ok {
+		return tmpl
+	}
+	return builtin
+}
+
+// Write renders err with the built-in pages, see Pages.Write.
+func Write(w *response.Writer, req *request.Request, err error) error {
+	return Default.Write(w, req, err)
+}
+
+// Write sends err as an error response in the format the client prefers:
+// an HTML page, a problem+json document or plain text. Status and message
+// come from a *server.HandlerError, anything else is a 500 without details.
+// A client accepting none of them still gets the real status, as plain text.
+func (p *Pages) Write(w *response.Writer, req *request.Request, err error) error {
+	problem := jsonio.ProblemFromError(err)
+	statusCode := response.StatusCode(problem.Status)
+	title := response.ReasonPhrase(statusCode)
+	if problem.Detail == "" {
+		problem.Detail = title
+	}
+
+	w.OnWriteHeaders(func(_ response.StatusCode, h headers.Headers) {
+		negotiate.AddVary(h, "Accept")
+	})
+
+	// A 406 would hide the error itself, so no match falls back to text
+	result, _ := negotiate.Negotiate(req, offers)
+	switch result.Type {
+	case "application/problem+json", "application/json":
+		problem.Instance = req.RequestLine.Path
+		return jsonio.WriteProblem(w, problem)
+	case "text/html":
+		data := Data{
+			StatusCode: problem.Status,
+			Title:      title,
+			Message:    problem.Detail,
+			RequestID:  req.ID(),
+			Method:     req.RequestLine.Method,
+			Path:       req.RequestLine.Path,
+		}
+		page := &bytes.Buffer{}
+		tmplErr := p.lookup(problem.Status).Execute(page, data)
+		if tmplErr != nil {
+			log.Printf("errorpage: rendering %d: %v", problem.Status, tmplErr)
+			page.Reset()
+			builtin.Execute(page, data)
+		}
+		return write(w, statusCode, "text/html; charset=utf-8", page.String())
+	default:
+		return write(w, statusCode, "text/plain; charset=utf-8", fmt.Sprintf("%d %s: %s\n", statusCode, title, problem.Detail))
+	}
+}
+
+func write(w *response.Writer, statusCode response.StatusCode, contentType, body string) error {
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Content-Type", contentType)
+	err := w.WriteStatusLine(statusCode)
+	if err != nil {
+		return err
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteBody([]byte(body))
+	return err
+}
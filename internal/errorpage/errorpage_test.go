@@ -0,0 +1,105 @@
+package errorpage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"dev.grab-a-byte.network/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func render(t *testing.T, accept string, err error) (*http.Response, string) {
+	t.Helper()
+	req := &request.Request{Headers: headers.NewHeaders()}
+	if accept != "" {
+		req.Headers.Set("Accept", accept)
+	}
+	builder := &strings.Builder{}
+	require.NoError(t, Write(response.NewWriter(builder), req, err))
+
+	res, readErr := http.ReadResponse(bufio.NewReader(strings.NewReader(builder.String())), nil)
+	require.NoError(t, readErr)
+	body, readErr := io.ReadAll(res.Body)
+	require.NoError(t, readErr)
+	return res, string(body)
+}
+
+func TestWrite(t *testing.T) {
+	notFound := &server.HandlerError{StatusCode: 404, ErrorMessage: "No <such> page"}
+
+	// Test: Browsers get HTML
+	res, body := render(t, "text/html,application/xhtml+xml,*/*;q=0.8", notFound)
+	assert.Equal(t, 404, res.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t, "Accept", res.Header.Get("Vary"))
+	assert.Contains(t, body, "<title>404 Not Found</title>")
+	assert.Contains(t, body, "No &lt;such&gt; page")
+
+	// Test: API clients get problem+json
+	res, body = render(t, "application/json", notFound)
+	assert.Equal(t, "application/problem+json", res.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"about:blank","title":"Not Found","status":404,"detail":"No <such> page"}`, body)
+
+	// Test: Plain text
+	res, body = render(t, "text/plain", notFound)
+	assert.Equal(t, 404, res.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t, "404 Not Found: No <such> page\n", body)
+
+	// Test: Clients accepting none of the formats keep the status, as text
+	res, body = render(t, "image/png", notFound)
+	assert.Equal(t, 404, res.StatusCode)
+	assert.Equal(t, "Accept", res.Header.Get("Vary"))
+	assert.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t, "404 Not Found: No <such> page\n", body)
+
+	// Test: Unknown errors are reported as a bare 500
+	res, body = render(t, "text/plain", errors.New("secret"))
+	assert.Equal(t, 500, res.StatusCode)
+	assert.NotContains(t, body, "secret")
+}
+
+func TestPages(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "404.html"), []byte(`lost: {{.Method}} {{.Path}} ({{.RequestID}})`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "4xx.html"), []byte(`client error {{.StatusCode}}: {{.Message}}`), 0o644))
+	pages, err := Load(dir)
+	require.NoError(t, err)
+
+	write := func(statusCode int) string {
+		req := &request.Request{Headers: headers.NewHeaders(), RequestLine: request.RequestLine{Method: "GET", Path: "/<missing>"}}
+		req = req.WithContext(request.ContextWithRequestID(context.Background(), "abc123"))
+		builder := &strings.Builder{}
+		require.NoError(t, pages.Write(response.NewWriter(builder), req, &server.HandlerError{StatusCode: statusCode, ErrorMessage: "nope"}))
+		res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(builder.String())), nil)
+		require.NoError(t, err)
+		assert.Equal(t, statusCode, res.StatusCode)
+		body, _ := io.ReadAll(res.Body)
+		return string(body)
+	}
+
+	// Test: Exact status, with request details escaped
+	assert.Equal(t, "lost: GET /&lt;missing&gt; (abc123)", write(404))
+	// Test: Class fallback
+	assert.Equal(t, "client error 410: nope", write(410))
+	// Test: Built-in page for everything else
+	page := write(503)
+	assert.Contains(t, page, "<title>503 Service Unavailable</title>")
+	assert.Contains(t, page, "Request ID: abc123")
+
+	_, err = Parse(map[string]string{"oops": "x"})
+	assert.ErrorIs(t, err, ERROR_INVALID_PAGE_NAME)
+	_, err = Parse(map[string]string{"500": "{{.Missing"})
+	assert.Error(t, err)
+}
@@ -3,11 +3,11 @@ package headers
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"strings"
 )
 
 var ERROR_INVALID_FIELD_VALUE = errors.New("space before colon")
+var ERROR_INVALID_FIELD_NAME = errors.New("invalid character in field name")
 
 const whitespace = " \t"
 
@@ -75,12 +75,17 @@ func (h Headers) Parse(data []byte) (int, bool, error) {
 		}
 
 		if valid := validFieldName([]byte(key)); !valid {
-			return 0, false, fmt.Errorf("invalid character in field name")
+			return 0, false, ERROR_INVALID_FIELD_NAME
 		}
 		lowerKey := strings.ToLower(key)
 		if existing, ok := h[lowerKey]; ok {
-			newVal := fmt.Sprintf("%s %s", existing, value)
-			h[lowerKey] = newVal
+			// Repeated fields form one comma separated list, RFC 9110
+			// section 5.3, except cookies which RFC 6265 joins with "; "
+			separator := ", "
+			if lowerKey == "cookie" {
+				separator = "; "
+			}
+			h[lowerKey] = existing + separator + value
 		} else {
 			h[lowerKey] = value
 
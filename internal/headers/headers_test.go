@@ -24,10 +24,19 @@ func TestHeaderParsing(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069 another host", headers["host"])
+	assert.Equal(t, "localhost:42069, another host", headers["host"])
 	assert.Equal(t, 45, n)
 	assert.True(t, done)
 
+	// Test: Repeated list fields stay a valid list, cookies use semicolons
+	headers = NewHeaders()
+	data = []byte("Accept: text/html\r\nAccept: application/json\r\nCookie: a=1\r\nCookie: b=2\r\n\r\n")
+	_, done, err = headers.Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, "text/html, application/json", headers["accept"])
+	assert.Equal(t, "a=1; b=2", headers["cookie"])
+	assert.True(t, done)
+
 	// Test: Valid multiple header
 	headers = NewHeaders()
 	data = []byte("Host: localhost:42069\r\nMost: 42\r\n\r\n")
@@ -69,7 +78,7 @@ func TestHeaderParsing(t *testing.T) {
 	headers = NewHeaders()
 	data = []byte("H©st: localhost:42069\r\n\r\n)")
 	n, done, err = headers.Parse(data)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ERROR_INVALID_FIELD_NAME)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
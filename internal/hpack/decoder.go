@@ -0,0 +1,137 @@
+package hpack
+
+import "dev.grab-a-byte.network/internal/headers"
+
+// Decoder decodes the header blocks of one direction of a connection,
+// which must be passed to Decode in the order they were sent.
+type Decoder struct {
+	table dynamicTable
+	// limit is the largest table size the encoder may switch to, in HTTP/2
+	// the SETTINGS_HEADER_TABLE_SIZE sent to the peer
+	limit uint32
+	// maxListSize caps the decoded size of a block, 0 for no limit
+	maxListSize uint32
+}
+
+// NewDecoder returns a decoder whose dynamic table starts out, and is
+// limited to, maxTableSize bytes.
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{table: dynamicTable{maxSize: maxTableSize}, limit: maxTableSize}
+}
+
+// SetMaxTableSize changes the limit on the table size the encoder may
+// choose. Lowering it below the current size evicts entries straight away.
+func (d *Decoder) SetMaxTableSize(limit uint32) {
+	d.limit = limit
+	if d.table.maxSize > limit {
+		d.table.setMaxSize(limit)
+	}
+}
+
+// SetMaxHeaderListSize limits the decoded size of a block, counted as the
+// sum of HeaderField.Size like SETTINGS_MAX_HEADER_LIST_SIZE. Small blocks
+// can reference large table entries many times over, so without a limit a
+// peer can make Decode allocate far more than it sent. 0 removes the limit.
+func (d *Decoder) SetMaxHeaderListSize(size uint32) {
+	d.maxListSize = size
+}
+
+// Decode decodes a complete header block, RFC 7541 section 6. A failed
+// block leaves the table in an unknown state, so the connection has to be
+// closed with a COMPRESSION_ERROR. The exception is ERROR_HEADER_LIST_SIZE:
+// the rest of the block is still decoded into the table, just not returned,
+// so only the request it belongs to needs rejecting.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	var listSize uint64
+	tooLarge := false
+	for len(block) > 0 {
+		b := block[0]
+		var hf HeaderField
+		var err error
+		switch {
+		case b&0x80 != 0:
+			// Indexed field
+			var index uint64
+			index, block, err = ReadInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			hf, err = d.table.field(index)
+		case b&0xc0 == 0x40:
+			// Literal with incremental indexing
+			hf, block, err = d.readLiteral(block, 6)
+			if err == nil {
+				d.table.add(hf)
+			}
+		case b&0xe0 == 0x20:
+			// Size updates only come before the first field
+			if len(fields) > 0 {
+				return nil, ERROR_TABLE_SIZE_POSITION
+			}
+			var size uint64
+			size, block, err = ReadInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.limit) {
+				return nil, ERROR_TABLE_SIZE
+			}
+			d.table.setMaxSize(uint32(size))
+			continue
+		default:
+			// Literal without indexing, or never indexed
+			hf, block, err = d.readLiteral(block, 4)
+			hf.Sensitive = b&0xf0 == 0x10
+		}
+		if err != nil {
+			return nil, err
+		}
+		listSize += uint64(hf.Size())
+		if d.maxListSize > 0 && listSize > uint64(d.maxListSize) {
+			tooLarge = true
+		}
+		if !tooLarge {
+			fields = append(fields, hf)
+		}
+	}
+	if tooLarge {
+		return nil, ERROR_HEADER_LIST_SIZE
+	}
+	return fields, nil
+}
+
+// DecodeHeaders decodes a block straight into headers.Headers, see
+// ToHeaders for how repeated names are handled.
+func (d *Decoder) DecodeHeaders(block []byte) (headers.Headers, error) {
+	fields, err := d.Decode(block)
+	if err != nil {
+		return nil, err
+	}
+	return ToHeaders(fields), nil
+}
+
+func (d *Decoder) readLiteral(block []byte, prefix uint8) (HeaderField, []byte, error) {
+	index, rest, err := ReadInt(block, prefix)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	var hf HeaderField
+	if index > 0 {
+		named, err := d.table.field(index)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+		hf.Name = named.Name
+	} else {
+		hf.Name, rest, err = readString(rest)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+	}
+	hf.Value, rest, err = readString(rest)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	return hf, rest, nil
+}
@@ -0,0 +1,84 @@
+package hpack
+
+import "dev.grab-a-byte.network/internal/headers"
+
+// Encoder encodes the header blocks of one direction of a connection. The
+// blocks must be sent in the order they were encoded.
+type Encoder struct {
+	table   dynamicTable
+	huffman bool
+	// pendingMin is the smallest size the table went through since the
+	// last block, when the size changed
+	pendingMin    uint32
+	pendingUpdate bool
+}
+
+// NewEncoder returns an encoder whose dynamic table starts out at
+// tableSize bytes, which must match the decoder's initial size.
+func NewEncoder(tableSize uint32) *Encoder {
+	return &Encoder{table: dynamicTable{maxSize: tableSize}, huffman: true}
+}
+
+// SetHuffman turns Huffman coding of string literals on or off. When on,
+// which is the default, it is only used when it doesn't make a string
+// longer.
+func (e *Encoder) SetHuffman(enabled bool) {
+	e.huffman = enabled
+}
+
+// SetMaxTableSize changes the dynamic table size, which must not be above
+// the decoder's limit, in HTTP/2 the peer's SETTINGS_HEADER_TABLE_SIZE. The
+// decoder is told at the start of the next block.
+func (e *Encoder) SetMaxTableSize(size uint32) {
+	if size == e.table.maxSize && !e.pendingUpdate {
+		return
+	}
+	if !e.pendingUpdate || size < e.pendingMin {
+		e.pendingMin = size
+	}
+	e.pendingUpdate = true
+	e.table.setMaxSize(size)
+}
+
+// Encode appends the header block for fields to dst. Fields found in a
+// table are sent as an index, others are added to the dynamic table unless
+// they are sensitive or too large to fit.
+func (e *Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	if e.pendingUpdate {
+		// A shrink followed by a grow needs both signalled, RFC 7541
+		// section 4.2
+		if e.pendingMin < e.table.maxSize {
+			dst = AppendInt(dst, 0x20, 5, uint64(e.pendingMin))
+		}
+		dst = AppendInt(dst, 0x20, 5, uint64(e.table.maxSize))
+		e.pendingUpdate = false
+	}
+
+	for _, hf := range fields {
+		index, exact := e.table.search(hf)
+		if exact && !hf.Sensitive {
+			dst = AppendInt(dst, 0x80, 7, index)
+			continue
+		}
+
+		switch {
+		case hf.Sensitive:
+			dst = AppendInt(dst, 0x10, 4, index)
+		case hf.Size() > e.table.maxSize:
+			dst = AppendInt(dst, 0, 4, index)
+		default:
+			dst = AppendInt(dst, 0x40, 6, index)
+			e.table.add(hf)
+		}
+		if index == 0 {
+			dst = appendString(dst, hf.Name, e.huffman)
+		}
+		dst = appendString(dst, hf.Value, e.huffman)
+	}
+	return dst
+}
+
+// EncodeHeaders appends the header block for h, see FromHeaders.
+func (e *Encoder) EncodeHeaders(dst []byte, h headers.Headers) []byte {
+	return e.Encode(dst, FromHeaders(h))
+}
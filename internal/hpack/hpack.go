@@ -0,0 +1,231 @@
+// Package hpack implements HPACK, the HTTP/2 header compression format from
+// RFC 7541.
+package hpack
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"dev.grab-a-byte.network/internal/headers"
+)
+
+var ERROR_INVALID_HUFFMAN = errors.New("invalid huffman encoded string")
+var ERROR_INVALID_INDEX = errors.New("header table index out of range")
+var ERROR_INTEGER_OVERFLOW = errors.New("integer too large")
+var ERROR_TRUNCATED = errors.New("header block truncated")
+var ERROR_TABLE_SIZE = errors.New("table size update above the limit")
+var ERROR_TABLE_SIZE_POSITION = errors.New("table size update after a header field")
+var ERROR_HEADER_LIST_SIZE = errors.New("decoded header list too large")
+
+// DefaultTableSize is the dynamic table size both sides start with in
+// HTTP/2, the initial SETTINGS_HEADER_TABLE_SIZE.
+const DefaultTableSize = 4096
+
+type HeaderField struct {
+	Name  string
+	Value string
+	// Sensitive fields are never added to a dynamic table, by this encoder
+	// or by any intermediary re-encoding them, RFC 7541 section 7.1.3.
+	Sensitive bool
+}
+
+// Size is the space the field takes up in the dynamic table, RFC 7541
+// section 4.1.
+func (hf HeaderField) Size() uint32 {
+	return uint32(len(hf.Name) + len(hf.Value) + 32)
+}
+
+// staticTable is RFC 7541 Appendix A, index 1 is staticTable[0].
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// staticNames and staticFields map to the first static table index with
+// that name, or name and value.
+var staticNames = map[string]uint64{}
+var staticFields = map[HeaderField]uint64{}
+
+func init() {
+	for i := len(staticTable) - 1; i >= 0; i-- {
+		staticNames[staticTable[i].Name] = uint64(i + 1)
+		staticFields[staticTable[i]] = uint64(i + 1)
+	}
+}
+
+// FromHeaders lists h as header fields with lowercase names, sorted so the
+// encoding is the same every time.
+func FromHeaders(h headers.Headers) []HeaderField {
+	fields := make([]HeaderField, 0, len(h))
+	for name, value := range h {
+		fields = append(fields, HeaderField{Name: strings.ToLower(name), Value: value})
+	}
+	slices.SortFunc(fields, func(a, b HeaderField) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return fields
+}
+
+// ToHeaders folds fields into headers.Headers. Repeated names are joined
+// with commas, except cookies which are joined with "; " as RFC 9113
+// section 8.2.3 requires.
+func ToHeaders(fields []HeaderField) headers.Headers {
+	// Values are collected before joining, joining as they come copies
+	// everything seen so far for each repeat
+	values := map[string][]string{}
+	for _, hf := range fields {
+		name := strings.ToLower(hf.Name)
+		values[name] = append(values[name], hf.Value)
+	}
+	h := headers.NewHeaders()
+	for name, vs := range values {
+		separator := ", "
+		if name == "cookie" {
+			separator = "; "
+		}
+		h.Set(name, strings.Join(vs, separator))
+	}
+	return h
+}
+
+// AppendInt encodes value with an n-bit prefix, RFC 7541 section 5.1. The
+// remaining high bits of the first byte are taken from flags.
+func AppendInt(dst []byte, flags byte, n uint8, value uint64) []byte {
+	max := uint64(1)<<n - 1
+	if value < max {
+		return append(dst, flags|byte(value))
+	}
+	dst = append(dst, flags|byte(max))
+	value -= max
+	for value >= 0x80 {
+		dst = append(dst, byte(value&0x7f)|0x80)
+		value >>= 7
+	}
+	return append(dst, byte(value))
+}
+
+// ReadInt decodes an integer with an n-bit prefix from the start of p and
+// returns it with the rest of p.
+func ReadInt(p []byte, n uint8) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, ERROR_TRUNCATED
+	}
+	max := uint64(1)<<n - 1
+	value := uint64(p[0]) & max
+	p = p[1:]
+	if value < max {
+		return value, p, nil
+	}
+	var shift uint
+	for len(p) > 0 {
+		b := p[0]
+		p = p[1:]
+		value += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, p, nil
+		}
+		shift += 7
+		// Nothing sensible needs more than a 32 bit value
+		if shift > 28 {
+			return 0, nil, ERROR_INTEGER_OVERFLOW
+		}
+	}
+	return 0, nil, ERROR_TRUNCATED
+}
+
+// appendString encodes a string literal, Huffman coded when that's no
+// longer than the raw string.
+func appendString(dst []byte, s string, huffman bool) []byte {
+	if huffman {
+		if n := HuffmanLen(s); n <= len(s) {
+			dst = AppendInt(dst, 0x80, 7, uint64(n))
+			return AppendHuffman(dst, s)
+		}
+	}
+	dst = AppendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func readString(p []byte) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, ERROR_TRUNCATED
+	}
+	huffman := p[0]&0x80 != 0
+	length, rest, err := ReadInt(p, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(rest)) {
+		return "", nil, ERROR_TRUNCATED
+	}
+	raw := rest[:length]
+	rest = rest[length:]
+	if !huffman {
+		return string(raw), rest, nil
+	}
+	s, err := HuffmanDecode(raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return s, rest, nil
+}
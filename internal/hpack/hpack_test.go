@@ -0,0 +1,286 @@
+package hpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func fields(pairs ...string) []HeaderField {
+	out := make([]HeaderField, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		out = append(out, HeaderField{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return out
+}
+
+// tableState lists the dynamic table newest first, as the RFC prints it.
+func tableState(dt *dynamicTable) []HeaderField {
+	out := []HeaderField{}
+	for i := len(dt.entries) - 1; i >= 0; i-- {
+		out = append(out, dt.entries[i])
+	}
+	return out
+}
+
+func TestIntegers(t *testing.T) {
+	// Test: Examples from RFC 7541 Appendix C.1
+	assert.Equal(t, []byte{0x0a}, AppendInt(nil, 0, 5, 10))
+	assert.Equal(t, []byte{0x1f, 0x9a, 0x0a}, AppendInt(nil, 0, 5, 1337))
+	assert.Equal(t, []byte{0x2a}, AppendInt(nil, 0, 8, 42))
+
+	value, rest, err := ReadInt([]byte{0xff, 0x9a, 0x0a, 0x01}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1337), value)
+	assert.Equal(t, []byte{0x01}, rest)
+
+	// Test: Truncated and oversized integers are rejected
+	_, _, err = ReadInt([]byte{0x1f, 0x9a}, 5)
+	assert.ErrorIs(t, err, ERROR_TRUNCATED)
+	_, _, err = ReadInt([]byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, 5)
+	assert.ErrorIs(t, err, ERROR_INTEGER_OVERFLOW)
+}
+
+func TestHuffman(t *testing.T) {
+	for _, s := range []string{"", "www.example.com", "no-cache", "custom-key", "\x00\xff binary \x80"} {
+		encoded := AppendHuffman(nil, s)
+		assert.Len(t, encoded, HuffmanLen(s))
+		decoded, err := HuffmanDecode(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, s, decoded)
+	}
+	assert.Equal(t, unhex(t, "f1e3 c2e5 f23a 6ba0 ab90 f4ff"), AppendHuffman(nil, "www.example.com"))
+
+	// Test: Padding that isn't EOS, or is a byte or longer, is rejected
+	_, err := HuffmanDecode([]byte{0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xfe})
+	assert.ErrorIs(t, err, ERROR_INVALID_HUFFMAN)
+	_, err = HuffmanDecode([]byte{0xff})
+	assert.ErrorIs(t, err, ERROR_INVALID_HUFFMAN)
+}
+
+func TestFieldRepresentations(t *testing.T) {
+	// Test: Literal with indexing, RFC 7541 Appendix C.2.1
+	d := NewDecoder(DefaultTableSize)
+	decoded, err := d.Decode(unhex(t, "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572"))
+	require.NoError(t, err)
+	assert.Equal(t, fields("custom-key", "custom-header"), decoded)
+	assert.Equal(t, uint32(55), d.table.size)
+
+	// Test: Literal without indexing, C.2.2
+	d = NewDecoder(DefaultTableSize)
+	decoded, err = d.Decode(unhex(t, "040c 2f73 616d 706c 652f 7061 7468"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":path", "/sample/path"), decoded)
+	assert.Empty(t, d.table.entries)
+
+	// Test: Never indexed, C.2.3
+	block := unhex(t, "1008 7061 7373 776f 7264 0673 6563 7265 74")
+	d = NewDecoder(DefaultTableSize)
+	decoded, err = d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: "password", Value: "secret", Sensitive: true}}, decoded)
+	assert.Empty(t, d.table.entries)
+	e := NewEncoder(DefaultTableSize)
+	e.SetHuffman(false)
+	assert.Equal(t, block, e.Encode(nil, decoded))
+
+	// Test: Indexed field, C.2.4
+	decoded, err = NewDecoder(DefaultTableSize).Decode([]byte{0x82})
+	require.NoError(t, err)
+	assert.Equal(t, fields(":method", "GET"), decoded)
+}
+
+// exchange is one header block of an RFC 7541 Appendix C example and the
+// dynamic table after it, newest entry first.
+type exchange struct {
+	block  string
+	fields []HeaderField
+	table  []HeaderField
+	size   uint32
+}
+
+func runExchanges(t *testing.T, tableSize uint32, huffman bool, exchanges []exchange) {
+	t.Helper()
+	e := NewEncoder(tableSize)
+	e.SetHuffman(huffman)
+	d := NewDecoder(tableSize)
+	for i, ex := range exchanges {
+		block := unhex(t, ex.block)
+		assert.Equal(t, block, e.Encode(nil, ex.fields), "encoding block %d", i+1)
+
+		decoded, err := d.Decode(block)
+		require.NoError(t, err, "decoding block %d", i+1)
+		assert.Equal(t, ex.fields, decoded, "decoding block %d", i+1)
+
+		for _, table := range []*dynamicTable{&e.table, &d.table} {
+			assert.Equal(t, ex.table, tableState(table), "table after block %d", i+1)
+			assert.Equal(t, ex.size, table.size, "table size after block %d", i+1)
+		}
+	}
+}
+
+var requestExchanges = []exchange{
+	{
+		fields: fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com"),
+		table:  fields(":authority", "www.example.com"),
+		size:   57,
+	},
+	{
+		fields: fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com", "cache-control", "no-cache"),
+		table:  fields("cache-control", "no-cache", ":authority", "www.example.com"),
+		size:   110,
+	},
+	{
+		fields: fields(":method", "GET", ":scheme", "https", ":path", "/index.html", ":authority", "www.example.com", "custom-key", "custom-value"),
+		table:  fields("custom-key", "custom-value", "cache-control", "no-cache", ":authority", "www.example.com"),
+		size:   164,
+	},
+}
+
+func withBlocks(exchanges []exchange, blocks ...string) []exchange {
+	out := make([]exchange, len(exchanges))
+	for i, ex := range exchanges {
+		ex.block = blocks[i]
+		out[i] = ex
+	}
+	return out
+}
+
+func TestRequestExamples(t *testing.T) {
+	// Test: Requests without Huffman coding, RFC 7541 Appendix C.3
+	runExchanges(t, DefaultTableSize, false, withBlocks(requestExchanges,
+		"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+		"8286 84be 5808 6e6f 2d63 6163 6865",
+		"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+	))
+
+	// Test: Requests with Huffman coding, C.4
+	runExchanges(t, DefaultTableSize, true, withBlocks(requestExchanges,
+		"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+		"8286 84be 5886 a8eb 1064 9cbf",
+		"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+	))
+}
+
+var responseExchanges = []exchange{
+	{
+		fields: fields(":status", "302", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"),
+		table:  fields("location", "https://www.example.com", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "cache-control", "private", ":status", "302"),
+		size:   222,
+	},
+	{
+		fields: fields(":status", "307", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"),
+		table:  fields(":status", "307", "location", "https://www.example.com", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "cache-control", "private"),
+		size:   222,
+	},
+	{
+		fields: fields(":status", "200", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:22 GMT", "location", "https://www.example.com",
+			"content-encoding", "gzip", "set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"),
+		table: fields("set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1", "content-encoding", "gzip", "date", "Mon, 21 Oct 2013 20:13:22 GMT"),
+		size:  215,
+	},
+}
+
+func TestResponseExamples(t *testing.T) {
+	// Test: Responses without Huffman coding and evictions, RFC 7541
+	// Appendix C.5
+	runExchanges(t, 256, false, withBlocks(responseExchanges,
+		"4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+		"4803 3330 37c1 c0bf",
+		"88c1 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3220 474d 54c0 5a04 677a 6970 7738 666f 6f3d 4153 444a 4b48 514b 425a 584f 5157 454f 5049 5541 5851 5745 4f49 553b 206d 6178 2d61 6765 3d33 3630 303b 2076 6572 7369 6f6e 3d31",
+	))
+
+	// Test: Responses with Huffman coding, C.6
+	runExchanges(t, 256, true, withBlocks(responseExchanges,
+		"4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3",
+		"4883 640e ffc1 c0bf",
+		"88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07",
+	))
+}
+
+func TestTableSizeUpdates(t *testing.T) {
+	e := NewEncoder(DefaultTableSize)
+	d := NewDecoder(DefaultTableSize)
+	block := e.Encode(nil, fields("x-first", "1"))
+	_, err := d.Decode(block)
+	require.NoError(t, err)
+
+	// Test: Shrinking then growing signals both sizes and evicts
+	e.SetMaxTableSize(0)
+	e.SetMaxTableSize(100)
+	block = e.Encode(nil, fields("x-second", "2"))
+	assert.Equal(t, []byte{0x20, 0x3f, 0x45}, block[:3])
+	decoded, err := d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields("x-second", "2"), decoded)
+	assert.Equal(t, fields("x-second", "2"), tableState(&d.table))
+	assert.Equal(t, uint32(100), d.table.maxSize)
+
+	// Test: Updates above the limit or after a field are rejected
+	_, err = NewDecoder(100).Decode([]byte{0x3f, 0xe1, 0x1f})
+	assert.ErrorIs(t, err, ERROR_TABLE_SIZE)
+	_, err = NewDecoder(100).Decode([]byte{0x82, 0x20})
+	assert.ErrorIs(t, err, ERROR_TABLE_SIZE_POSITION)
+
+	// Test: Lowering the decoder's limit evicts right away
+	d.SetMaxTableSize(0)
+	assert.Empty(t, d.table.entries)
+
+	// Test: Out of range indexes are rejected
+	_, err = NewDecoder(DefaultTableSize).Decode([]byte{0xbe})
+	assert.ErrorIs(t, err, ERROR_INVALID_INDEX)
+}
+
+func TestHeaderListSize(t *testing.T) {
+	e := NewEncoder(DefaultTableSize)
+	d := NewDecoder(DefaultTableSize)
+	d.SetMaxHeaderListSize(16 << 10)
+	big := strings.Repeat("a", 4000)
+
+	// Test: Blocks within the limit decode as usual
+	block := e.Encode(nil, fields("x-big", big))
+	decoded, err := d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields("x-big", big), decoded)
+
+	// Test: A few bytes of references to a large entry are rejected
+	bomb := append(bytes.Repeat([]byte{0xbe}, 1000), e.Encode(nil, fields("x-after", "1"))...)
+	_, err = d.Decode(bomb)
+	assert.ErrorIs(t, err, ERROR_HEADER_LIST_SIZE)
+
+	// Test: The table still follows the encoder after a rejected block
+	decoded, err = d.Decode(e.Encode(nil, fields("x-after", "1", "x-big", big)))
+	require.NoError(t, err)
+	assert.Equal(t, fields("x-after", "1", "x-big", big), decoded)
+}
+
+func TestHeaders(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.Set("X-Trace", "abc")
+
+	// Test: Headers round trip with lowercase names in a stable order
+	e := NewEncoder(DefaultTableSize)
+	block := e.EncodeHeaders(nil, h)
+	assert.Equal(t, block, NewEncoder(DefaultTableSize).EncodeHeaders(nil, h))
+	decoded, err := NewDecoder(DefaultTableSize).DecodeHeaders(block)
+	require.NoError(t, err)
+	assert.Equal(t, h, decoded)
+
+	// Test: Repeated names are joined, cookies with semicolons
+	joined := ToHeaders(fields("cookie", "a=1", "accept", "text/html", "cookie", "b=2", "accept", "*/*"))
+	assert.Equal(t, "a=1; b=2", joined["cookie"])
+	assert.Equal(t, "text/html, */*", joined["accept"])
+}
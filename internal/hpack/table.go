@@ -0,0 +1,75 @@
+package hpack
+
+// dynamicTable is the FIFO of RFC 7541 section 2.3.2. Entries are kept
+// oldest first, so index 62, the newest entry, is the last element.
+type dynamicTable struct {
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+func (dt *dynamicTable) add(hf HeaderField) {
+	hf.Sensitive = false
+	dt.entries = append(dt.entries, hf)
+	dt.size += hf.Size()
+	dt.evict()
+}
+
+// setMaxSize changes the table size, evicting entries that no longer fit.
+func (dt *dynamicTable) setMaxSize(size uint32) {
+	dt.maxSize = size
+	dt.evict()
+}
+
+// evict drops the oldest entries until the table fits. An entry larger
+// than the whole table empties it, RFC 7541 section 4.4.
+func (dt *dynamicTable) evict() {
+	drop := 0
+	for dt.size > dt.maxSize {
+		dt.size -= dt.entries[drop].Size()
+		drop++
+	}
+	if drop > 0 {
+		dt.entries = append(dt.entries[:0], dt.entries[drop:]...)
+	}
+}
+
+// field returns the entry at index in the combined static and dynamic
+// index space.
+func (dt *dynamicTable) field(index uint64) (HeaderField, error) {
+	if index == 0 {
+		return HeaderField{}, ERROR_INVALID_INDEX
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], nil
+	}
+	index -= uint64(len(staticTable))
+	if index > uint64(len(dt.entries)) {
+		return HeaderField{}, ERROR_INVALID_INDEX
+	}
+	return dt.entries[uint64(len(dt.entries))-index], nil
+}
+
+// search finds hf in either table. exact is set when the value matched
+// too, otherwise index is for the name alone or zero when not found.
+// Static entries are preferred as they never get evicted.
+func (dt *dynamicTable) search(hf HeaderField) (index uint64, exact bool) {
+	if index, ok := staticFields[HeaderField{Name: hf.Name, Value: hf.Value}]; ok {
+		return index, true
+	}
+	nameIndex := staticNames[hf.Name]
+	for i := len(dt.entries) - 1; i >= 0; i-- {
+		entry := dt.entries[i]
+		if entry.Name != hf.Name {
+			continue
+		}
+		index := uint64(len(staticTable) + len(dt.entries) - i)
+		if entry.Value == hf.Value {
+			return index, true
+		}
+		if nameIndex == 0 {
+			nameIndex = index
+		}
+	}
+	return nameIndex, false
+}
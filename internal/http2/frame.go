@@ -0,0 +1,215 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+type Flags uint8
+
+const (
+	FlagEndStream  Flags = 0x1
+	FlagAck        Flags = 0x1
+	FlagEndHeaders Flags = 0x4
+	FlagPadded     Flags = 0x8
+	FlagPriority   Flags = 0x20
+)
+
+func (f Flags) has(flag Flags) bool {
+	return f&flag != 0
+}
+
+// ErrCode is an error code from RFC 9113 section 7, sent in RST_STREAM and
+// GOAWAY frames.
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+var errCodeNames = map[ErrCode]string{
+	ErrCodeNo:                 "NO_ERROR",
+	ErrCodeProtocol:           "PROTOCOL_ERROR",
+	ErrCodeInternal:           "INTERNAL_ERROR",
+	ErrCodeFlowControl:        "FLOW_CONTROL_ERROR",
+	ErrCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	ErrCodeStreamClosed:       "STREAM_CLOSED",
+	ErrCodeFrameSize:          "FRAME_SIZE_ERROR",
+	ErrCodeRefusedStream:      "REFUSED_STREAM",
+	ErrCodeCancel:             "CANCEL",
+	ErrCodeCompression:        "COMPRESSION_ERROR",
+	ErrCodeConnect:            "CONNECT_ERROR",
+	ErrCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	ErrCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	ErrCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (e ErrCode) String() string {
+	if name, ok := errCodeNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown error code 0x%x", uint32(e))
+}
+
+// ConnectionError ends the whole connection with a GOAWAY frame.
+type ConnectionError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (ce *ConnectionError) Error() string {
+	return fmt.Sprintf("http2 connection error %s: %s", ce.Code, ce.Reason)
+}
+
+func connError(code ErrCode, reason string) *ConnectionError {
+	return &ConnectionError{Code: code, Reason: reason}
+}
+
+// streamError resets a single stream, the connection carries on.
+type streamError struct {
+	streamID uint32
+	code     ErrCode
+}
+
+func (se *streamError) Error() string {
+	return fmt.Sprintf("http2 stream %d error %s", se.streamID, se.code)
+}
+
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+type Setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+const (
+	frameHeaderLen = 9
+	// defaultMaxFrameSize is the initial SETTINGS_MAX_FRAME_SIZE, and also
+	// the smallest allowed value
+	defaultMaxFrameSize = 1 << 14
+	maxFrameSizeLimit   = 1<<24 - 1
+	defaultWindowSize   = 65535
+	maxWindowSize       = 1<<31 - 1
+)
+
+type frame struct {
+	typ      FrameType
+	flags    Flags
+	streamID uint32
+	payload  []byte
+}
+
+// readFrame reads one frame. Frames over maxSize are rejected before the
+// payload is read.
+func readFrame(r io.Reader, maxSize uint32) (*frame, error) {
+	var head [frameHeaderLen]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return nil, err
+	}
+	length := uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2])
+	if length > maxSize {
+		return nil, connError(ErrCodeFrameSize, fmt.Sprintf("frame of %d bytes", length))
+	}
+	f := &frame{
+		typ:   FrameType(head[3]),
+		flags: Flags(head[4]),
+		// The reserved bit is ignored on receipt
+		streamID: binary.BigEndian.Uint32(head[5:]) & (1<<31 - 1),
+		payload:  make([]byte, length),
+	}
+	_, err = io.ReadFull(r, f.payload)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func writeFrame(w io.Writer, typ FrameType, flags Flags, streamID uint32, payload []byte) error {
+	head := [frameHeaderLen]byte{
+		byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)),
+		byte(typ), byte(flags),
+	}
+	binary.BigEndian.PutUint32(head[5:], streamID)
+	_, err := w.Write(head[:])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+// unpad strips the padding of DATA and HEADERS frames.
+func unpad(f *frame) ([]byte, error) {
+	if !f.flags.has(FlagPadded) {
+		return f.payload, nil
+	}
+	if len(f.payload) == 0 {
+		return nil, connError(ErrCodeFrameSize, "missing pad length")
+	}
+	padding := int(f.payload[0])
+	if padding >= len(f.payload) {
+		return nil, connError(ErrCodeProtocol, "padding longer than the frame")
+	}
+	return f.payload[1 : len(f.payload)-padding], nil
+}
+
+func parseSettings(payload []byte) ([]Setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, connError(ErrCodeFrameSize, "settings length not a multiple of 6")
+	}
+	settings := make([]Setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, Setting{
+			ID:    SettingID(binary.BigEndian.Uint16(payload[i:])),
+			Value: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings, nil
+}
+
+func appendSettings(dst []byte, settings []Setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.ID))
+		dst = binary.BigEndian.AppendUint32(dst, s.Value)
+	}
+	return dst
+}
@@ -0,0 +1,385 @@
+package http2
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"dev.grab-a-byte.network/internal/hpack"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient speaks just enough HTTP/2 to drive the server in tests.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	dec  *hpack.Decoder
+	enc  *hpack.Encoder
+}
+
+func startServer(t *testing.T, ctx context.Context, handler Handler, opts Options) (*testClient, chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	served := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		served <- ServeConn(ctx, conn, handler, opts)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{t: t, conn: conn, dec: hpack.NewDecoder(hpack.DefaultTableSize), enc: hpack.NewEncoder(hpack.DefaultTableSize)}, served
+}
+
+func (c *testClient) handshake(settings ...Setting) {
+	_, err := c.conn.Write([]byte(Preface))
+	require.NoError(c.t, err)
+	c.write(FrameSettings, 0, 0, appendSettings(nil, settings))
+	f := c.read()
+	require.Equal(c.t, FrameSettings, f.typ)
+}
+
+func (c *testClient) write(typ FrameType, flags Flags, streamID uint32, payload []byte) {
+	require.NoError(c.t, writeFrame(c.conn, typ, flags, streamID, payload))
+}
+
+// read returns the next frame, skipping the connection level ones a test
+// doesn't care about.
+func (c *testClient) read() *frame {
+	for {
+		f, err := readFrame(c.conn, maxFrameSizeLimit)
+		require.NoError(c.t, err)
+		if f.typ == FrameWindowUpdate && f.streamID == 0 || f.typ == FrameSettings && f.flags.has(FlagAck) {
+			continue
+		}
+		return f
+	}
+}
+
+func (c *testClient) request(streamID uint32, method, path string, endStream bool, extra ...hpack.HeaderField) {
+	fields := append([]hpack.HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "example.test"},
+	}, extra...)
+	flags := FlagEndHeaders
+	if endStream {
+		flags |= FlagEndStream
+	}
+	c.write(FrameHeaders, flags, streamID, c.enc.Encode(nil, fields))
+}
+
+type testResponse struct {
+	fields []hpack.HeaderField
+	body   string
+	reset  ErrCode
+}
+
+// responses reads frames until n streams have ended, returning what each
+// received by stream ID.
+func (c *testClient) responses(n int) map[uint32]*testResponse {
+	responses := map[uint32]*testResponse{}
+	get := func(id uint32) *testResponse {
+		if responses[id] == nil {
+			responses[id] = &testResponse{}
+		}
+		return responses[id]
+	}
+	for ended := 0; ended < n; {
+		f := c.read()
+		switch f.typ {
+		case FrameHeaders:
+			fields, err := c.dec.Decode(f.payload)
+			require.NoError(c.t, err)
+			get(f.streamID).fields = append(get(f.streamID).fields, fields...)
+		case FrameData:
+			get(f.streamID).body += string(f.payload)
+		case FrameRSTStream:
+			get(f.streamID).reset = ErrCode(binary.BigEndian.Uint32(f.payload))
+			ended++
+			continue
+		default:
+			continue
+		}
+		if f.flags.has(FlagEndStream) {
+			ended++
+		}
+	}
+	return responses
+}
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	body, _ := io.ReadAll(req.BodyReader())
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("x-method", req.RequestLine.Method)
+	h.Set("x-path", req.RequestLine.Path)
+	h.Set("x-host", req.Headers["host"])
+	w.WriteStatusLine(response.STATUS_OK)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+func TestServeConn(t *testing.T) {
+	client, served := startServer(t, context.Background(), echoHandler, Options{MaxBufferedBody: 8})
+	client.handshake()
+
+	// Test: Concurrent streams, with buffered and streamed bodies
+	client.request(1, "GET", "/one", true)
+	client.request(3, "POST", "/three", false, hpack.HeaderField{Name: "content-length", Value: "5"})
+	client.request(5, "POST", "/five", false)
+	client.write(FrameData, FlagEndStream, 3, []byte("small"))
+	client.write(FrameData, 0, 5, []byte("a body of "))
+	client.write(FrameData, FlagEndStream, 5, []byte("unknown length"))
+
+	responses := client.responses(3)
+	assert.Contains(t, responses[1].fields, hpack.HeaderField{Name: ":status", Value: "200"})
+	assert.Contains(t, responses[1].fields, hpack.HeaderField{Name: "x-path", Value: "/one"})
+	assert.Contains(t, responses[1].fields, hpack.HeaderField{Name: "x-host", Value: "example.test"})
+	assert.NotContains(t, responses[1].fields, hpack.HeaderField{Name: "connection", Value: "close"})
+	assert.Equal(t, "small", responses[3].body)
+	assert.Equal(t, "a body of unknown length", responses[5].body)
+
+	// Test: PING is echoed
+	client.write(FramePing, 0, 0, []byte("12345678"))
+	f := client.read()
+	assert.Equal(t, FramePing, f.typ)
+	assert.True(t, f.flags.has(FlagAck))
+	assert.Equal(t, "12345678", string(f.payload))
+
+	// Test: Malformed requests reset the stream only
+	client.write(FrameHeaders, FlagEndHeaders|FlagEndStream, 7, client.enc.Encode(nil, []hpack.HeaderField{{Name: ":method", Value: "GET"}, {Name: "Upper", Value: "x"}}))
+	assert.Equal(t, ErrCodeProtocol, client.responses(1)[7].reset)
+
+	// Test: Going backwards in stream IDs is a connection error
+	client.request(3, "GET", "/again", true)
+	f = client.read()
+	require.Equal(t, FrameGoAway, f.typ)
+	assert.Equal(t, ErrCodeStreamClosed, ErrCode(binary.BigEndian.Uint32(f.payload[4:])))
+	var connErr *ConnectionError
+	assert.ErrorAs(t, <-served, &connErr)
+}
+
+func TestFlowControl(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	client, _ := startServer(t, context.Background(), func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}, Options{})
+	client.handshake(Setting{SettingInitialWindowSize, 30})
+
+	// Test: Data stops at the window and resumes on WINDOW_UPDATE
+	client.request(1, "GET", "/", true)
+	f := client.read()
+	require.Equal(t, FrameHeaders, f.typ)
+	f = client.read()
+	require.Equal(t, FrameData, f.typ)
+	assert.Len(t, f.payload, 30)
+
+	client.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := readFrame(client.conn, maxFrameSizeLimit)
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+	client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	client.write(FrameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 1000))
+	received := len(f.payload)
+	for !f.flags.has(FlagEndStream) {
+		f = client.read()
+		received += len(f.payload)
+	}
+	assert.Equal(t, len(body), received)
+
+	// Test: Bodies a handler leaves unread are credited back to the connection
+	ignore := make(chan struct{})
+	client, _ = startServer(t, context.Background(), func(w *response.Writer, req *request.Request) {
+		var n int64
+		if req.RequestLine.Path == "/ignore" {
+			<-ignore
+		} else {
+			n, _ = io.Copy(io.Discard, req.BodyReader())
+		}
+		count := strconv.FormatInt(n, 10)
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(count)))
+		w.WriteBody([]byte(count))
+	}, Options{MaxBufferedBody: 0})
+	client.handshake()
+	upload := func(streamID uint32, path string, endStream bool) int {
+		client.request(streamID, "POST", path, false)
+		chunk := make([]byte, 16<<10)
+		sent := 0
+		for ; sent < windowSize; sent += len(chunk) {
+			var flags Flags
+			if endStream && sent+len(chunk) == windowSize {
+				flags = FlagEndStream
+			}
+			client.write(FrameData, flags, streamID, chunk)
+		}
+		return sent
+	}
+	sent := upload(1, "/ignore", false)
+	// The PING is answered once every DATA frame before it was processed
+	client.write(FramePing, 0, 0, []byte("12345678"))
+	for credited := 0; credited < sent; {
+		f, err := readFrame(client.conn, maxFrameSizeLimit)
+		require.NoError(t, err)
+		switch {
+		case f.typ == FrameHeaders:
+			_, err = client.dec.Decode(f.payload)
+			require.NoError(t, err)
+		case f.typ == FramePing:
+			close(ignore)
+		case f.typ == FrameWindowUpdate && f.streamID == 0:
+			credited += int(binary.BigEndian.Uint32(f.payload))
+		}
+	}
+	upload(3, "/", true)
+	assert.Equal(t, strconv.Itoa(windowSize), client.responses(1)[3].body)
+}
+
+func TestHeaderCompression(t *testing.T) {
+	client, served := startServer(t, context.Background(), func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Set("x-custom", "a value the encoder can index")
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(h)
+		w.WriteBody(nil)
+	}, Options{})
+	client.handshake(Setting{SettingHeaderTableSize, 256})
+
+	headerBlock := func(streamID uint32) []byte {
+		client.request(streamID, "GET", "/", true)
+		f := client.read()
+		require.Equal(t, FrameHeaders, f.typ)
+		block := f.payload
+		for !f.flags.has(FlagEndStream) {
+			f = client.read()
+		}
+		return block
+	}
+
+	// Test: The peer's table size is signalled before the first field
+	first := headerBlock(1)
+	assert.Equal(t, byte(0x20), first[0]&0xe0)
+	fields, err := client.dec.Decode(first)
+	require.NoError(t, err)
+	assert.Contains(t, fields, hpack.HeaderField{Name: "x-custom", Value: "a value the encoder can index"})
+
+	// Test: Repeated response headers are sent as indexes
+	second := headerBlock(3)
+	assert.Less(t, len(second), len(first))
+	fields, err = client.dec.Decode(second)
+	require.NoError(t, err)
+	assert.Contains(t, fields, hpack.HeaderField{Name: "x-custom", Value: "a value the encoder can index"})
+
+	// Test: An undecodable header block is a COMPRESSION_ERROR
+	client.write(FrameHeaders, FlagEndHeaders|FlagEndStream, 5, []byte{0xff, 0x00})
+	f := client.read()
+	require.Equal(t, FrameGoAway, f.typ)
+	assert.Equal(t, ErrCodeCompression, ErrCode(binary.BigEndian.Uint32(f.payload[4:])))
+	var connErr *ConnectionError
+	require.ErrorAs(t, <-served, &connErr)
+	assert.Equal(t, ErrCodeCompression, connErr.Code)
+}
+
+func TestLimits(t *testing.T) {
+	client, _ := startServer(t, context.Background(), echoHandler, Options{MaxBufferedBody: -1})
+	client.handshake()
+	big := hpack.HeaderField{Name: "x-big", Value: strings.Repeat("a", 4000)}
+
+	// Test: A small block expanding past the header list limit resets the stream
+	client.request(1, "GET", "/", true, big)
+	assert.Zero(t, client.responses(1)[1].reset)
+	repeated := make([]hpack.HeaderField, 300)
+	for i := range repeated {
+		repeated[i] = big
+	}
+	client.request(3, "GET", "/", true, repeated...)
+	assert.Equal(t, ErrCodeEnhanceYourCalm, client.responses(1)[3].reset)
+
+	// Test: The connection stays usable with the table in sync
+	client.request(5, "GET", "/after", true, big)
+	assert.Contains(t, client.responses(1)[5].fields, hpack.HeaderField{Name: "x-path", Value: "/after"})
+
+	// Test: Buffered bodies are capped, declared or not
+	client.request(7, "POST", "/", false, hpack.HeaderField{Name: "content-length", Value: "9000000"})
+	assert.Equal(t, ErrCodeEnhanceYourCalm, client.responses(1)[7].reset)
+	client.request(9, "POST", "/", false)
+	chunk := make([]byte, 16<<10)
+	for sent := 0; sent <= maxBufferedBody; sent += len(chunk) {
+		client.write(FrameData, 0, 9, chunk)
+	}
+	assert.Equal(t, ErrCodeEnhanceYourCalm, client.responses(1)[9].reset)
+}
+
+func TestShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	reset := make(chan error, 1)
+	client, served := startServer(t, ctx, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Path == "/reset" {
+			<-req.Context().Done()
+			reset <- context.Cause(req.Context())
+			return
+		}
+		close(started)
+		time.Sleep(20 * time.Millisecond)
+		echoHandler(w, req)
+	}, Options{})
+	client.handshake()
+
+	// Test: RST_STREAM cancels the request context
+	client.request(1, "GET", "/reset", true)
+	client.write(FrameRSTStream, 0, 1, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel)))
+	assert.ErrorIs(t, <-reset, ERROR_STREAM_RESET)
+
+	// Test: Shutting down sends GOAWAY and lets open streams finish
+	client.request(3, "GET", "/slow", true)
+	<-started
+	cancel()
+	f := client.read()
+	require.Equal(t, FrameGoAway, f.typ)
+	assert.Equal(t, uint32(3), binary.BigEndian.Uint32(f.payload))
+	responses := client.responses(1)
+	assert.Contains(t, responses[3].fields, hpack.HeaderField{Name: ":status", Value: "200"})
+	assert.NoError(t, <-served)
+
+	// Test: Draining sends GOAWAY without cancelling running handlers
+	drain := make(chan struct{})
+	drained := make(chan error, 1)
+	client, served = startServer(t, context.Background(), func(w *response.Writer, req *request.Request) {
+		close(drain)
+		time.Sleep(20 * time.Millisecond)
+		drained <- req.Context().Err()
+		echoHandler(w, req)
+	}, Options{Drain: drain})
+	client.handshake()
+	client.request(1, "GET", "/slow", true)
+	f = client.read()
+	require.Equal(t, FrameGoAway, f.typ)
+	assert.Equal(t, ErrCodeNo, ErrCode(binary.BigEndian.Uint32(f.payload[4:])))
+	responses = client.responses(1)
+	assert.Contains(t, responses[1].fields, hpack.HeaderField{Name: ":status", Value: "200"})
+	assert.NoError(t, <-drained)
+	assert.NoError(t, <-served)
+}
@@ -0,0 +1,909 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"dev.grab-a-byte.network/internal/hpack"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+)
+
+// Preface is the client connection preface, RFC 9113 section 3.4.
+const Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// NextProtoTLS is the ALPN protocol ID of HTTP/2 over TLS.
+const NextProtoTLS = "h2"
+
+var ERROR_INVALID_PREFACE = errors.New("invalid http2 connection preface")
+var ERROR_STREAM_RESET = errors.New("http2 stream reset")
+var ERROR_CONN_CLOSED = errors.New("http2 connection closed")
+
+const (
+	defaultMaxConcurrentStreams = 100
+	// windowSize is the receive window for the connection and every stream
+	windowSize = 1 << 20
+	// maxHeaderBlock bounds a header block collected over CONTINUATION
+	// frames
+	maxHeaderBlock = 1 << 20
+	// maxHeaderList bounds the decoded header block, sent to the client as
+	// SETTINGS_MAX_HEADER_LIST_SIZE
+	maxHeaderList = 1 << 20
+	// maxBufferedBody bounds bodies buffered in memory when
+	// Options.MaxBufferedBody is negative, larger ones reset the stream
+	maxBufferedBody = 8 << 20
+)
+
+// Handler has the same shape as server.Handler, which can be passed as is.
+type Handler func(w *response.Writer, req *request.Request)
+
+type Options struct {
+	// MaxConcurrentStreams is how many streams a client may have open at
+	// once. Zero means 100.
+	MaxConcurrentStreams uint32
+	// MaxBufferedBody is the largest request body read before the handler
+	// runs. Larger bodies, and ones without a content-length, are streamed
+	// through Request.BodyReader instead. Negative buffers every body up to
+	// 8 MiB and resets streams sending more.
+	MaxBufferedBody int64
+	// Drain, once closed, shuts the connection down like cancelling the
+	// context does but leaves the contexts of running handlers alone.
+	Drain <-chan struct{}
+}
+
+type serverConn struct {
+	conn    net.Conn
+	reader  io.Reader
+	handler Handler
+	opts    Options
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+
+	// Only used by the read loop
+	dec             *hpack.Decoder
+	headerBlock     []byte
+	headerStream    uint32
+	headerEndStream bool
+
+	writeMu   sync.Mutex
+	writer    *bufio.Writer
+	enc       *hpack.Encoder
+	headerBuf []byte
+
+	// peerMaxFrame is the peer's SETTINGS_MAX_FRAME_SIZE and peerTableSize
+	// its SETTINGS_HEADER_TABLE_SIZE, applied before the next header block
+	peerMaxFrame  atomic.Uint32
+	peerTableSize atomic.Uint32
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// streams holds streams until they are closed
+	streams      map[uint32]*stream
+	lastStreamID uint32
+	sendWindow   int64
+	recvWindow   int64
+	// peerWindow is the peer's SETTINGS_INITIAL_WINDOW_SIZE
+	peerWindow int64
+	goingAway  bool
+	closed     bool
+
+	handlers sync.WaitGroup
+}
+
+// ServeConn serves HTTP/2 on conn, which must start with the client
+// preface, until the client goes away or ctx is done. Cancelling ctx sends
+// GOAWAY and lets open streams finish. conn is closed on return.
+func ServeConn(ctx context.Context, conn net.Conn, handler Handler, opts Options) error {
+	sc := newServerConn(ctx, conn, conn, handler, opts)
+	return sc.serve(nil)
+}
+
+// IsUpgrade reports whether req asks to switch to HTTP/2 with
+// "Upgrade: h2c", RFC 7540 section 3.2.
+func IsUpgrade(req *request.Request) bool {
+	_, ok := upgradeSettings(req)
+	return ok
+}
+
+// ServeUpgrade continues a connection after the 101 response to an h2c
+// upgrade was sent. req is answered on stream 1, and must not have a
+// streamed body as the rest of the connection belongs to HTTP/2.
+func ServeUpgrade(ctx context.Context, conn net.Conn, req *request.Request, handler Handler, opts Options) error {
+	settings, ok := upgradeSettings(req)
+	if !ok || req.IsStreamed() {
+		conn.Close()
+		return connError(ErrCodeProtocol, "not an h2c upgrade")
+	}
+	reader := io.MultiReader(bytes.NewReader(req.Buffered()), conn)
+	sc := newServerConn(ctx, conn, reader, handler, opts)
+	err := sc.applySettings(settings)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return sc.serve(req)
+}
+
+func upgradeSettings(req *request.Request) ([]Setting, bool) {
+	upgrade, _ := req.Headers.Get("Upgrade")
+	connection, _ := req.Headers.Get("Connection")
+	encoded, ok := req.Headers.Get("HTTP2-Settings")
+	if !ok || !hasToken(upgrade, "h2c") || !hasToken(connection, "upgrade") || !hasToken(connection, "http2-settings") {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, false
+	}
+	settings, err := parseSettings(payload)
+	if err != nil {
+		return nil, false
+	}
+	return settings, true
+}
+
+func hasToken(value, token string) bool {
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		if strings.EqualFold(part, token) {
+			return true
+		}
+	}
+	return false
+}
+
+func newServerConn(ctx context.Context, conn net.Conn, reader io.Reader, handler Handler, opts Options) *serverConn {
+	if opts.MaxConcurrentStreams == 0 {
+		opts.MaxConcurrentStreams = defaultMaxConcurrentStreams
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	sc := &serverConn{
+		conn:       conn,
+		reader:     bufio.NewReader(reader),
+		handler:    handler,
+		opts:       opts,
+		ctx:        ctx,
+		cancel:     cancel,
+		dec:        newDecoder(),
+		writer:     bufio.NewWriter(conn),
+		enc:        hpack.NewEncoder(hpack.DefaultTableSize),
+		streams:    map[uint32]*stream{},
+		sendWindow: defaultWindowSize,
+		recvWindow: defaultWindowSize,
+		peerWindow: defaultWindowSize,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	sc.peerMaxFrame.Store(defaultMaxFrameSize)
+	sc.peerTableSize.Store(hpack.DefaultTableSize)
+	return sc
+}
+
+func (sc *serverConn) serve(upgrade *request.Request) error {
+	defer sc.close()
+	go func() {
+		select {
+		case <-sc.ctx.Done():
+		case <-sc.opts.Drain:
+		}
+		sc.shutdown()
+	}()
+
+	err := sc.writeInitialSettings()
+	if err != nil {
+		return err
+	}
+	if upgrade != nil {
+		sc.startUpgradeStream(upgrade)
+	}
+
+	preface := make([]byte, len(Preface))
+	_, err = io.ReadFull(sc.reader, preface)
+	if err != nil {
+		return err
+	}
+	if string(preface) != Preface {
+		sc.writeGoAway(ErrCodeProtocol)
+		return ERROR_INVALID_PREFACE
+	}
+
+	first := true
+	for {
+		f, err := readFrame(sc.reader, defaultMaxFrameSize)
+		if err == nil && first && f.typ != FrameSettings {
+			err = connError(ErrCodeProtocol, "first frame is not SETTINGS")
+		}
+		if err == nil {
+			first = false
+			err = sc.processFrame(f)
+		}
+
+		var se *streamError
+		var ce *ConnectionError
+		switch {
+		case err == nil:
+		case errors.As(err, &se):
+			sc.resetStream(se.streamID, se.code)
+		case errors.As(err, &ce):
+			sc.writeGoAway(ce.Code)
+			return ce
+		default:
+			sc.mu.Lock()
+			goingAway := sc.goingAway
+			sc.mu.Unlock()
+			if goingAway || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// close tears the connection down once reading stopped, failing whatever
+// the handlers still do and waiting for them to return.
+func (sc *serverConn) close() {
+	sc.mu.Lock()
+	sc.closed = true
+	for _, st := range sc.streams {
+		st.cancel(ERROR_CONN_CLOSED)
+		if st.body != nil {
+			st.body.closeWithError(ERROR_CONN_CLOSED)
+		}
+	}
+	sc.mu.Unlock()
+	sc.cond.Broadcast()
+	sc.cancel(ERROR_CONN_CLOSED)
+	sc.conn.Close()
+	sc.handlers.Wait()
+}
+
+// shutdown sends GOAWAY so the client opens no new streams, the connection
+// closes once the open ones are done.
+func (sc *serverConn) shutdown() {
+	sc.mu.Lock()
+	if sc.closed || sc.goingAway {
+		sc.mu.Unlock()
+		return
+	}
+	sc.goingAway = true
+	idle := len(sc.streams) == 0
+	sc.mu.Unlock()
+
+	sc.writeGoAway(ErrCodeNo)
+	if idle {
+		sc.conn.Close()
+	}
+}
+
+func (sc *serverConn) processFrame(f *frame) error {
+	if sc.headerBlock != nil && (f.typ != FrameContinuation || f.streamID != sc.headerStream) {
+		return connError(ErrCodeProtocol, "expected CONTINUATION")
+	}
+
+	switch f.typ {
+	case FrameData:
+		return sc.processData(f)
+	case FrameHeaders:
+		return sc.processHeaders(f)
+	case FrameContinuation:
+		return sc.processContinuation(f)
+	case FramePriority:
+		// Priorities are only advisory and not acted upon
+		if f.streamID == 0 {
+			return connError(ErrCodeProtocol, "PRIORITY on stream 0")
+		}
+		if len(f.payload) != 5 {
+			return &streamError{f.streamID, ErrCodeFrameSize}
+		}
+		return nil
+	case FrameRSTStream:
+		return sc.processReset(f)
+	case FrameSettings:
+		return sc.processSettings(f)
+	case FramePushPromise:
+		return connError(ErrCodeProtocol, "PUSH_PROMISE from a client")
+	case FramePing:
+		return sc.processPing(f)
+	case FrameGoAway:
+		return sc.processGoAway(f)
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	}
+	// Unknown frame types must be ignored
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f *frame) error {
+	if f.streamID == 0 {
+		return connError(ErrCodeProtocol, "HEADERS on stream 0")
+	}
+	payload, err := unpad(f)
+	if err != nil {
+		return err
+	}
+	if f.flags.has(FlagPriority) {
+		if len(payload) < 5 {
+			return connError(ErrCodeFrameSize, "HEADERS too short for priority")
+		}
+		payload = payload[5:]
+	}
+	sc.headerStream = f.streamID
+	sc.headerEndStream = f.flags.has(FlagEndStream)
+	sc.headerBlock = append(make([]byte, 0, len(payload)), payload...)
+	if f.flags.has(FlagEndHeaders) {
+		return sc.endHeaders()
+	}
+	return nil
+}
+
+func (sc *serverConn) processContinuation(f *frame) error {
+	if sc.headerBlock == nil {
+		return connError(ErrCodeProtocol, "unexpected CONTINUATION")
+	}
+	if len(sc.headerBlock)+len(f.payload) > maxHeaderBlock {
+		return connError(ErrCodeEnhanceYourCalm, "header block too large")
+	}
+	sc.headerBlock = append(sc.headerBlock, f.payload...)
+	if f.flags.has(FlagEndHeaders) {
+		return sc.endHeaders()
+	}
+	return nil
+}
+
+// endHeaders handles a complete header block, which either opens a stream
+// or carries trailers for one.
+func (sc *serverConn) endHeaders() error {
+	block, id, endStream := sc.headerBlock, sc.headerStream, sc.headerEndStream
+	sc.headerBlock = nil
+
+	// Decoding must happen even for refused streams to keep the table in sync
+	fields, err := sc.dec.Decode(block)
+	// Oversized lists still keep the table in sync, only the stream fails
+	tooLarge := errors.Is(err, hpack.ERROR_HEADER_LIST_SIZE)
+	if err != nil && !tooLarge {
+		return connError(ErrCodeCompression, err.Error())
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[id]
+	receiving := st != nil && (st.state == stateOpen || st.state == stateHalfClosedLocal)
+	sc.mu.Unlock()
+	if st != nil {
+		// Trailers, which handlers have no way to read, so they are dropped
+		if !endStream {
+			return &streamError{id, ErrCodeProtocol}
+		}
+		if !receiving {
+			return &streamError{id, ErrCodeStreamClosed}
+		}
+		if tooLarge {
+			return &streamError{id, ErrCodeEnhanceYourCalm}
+		}
+		return sc.endOfBody(st)
+	}
+
+	if id%2 == 0 {
+		return connError(ErrCodeProtocol, "even stream ID from a client")
+	}
+	sc.mu.Lock()
+	if id <= sc.lastStreamID {
+		sc.mu.Unlock()
+		return connError(ErrCodeStreamClosed, "HEADERS on a closed stream")
+	}
+	sc.lastStreamID = id
+	goingAway := sc.goingAway
+	active := uint32(len(sc.streams))
+	sc.mu.Unlock()
+
+	if goingAway {
+		return nil
+	}
+	if active >= sc.opts.MaxConcurrentStreams {
+		return &streamError{id, ErrCodeRefusedStream}
+	}
+	if tooLarge {
+		return &streamError{id, ErrCodeEnhanceYourCalm}
+	}
+
+	line, h, ok := requestFields(fields)
+	if !ok {
+		return &streamError{id, ErrCodeProtocol}
+	}
+	contentLength := int64(-1)
+	if value, ok := h.Get("content-length"); ok {
+		contentLength, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || contentLength < 0 {
+			return &streamError{id, ErrCodeProtocol}
+		}
+	}
+
+	st = sc.newStream(id, line.Method == "HEAD")
+	st.line, st.header, st.contentLength = line, h, contentLength
+
+	if endStream {
+		return sc.endOfBody(st)
+	}
+	maxBuffered := sc.opts.MaxBufferedBody
+	if maxBuffered < 0 && contentLength > maxBufferedBody {
+		return &streamError{id, ErrCodeEnhanceYourCalm}
+	}
+	if maxBuffered >= 0 && (contentLength < 0 || contentLength > maxBuffered) {
+		st.body = newRequestBody(func(n int) { sc.returnCredit(st, n) })
+		return sc.startHandler(st, nil, st.body)
+	}
+	return nil
+}
+
+func (sc *serverConn) newStream(id uint32, isHead bool) *stream {
+	ctx, cancel := context.WithCancelCause(sc.ctx)
+	st := &stream{
+		sc:         sc,
+		id:         id,
+		state:      stateOpen,
+		recvWindow: windowSize,
+		ctx:        ctx,
+		cancel:     cancel,
+		isHead:     isHead,
+	}
+	sc.mu.Lock()
+	st.sendWindow = sc.peerWindow
+	sc.streams[id] = st
+	sc.mu.Unlock()
+	return st
+}
+
+// startUpgradeStream answers the request that asked for the upgrade on
+// stream 1, which starts out half-closed as the request is complete.
+func (sc *serverConn) startUpgradeStream(req *request.Request) {
+	st := sc.newStream(1, req.RequestLine.Method == "HEAD")
+	sc.mu.Lock()
+	sc.lastStreamID = 1
+	st.state = stateHalfClosedRemote
+	sc.mu.Unlock()
+	sc.runHandler(st, req)
+}
+
+func (sc *serverConn) startHandler(st *stream, body []byte, bodyReader *requestBody) error {
+	var reader io.Reader
+	if bodyReader != nil {
+		reader = bodyReader
+	}
+	req, err := request.NewRequest(st.line, st.header, body, reader)
+	if err != nil {
+		return &streamError{st.id, ErrCodeProtocol}
+	}
+	sc.runHandler(st, req)
+	return nil
+}
+
+func (sc *serverConn) runHandler(st *stream, req *request.Request) {
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		sc.handler(response.NewFramedWriter(st), req.WithContext(st.ctx))
+		st.finish()
+	}()
+}
+
+func (sc *serverConn) processData(f *frame) error {
+	if f.streamID == 0 {
+		return connError(ErrCodeProtocol, "DATA on stream 0")
+	}
+	payload, err := unpad(f)
+	if err != nil {
+		return err
+	}
+	length := int64(len(f.payload))
+
+	sc.mu.Lock()
+	// Flow control covers the whole payload, padding included
+	if length > sc.recvWindow {
+		sc.mu.Unlock()
+		return connError(ErrCodeFlowControl, "connection window exceeded")
+	}
+	sc.recvWindow -= length
+	st := sc.streams[f.streamID]
+	receiving := st != nil && (st.state == stateOpen || st.state == stateHalfClosedLocal)
+	if !receiving {
+		idle := f.streamID > sc.lastStreamID
+		sc.mu.Unlock()
+		sc.returnCredit(nil, int(length))
+		if idle {
+			return connError(ErrCodeProtocol, "DATA on an idle stream")
+		}
+		return &streamError{f.streamID, ErrCodeStreamClosed}
+	}
+	if length > st.recvWindow {
+		sc.mu.Unlock()
+		sc.returnCredit(nil, int(length))
+		return &streamError{st.id, ErrCodeFlowControl}
+	}
+	st.recvWindow -= length
+	sc.mu.Unlock()
+
+	// Padding is returned right away, data once it has been consumed
+	if padding := int(length) - len(payload); padding > 0 {
+		sc.returnCredit(st, padding)
+	}
+	st.received += int64(len(payload))
+	if st.contentLength >= 0 && st.received > st.contentLength {
+		return &streamError{st.id, ErrCodeProtocol}
+	}
+	if len(payload) > 0 {
+		if st.body != nil {
+			// A reset can race the write, nobody reads the data then
+			if !st.body.write(payload) {
+				sc.returnCredit(nil, len(payload))
+			}
+		} else {
+			// Credit goes straight back, so the cap is all that stops a
+			// client without a content-length
+			if len(st.buffered)+len(payload) > maxBufferedBody {
+				return &streamError{st.id, ErrCodeEnhanceYourCalm}
+			}
+			st.buffered = append(st.buffered, payload...)
+			sc.returnCredit(st, len(payload))
+		}
+	}
+
+	if f.flags.has(FlagEndStream) {
+		return sc.endOfBody(st)
+	}
+	return nil
+}
+
+// endOfBody handles the end of the request, which starts the handler when
+// the body was being buffered.
+func (sc *serverConn) endOfBody(st *stream) error {
+	if st.contentLength >= 0 && st.received != st.contentLength {
+		return &streamError{st.id, ErrCodeProtocol}
+	}
+
+	unread := 0
+	sc.mu.Lock()
+	if st.state == stateHalfClosedLocal {
+		unread = sc.removeStream(st)
+	} else {
+		st.state = stateHalfClosedRemote
+	}
+	sc.mu.Unlock()
+	sc.returnCredit(nil, unread)
+
+	if st.body != nil {
+		st.body.closeWithError(io.EOF)
+		return nil
+	}
+	return sc.startHandler(st, st.buffered, nil)
+}
+
+func (sc *serverConn) processReset(f *frame) error {
+	if f.streamID == 0 {
+		return connError(ErrCodeProtocol, "RST_STREAM on stream 0")
+	}
+	if len(f.payload) != 4 {
+		return connError(ErrCodeFrameSize, "RST_STREAM must be 4 bytes")
+	}
+	unread := 0
+	sc.mu.Lock()
+	if f.streamID > sc.lastStreamID {
+		sc.mu.Unlock()
+		return connError(ErrCodeProtocol, "RST_STREAM on an idle stream")
+	}
+	st := sc.streams[f.streamID]
+	if st != nil {
+		unread = sc.removeStream(st)
+	}
+	sc.mu.Unlock()
+	sc.returnCredit(nil, unread)
+	return nil
+}
+
+func (sc *serverConn) processSettings(f *frame) error {
+	if f.streamID != 0 {
+		return connError(ErrCodeProtocol, "SETTINGS on a stream")
+	}
+	if f.flags.has(FlagAck) {
+		if len(f.payload) != 0 {
+			return connError(ErrCodeFrameSize, "SETTINGS ACK with a payload")
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.payload)
+	if err != nil {
+		return err
+	}
+	err = sc.applySettings(settings)
+	if err != nil {
+		return err
+	}
+	return sc.writeFrame(FrameSettings, FlagAck, 0, nil)
+}
+
+func (sc *serverConn) applySettings(settings []Setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		switch s.ID {
+		case SettingHeaderTableSize:
+			// A bigger table than the default isn't worth the memory
+			sc.peerTableSize.Store(min(s.Value, hpack.DefaultTableSize))
+		case SettingEnablePush:
+			if s.Value > 1 {
+				return connError(ErrCodeProtocol, "invalid SETTINGS_ENABLE_PUSH")
+			}
+		case SettingInitialWindowSize:
+			if s.Value > maxWindowSize {
+				return connError(ErrCodeFlowControl, "invalid SETTINGS_INITIAL_WINDOW_SIZE")
+			}
+			// The change applies to the window of every open stream
+			delta := int64(s.Value) - sc.peerWindow
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return connError(ErrCodeFlowControl, "stream window overflow")
+				}
+			}
+			sc.peerWindow = int64(s.Value)
+		case SettingMaxFrameSize:
+			if s.Value < defaultMaxFrameSize || s.Value > maxFrameSizeLimit {
+				return connError(ErrCodeProtocol, "invalid SETTINGS_MAX_FRAME_SIZE")
+			}
+			sc.peerMaxFrame.Store(s.Value)
+		}
+		// Limits on streams the server opens don't apply, it never pushes
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processPing(f *frame) error {
+	if f.streamID != 0 {
+		return connError(ErrCodeProtocol, "PING on a stream")
+	}
+	if len(f.payload) != 8 {
+		return connError(ErrCodeFrameSize, "PING must be 8 bytes")
+	}
+	if f.flags.has(FlagAck) {
+		return nil
+	}
+	return sc.writeFrame(FramePing, FlagAck, 0, f.payload)
+}
+
+// processGoAway stops new streams from the client, the connection closes
+// once the open ones are done.
+func (sc *serverConn) processGoAway(f *frame) error {
+	if f.streamID != 0 {
+		return connError(ErrCodeProtocol, "GOAWAY on a stream")
+	}
+	if len(f.payload) < 8 {
+		return connError(ErrCodeFrameSize, "GOAWAY too short")
+	}
+	sc.mu.Lock()
+	sc.goingAway = true
+	idle := len(sc.streams) == 0
+	sc.mu.Unlock()
+	if idle {
+		sc.conn.Close()
+	}
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(f *frame) error {
+	if len(f.payload) != 4 {
+		return connError(ErrCodeFrameSize, "WINDOW_UPDATE must be 4 bytes")
+	}
+	increment := int64(binary.BigEndian.Uint32(f.payload) & (1<<31 - 1))
+	if increment == 0 {
+		if f.streamID == 0 {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE of 0")
+		}
+		return &streamError{f.streamID, ErrCodeProtocol}
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.streamID == 0 {
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindowSize {
+			return connError(ErrCodeFlowControl, "connection window overflow")
+		}
+	} else {
+		st := sc.streams[f.streamID]
+		if st == nil {
+			if f.streamID > sc.lastStreamID {
+				return connError(ErrCodeProtocol, "WINDOW_UPDATE on an idle stream")
+			}
+			return nil
+		}
+		st.sendWindow += increment
+		if st.sendWindow > maxWindowSize {
+			return &streamError{st.id, ErrCodeFlowControl}
+		}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+// reserveWindow waits until up to want bytes may be sent on st and takes
+// them from the stream and connection windows.
+func (sc *serverConn) reserveWindow(st *stream, want int) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for {
+		if st.state == stateClosed || sc.closed {
+			return 0, ERROR_STREAM_RESET
+		}
+		if st.sendWindow > 0 && sc.sendWindow > 0 {
+			break
+		}
+		sc.cond.Wait()
+	}
+	n := min(int64(want), st.sendWindow, sc.sendWindow, int64(sc.peerMaxFrame.Load()))
+	st.sendWindow -= n
+	sc.sendWindow -= n
+	return int(n), nil
+}
+
+// returnCredit gives n bytes of receive window back to the client. st is
+// nil for data that only counted against the connection.
+func (sc *serverConn) returnCredit(st *stream, n int) {
+	if n == 0 {
+		return
+	}
+	sc.mu.Lock()
+	sc.recvWindow += int64(n)
+	open := st != nil && (st.state == stateOpen || st.state == stateHalfClosedLocal)
+	if open {
+		st.recvWindow += int64(n)
+	}
+	sc.mu.Unlock()
+
+	increment := binary.BigEndian.AppendUint32(nil, uint32(n))
+	sc.writeFrame(FrameWindowUpdate, 0, 0, increment)
+	if open {
+		sc.writeFrame(FrameWindowUpdate, 0, st.id, increment)
+	}
+}
+
+// closeLocal records that the response is complete.
+func (sc *serverConn) closeLocal(st *stream) {
+	unread := 0
+	sc.mu.Lock()
+	switch st.state {
+	case stateOpen:
+		st.state = stateHalfClosedLocal
+	case stateHalfClosedRemote:
+		unread = sc.removeStream(st)
+	}
+	sc.mu.Unlock()
+	sc.returnCredit(nil, unread)
+}
+
+// removeStream closes st, sc.mu must be held. It returns how much of the
+// body was received but never read, which the caller must give back to the
+// connection window once sc.mu is released.
+func (sc *serverConn) removeStream(st *stream) int {
+	if st.state == stateClosed {
+		return 0
+	}
+	st.state = stateClosed
+	st.cancel(ERROR_STREAM_RESET)
+	unread := 0
+	if st.body != nil {
+		unread = st.body.discard(ERROR_STREAM_RESET)
+	}
+	delete(sc.streams, st.id)
+	sc.cond.Broadcast()
+	if sc.goingAway && len(sc.streams) == 0 {
+		sc.conn.Close()
+	}
+	return unread
+}
+
+// resetStream sends RST_STREAM and closes the stream if it is still known.
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	unread := 0
+	sc.mu.Lock()
+	if st := sc.streams[id]; st != nil {
+		unread = sc.removeStream(st)
+	}
+	sc.mu.Unlock()
+	sc.writeFrame(FrameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, uint32(code)))
+	sc.returnCredit(nil, unread)
+}
+
+func newDecoder() *hpack.Decoder {
+	dec := hpack.NewDecoder(hpack.DefaultTableSize)
+	dec.SetMaxHeaderListSize(maxHeaderList)
+	return dec
+}
+
+func (sc *serverConn) writeInitialSettings() error {
+	settings := appendSettings(nil, []Setting{
+		{SettingMaxConcurrentStreams, sc.opts.MaxConcurrentStreams},
+		{SettingInitialWindowSize, windowSize},
+		{SettingMaxHeaderListSize, maxHeaderList},
+	})
+	err := sc.writeFrame(FrameSettings, 0, 0, settings)
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	sc.recvWindow += windowSize - defaultWindowSize
+	sc.mu.Unlock()
+	return sc.writeFrame(FrameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, windowSize-defaultWindowSize))
+}
+
+func (sc *serverConn) writeGoAway(code ErrCode) error {
+	sc.mu.Lock()
+	payload := binary.BigEndian.AppendUint32(nil, sc.lastStreamID)
+	sc.mu.Unlock()
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	return sc.writeFrame(FrameGoAway, 0, 0, payload)
+}
+
+func (sc *serverConn) writeFrame(typ FrameType, flags Flags, streamID uint32, payload []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	err := writeFrame(sc.writer, typ, flags, streamID, payload)
+	if err != nil {
+		return err
+	}
+	return sc.writer.Flush()
+}
+
+func (sc *serverConn) writeData(streamID uint32, p []byte, endStream bool) error {
+	var flags Flags
+	if endStream {
+		flags = FlagEndStream
+	}
+	return sc.writeFrame(FrameData, flags, streamID, p)
+}
+
+// writeHeaders encodes and sends a header block, split into CONTINUATION
+// frames when it doesn't fit in one. The whole block goes out under the
+// write lock as nothing may come between its frames.
+func (sc *serverConn) writeHeaders(st *stream, fields []hpack.HeaderField, endStream bool) error {
+	sc.mu.Lock()
+	closed := st.state == stateClosed
+	sc.mu.Unlock()
+	if closed {
+		return ERROR_STREAM_RESET
+	}
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	sc.enc.SetMaxTableSize(sc.peerTableSize.Load())
+	sc.headerBuf = sc.enc.Encode(sc.headerBuf[:0], fields)
+	block := sc.headerBuf
+	maxFrame := int(sc.peerMaxFrame.Load())
+	typ := FrameHeaders
+	for {
+		chunk := block[:min(len(block), maxFrame)]
+		block = block[len(chunk):]
+		var flags Flags
+		if typ == FrameHeaders && endStream {
+			flags |= FlagEndStream
+		}
+		if len(block) == 0 {
+			flags |= FlagEndHeaders
+		}
+		err := writeFrame(sc.writer, typ, flags, st.id, chunk)
+		if err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			break
+		}
+		typ = FrameContinuation
+	}
+	return sc.writer.Flush()
+}
@@ -0,0 +1,289 @@
+package http2
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/hpack"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+)
+
+// streamState follows RFC 9113 section 5.1 from the server's side. Idle and
+// reserved states don't need representing, streams are created open.
+type streamState int
+
+const (
+	stateOpen streamState = iota
+	stateHalfClosedRemote
+	stateHalfClosedLocal
+	stateClosed
+)
+
+// connectionHeaders are HTTP/1.1 connection-specific fields, which are not
+// allowed in HTTP/2 messages.
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// stream is one request and response exchange. It is the response.Framer
+// for its response, so those methods are called from the handler goroutine.
+type stream struct {
+	sc *serverConn
+	id uint32
+
+	// Guarded by sc.mu
+	state      streamState
+	sendWindow int64
+	recvWindow int64
+
+	// ctx is the request context, cancelled when the stream is reset or
+	// the connection goes away
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	// Only used by the read loop
+	line          request.RequestLine
+	header        headers.Headers
+	contentLength int64
+	received      int64
+	buffered      []byte
+	body          *requestBody
+
+	// Only used by the handler goroutine
+	isHead      bool
+	headersSent bool
+	ended       bool
+}
+
+// requestFields turns the decoded fields of a request header block into a
+// request line and headers, enforcing RFC 9113 section 8.3.
+func requestFields(fields []hpack.HeaderField) (request.RequestLine, headers.Headers, bool) {
+	line := request.RequestLine{HttpVersion: "2"}
+	var regularFields []hpack.HeaderField
+	var scheme, authority, path string
+	pseudo := map[string]*string{":method": &line.Method, ":scheme": &scheme, ":authority": &authority, ":path": &path}
+	regular := false
+
+	for _, hf := range fields {
+		if strings.HasPrefix(hf.Name, ":") {
+			target, known := pseudo[hf.Name]
+			// Pseudo-header fields come first and only once each
+			if !known || regular || *target != "" {
+				return line, nil, false
+			}
+			*target = hf.Value
+			continue
+		}
+		regular = true
+		if hf.Name == "" || hf.Name != strings.ToLower(hf.Name) || connectionHeaders[hf.Name] {
+			return line, nil, false
+		}
+		if hf.Name == "te" && hf.Value != "trailers" {
+			return line, nil, false
+		}
+		regularFields = append(regularFields, hf)
+	}
+	// Cookies may be split into one field per pair, RFC 9113 section 8.2.3,
+	// ToHeaders joins them back with semicolons
+	h := hpack.ToHeaders(regularFields)
+
+	if line.Method == "" {
+		return line, nil, false
+	}
+	if line.Method == "CONNECT" {
+		if scheme != "" || path != "" || authority == "" {
+			return line, nil, false
+		}
+		line.RequestTarget = authority
+	} else {
+		if scheme == "" || path == "" || (path != "*" && path[0] != '/') {
+			return line, nil, false
+		}
+		line.RequestTarget = path
+	}
+	if _, ok := h["host"]; !ok && authority != "" {
+		h["host"] = authority
+	}
+	return line, h, true
+}
+
+// responseFields lowercases names and drops fields HTTP/2 doesn't allow,
+// which handlers written for HTTP/1.1 routinely set.
+func responseFields(fields []hpack.HeaderField, h headers.Headers) []hpack.HeaderField {
+	for _, hf := range hpack.FromHeaders(h) {
+		if connectionHeaders[hf.Name] || hf.Name == "te" {
+			continue
+		}
+		fields = append(fields, hf)
+	}
+	return fields
+}
+
+func (st *stream) WriteHeaders(statusCode response.StatusCode, h headers.Headers, cookies []string) error {
+	fields := responseFields([]hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(statusCode))}}, h)
+	// Cookies often carry session secrets, keep them out of the tables
+	for _, c := range cookies {
+		fields = append(fields, hpack.HeaderField{Name: "set-cookie", Value: c, Sensitive: true})
+	}
+	err := st.sc.writeHeaders(st, fields, false)
+	if err != nil {
+		return err
+	}
+	st.headersSent = true
+	return nil
+}
+
+// Write sends p as DATA frames, waiting for flow control window as needed.
+// Responses to HEAD requests have no body so it is discarded.
+func (st *stream) Write(p []byte) (int, error) {
+	if st.isHead {
+		return len(p), nil
+	}
+	written := 0
+	for len(p) > 0 {
+		n, err := st.sc.reserveWindow(st, len(p))
+		if err != nil {
+			return written, err
+		}
+		err = st.sc.writeData(st.id, p[:n], false)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (st *stream) WriteTrailers(h headers.Headers) error {
+	if st.ended {
+		return nil
+	}
+	st.ended = true
+	err := st.sc.writeHeaders(st, responseFields(nil, h), true)
+	if err != nil {
+		return err
+	}
+	st.sc.closeLocal(st)
+	return nil
+}
+
+func (st *stream) End() error {
+	if st.ended {
+		return nil
+	}
+	st.ended = true
+	err := st.sc.writeData(st.id, nil, true)
+	if err != nil {
+		return err
+	}
+	st.sc.closeLocal(st)
+	return nil
+}
+
+// finish runs once the handler returned. An incomplete response is ended,
+// a missing one resets the stream as there is nothing to send.
+func (st *stream) finish() {
+	st.sc.mu.Lock()
+	reset := st.state == stateClosed
+	st.sc.mu.Unlock()
+	if reset {
+		return
+	}
+	if !st.headersSent {
+		st.sc.resetStream(st.id, ErrCodeInternal)
+		return
+	}
+	st.End()
+	// The client is still sending a body nobody will read
+	st.sc.mu.Lock()
+	unread := st.state == stateHalfClosedLocal
+	st.sc.mu.Unlock()
+	if unread {
+		st.sc.resetStream(st.id, ErrCodeNo)
+	}
+}
+
+// requestBody is a streamed request body. The read loop appends DATA
+// payloads and flow control credit is returned as the handler reads, so at
+// most a window's worth is ever held.
+type requestBody struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      []byte
+	err      error
+	consumed func(n int)
+	// discarded is set once the stream is gone and nothing will read buf
+	discarded bool
+}
+
+func newRequestBody(consumed func(n int)) *requestBody {
+	b := &requestBody{consumed: consumed}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	for len(b.buf) == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if len(b.buf) == 0 {
+		err := b.err
+		b.mu.Unlock()
+		return 0, err
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	b.mu.Unlock()
+	b.consumed(n)
+	return n, nil
+}
+
+// write appends p for the handler to read. It reports false when the body
+// was discarded, the caller must then return the credit itself.
+func (b *requestBody) write(p []byte) bool {
+	b.mu.Lock()
+	if b.discarded {
+		b.mu.Unlock()
+		return false
+	}
+	b.buf = append(b.buf, p...)
+	b.mu.Unlock()
+	b.cond.Broadcast()
+	return true
+}
+
+// closeWithError makes reads fail with err once the buffered data is read,
+// io.EOF for a complete body.
+func (b *requestBody) closeWithError(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// discard fails reads with err right away and drops the buffered data,
+// returning how many bytes were dropped so their credit can be returned.
+func (b *requestBody) discard(err error) int {
+	b.mu.Lock()
+	n := len(b.buf)
+	b.buf = nil
+	b.discarded = true
+	if b.err == nil {
+		b.err = err
+	}
+	b.mu.Unlock()
+	b.cond.Broadcast()
+	return n
+}
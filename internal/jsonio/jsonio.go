@@ -0,0 +1,216 @@
+package jsonio
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"dev.grab-a-byte.network/internal/server"
+)
+
+const DefaultMaxSize = 1 << 20
+
+type DecodeOptions struct {
+	// MaxSize is the largest body accepted, zero means DefaultMaxSize.
+	MaxSize int64
+	// AllowUnknownFields accepts object keys that don't match a field of
+	// the destination. By default they are rejected so typos are caught.
+	AllowUnknownFields bool
+}
+
+// Decode reads the JSON request body into v. Failures are returned as a
+// *server.HandlerError carrying the status to answer with (400, 413 or 415)
+// and a message that is safe to show the client, ready for WriteError.
+func Decode(req *request.Request, v any, opts DecodeOptions) error {
+	if opts.MaxSize == 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+
+	if contentType, ok := req.Headers.Get("Content-Type"); ok {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !isJSON(mediaType) {
+			return &server.HandlerError{
+				StatusCode:   int(response.STATUS_UNSUPPORTED_MEDIA),
+				ErrorMessage: fmt.Sprintf("Content-Type must be application/json, got %q", contentType),
+			}
+		}
+	}
+
+	limited := &io.LimitedReader{R: req.BodyReader(), N: opts.MaxSize + 1}
+	decoder := json.NewDecoder(limited)
+	if !opts.AllowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+
+	err := decoder.Decode(v)
+	if err == nil {
+		// Anything after the first value means the body isn't one document.
+		var extra json.RawMessage
+		if decoder.Decode(&extra) != io.EOF {
+			err = errTrailingData
+		}
+	}
+	if limited.N <= 0 {
+		return &server.HandlerError{
+			StatusCode:   int(response.STATUS_PAYLOAD_TOO_LARGE),
+			ErrorMessage: fmt.Sprintf("request body must not be larger than %d bytes", opts.MaxSize),
+		}
+	}
+	if err != nil {
+		return &server.HandlerError{
+			StatusCode:   int(response.STATUS_BAD_REQUEST),
+			ErrorMessage: describe(err),
+		}
+	}
+	return nil
+}
+
+var errTrailingData = errors.New("request body must only contain a single JSON value")
+
+// describe turns the errors of encoding/json into messages that point at
+// the problem without exposing Go type names.
+func describe(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return "request body must not be empty"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "request body contains truncated JSON"
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("request body contains malformed JSON at offset %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		if typeErr.Field != "" {
+			return fmt.Sprintf("field %q must be %s", typeErr.Field, jsonKind(typeErr.Type.Kind().String()))
+		}
+		return fmt.Sprintf("request body must be %s", jsonKind(typeErr.Type.Kind().String()))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return "request body contains unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	case errors.Is(err, errTrailingData):
+		return err.Error()
+	default:
+		return "request body is not valid JSON"
+	}
+}
+
+func jsonKind(kind string) string {
+	switch {
+	case kind == "string":
+		return "a string"
+	case kind == "bool":
+		return "a boolean"
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "a number"
+	case kind == "slice" || kind == "array":
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// isJSON accepts application/json and structured syntax suffixes such as
+// application/merge-patch+json.
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || (strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"))
+}
+
+// Write sends v as a complete JSON response with the given status.
+func Write(w *response.Writer, statusCode response.StatusCode, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeBody(w, statusCode, "application/json", body)
+}
+
+func writeBody(w *response.Writer, statusCode response.StatusCode, contentType string, body []byte) error {
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Content-Type", contentType)
+	err := w.WriteStatusLine(statusCode)
+	if err != nil {
+		return err
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteBody(body)
+	return err
+}
+
+// Problem is an RFC 9457 problem details document. Extensions are written
+// as additional top level members.
+type Problem struct {
+	Type       string
+	Title      string
+	Status     int
+	Detail     string
+	Instance   string
+	Extensions map[string]any
+}
+
+func (p Problem) MarshalJSON() ([]byte, error) {
+	doc := make(map[string]any, len(p.Extensions)+5)
+	for k, v := range p.Extensions {
+		doc[k] = v
+	}
+	if p.Type != "" {
+		doc["type"] = p.Type
+	}
+	if p.Title != "" {
+		doc["title"] = p.Title
+	}
+	if p.Status != 0 {
+		doc["status"] = p.Status
+	}
+	if p.Detail != "" {
+		doc["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		doc["instance"] = p.Instance
+	}
+	return json.Marshal(doc)
+}
+
+// WriteProblem sends p as application/problem+json. A missing Title is
+// filled in with the reason phrase of the status.
+func WriteProblem(w *response.Writer, p Problem) error {
+	if p.Status == 0 {
+		p.Status = int(response.STATUS_INTERNAL_SERVER_ERROR)
+	}
+	if p.Title == "" {
+		p.Title = response.ReasonPhrase(response.StatusCode(p.Status))
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return writeBody(w, response.StatusCode(p.Status), "application/problem+json", body)
+}
+
+// ProblemFromError converts err into a problem document. A *server.HandlerError
+// keeps its status and message, anything else becomes a 500 without details
+// so internal errors aren't leaked to clients.
+func ProblemFromError(err error) Problem {
+	var he *server.HandlerError
+	if errors.As(err, &he) {
+		return Problem{
+			Type:   "about:blank",
+			Status: he.StatusCode,
+			Detail: he.ErrorMessage,
+		}
+	}
+	return Problem{Type: "about:blank", Status: int(response.STATUS_INTERNAL_SERVER_ERROR)}
+}
+
+// WriteError renders err with ProblemFromError and sends it.
+func WriteError(w *response.Writer, err error) error {
+	return WriteProblem(w, ProblemFromError(err))
+}
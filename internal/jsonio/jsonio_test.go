@@ -0,0 +1,122 @@
+package jsonio
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"dev.grab-a-byte.network/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type user struct {
+	Name string   `json:"name"`
+	Age  int      `json:"age"`
+	Tags []string `json:"tags"`
+}
+
+func jsonRequest(contentType, body string) *request.Request {
+	req := &request.Request{Headers: headers.NewHeaders(), Body: []byte(body)}
+	if contentType != "" {
+		req.Headers.Set("Content-Type", contentType)
+	}
+	return req
+}
+
+func TestDecode(t *testing.T) {
+	var u user
+	require.NoError(t, Decode(jsonRequest("application/json; charset=utf-8", `{"name":"ada","age":36}`), &u, DecodeOptions{}))
+	assert.Equal(t, user{Name: "ada", Age: 36}, u)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		opts        DecodeOptions
+		status      int
+		message     string
+	}{
+		{"empty", "application/json", "", DecodeOptions{}, 400, "request body must not be empty"},
+		{"malformed", "application/json", `{"name":}`, DecodeOptions{}, 400, "malformed JSON at offset 9"},
+		{"truncated", "application/json", `{"name":"ada"`, DecodeOptions{}, 400, "truncated JSON"},
+		{"wrong type", "application/json", `{"age":"old"}`, DecodeOptions{}, 400, `field "age" must be a number`},
+		{"unknown field", "application/json", `{"nmae":"ada"}`, DecodeOptions{}, 400, `unknown field "nmae"`},
+		{"trailing data", "application/json", `{"name":"ada"} {}`, DecodeOptions{}, 400, "single JSON value"},
+		{"too large", "application/json", `{"name":"` + strings.Repeat("a", 100) + `"}`, DecodeOptions{MaxSize: 64}, 413, "larger than 64 bytes"},
+		{"not json", "text/plain", `{}`, DecodeOptions{}, 415, "Content-Type must be application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Decode(jsonRequest(tt.contentType, tt.body), &user{}, tt.opts)
+			var he *server.HandlerError
+			require.True(t, errors.As(err, &he), "got %v", err)
+			assert.Equal(t, tt.status, he.StatusCode)
+			assert.Contains(t, he.ErrorMessage, tt.message)
+		})
+	}
+
+	// Test: Unknown fields can be allowed and structured suffixes are JSON
+	require.NoError(t, Decode(jsonRequest("application/merge-patch+json", `{"nmae":"ada"}`), &u, DecodeOptions{AllowUnknownFields: true}))
+}
+
+func writeTo(t *testing.T, fn func(w *response.Writer)) (*http.Response, string) {
+	t.Helper()
+	builder := &strings.Builder{}
+	fn(response.NewWriter(builder))
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(builder.String())), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body)
+}
+
+func TestWrite(t *testing.T) {
+	res, body := writeTo(t, func(w *response.Writer) {
+		require.NoError(t, Write(w, response.STATUS_CREATED, user{Name: "ada", Tags: []string{"x"}}))
+	})
+	assert.Equal(t, 201, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	assert.Equal(t, int64(len(body)), res.ContentLength)
+	assert.JSONEq(t, `{"name":"ada","age":0,"tags":["x"]}`, body)
+}
+
+func TestWriteError(t *testing.T) {
+	// Test: Handler errors keep their status and message
+	res, body := writeTo(t, func(w *response.Writer) {
+		WriteError(w, &server.HandlerError{StatusCode: 404, ErrorMessage: "no such user"})
+	})
+	assert.Equal(t, 404, res.StatusCode)
+	assert.Equal(t, "application/problem+json", res.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"about:blank","title":"Not Found","status":404,"detail":"no such user"}`, body)
+
+	// Test: Other errors are hidden behind a 500
+	res, body = writeTo(t, func(w *response.Writer) {
+		WriteError(w, errors.New("database password is hunter2"))
+	})
+	assert.Equal(t, 500, res.StatusCode)
+	assert.NotContains(t, body, "hunter2")
+
+	// Test: Extensions become top level members
+	res, body = writeTo(t, func(w *response.Writer) {
+		WriteProblem(w, Problem{
+			Type:       "https://example.com/probs/out-of-credit",
+			Status:     403,
+			Instance:   "/account/12345",
+			Extensions: map[string]any{"balance": 30},
+		})
+	})
+	var doc map[string]any
+	require.NoError(t, json.Unmarshal([]byte(body), &doc))
+	assert.Equal(t, 403, res.StatusCode)
+	assert.Equal(t, "Forbidden", doc["title"])
+	assert.Equal(t, float64(30), doc["balance"])
+	assert.Equal(t, "/account/12345", doc["instance"])
+}
@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"dev.grab-a-byte.network/internal/server"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type Options struct {
+	// Path the metrics are served on, defaults to /metrics.
+	Path string
+	// Route maps a request to the route label. Every distinct label adds
+	// series, so it must come from a fixed set and never straight from the
+	// path. Defaults to KnownRoutes(Routes...).
+	Route func(req *request.Request) string
+	// Routes are the first path segments, such as /httpbin, the default
+	// Route labels as themselves. Everything else is "other".
+	Routes []string
+	// Buckets for the latency histogram, defaults to DefaultBuckets.
+	Buckets []float64
+}
+
+// KnownRoutes labels requests by their first path segment, /httpbin/get
+// becomes /httpbin, when it is one of routes and "other" when it isn't.
+func KnownRoutes(routes ...string) func(req *request.Request) string {
+	known := map[string]bool{}
+	for _, route := range routes {
+		known[route] = true
+	}
+	return func(req *request.Request) string {
+		segment := firstSegment(req.RequestLine.Path)
+		if known[segment] {
+			return segment
+		}
+		return "other"
+	}
+}
+
+func firstSegment(path string) string {
+	if path == "" {
+		return ""
+	}
+	if i := strings.IndexByte(path[1:], '/'); i >= 0 {
+		return path[:i+1]
+	}
+	return path
+}
+
+// Middleware counts requests by method, route and status class, records
+// their latency and response size, and serves the registry on opts.Path.
+func Middleware(reg *Registry, opts Options) server.Middleware {
+	if opts.Path == "" {
+		opts.Path = "/metrics"
+	}
+	if opts.Route == nil {
+		opts.Route = KnownRoutes(opts.Routes...)
+	}
+
+	requests := reg.Counter("http_requests_total", "Requests handled, by method, route and status class.", "method", "route", "status")
+	duration := reg.Histogram("http_request_duration_seconds", "Time taken to handle a request.", opts.Buckets, "method", "route")
+	bodyBytes := reg.Counter("http_response_body_bytes_total", "Bytes sent after the response headers.", "method", "route")
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if req.RequestLine.Path == opts.Path && req.RequestLine.Method == "GET" {
+				serve(w, reg)
+				return
+			}
+
+			started := time.Now()
+			returned := false
+			defer func() {
+				status := w.StatusCode()
+				// The server answers a panic with a 500 once it reaches it
+				if !returned && status == 0 {
+					status = response.STATUS_INTERNAL_SERVER_ERROR
+				}
+				method := normalizeMethod(req.RequestLine.Method)
+				route := opts.Route(req)
+				requests.Inc(method, route, statusClass(status))
+				duration.Observe(time.Since(started).Seconds(), method, route)
+				bodyBytes.Add(float64(w.BytesWritten()), method, route)
+			}()
+			next(w, req)
+			returned = true
+		}
+	}
+}
+
+func serve(w *response.Writer, reg *Registry) {
+	body := &bytes.Buffer{}
+	reg.WriteTo(body)
+	h := response.GetDefaultHeaders(body.Len())
+	h.Set("Content-Type", contentType)
+	w.WriteStatusLine(response.STATUS_OK)
+	w.WriteHeaders(h)
+	w.WriteBody(body.Bytes())
+}
+
+// knownMethods keeps the method label bounded, anything else is "other".
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+func normalizeMethod(method string) string {
+	if knownMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+func statusClass(statusCode response.StatusCode) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(int(statusCode)/100) + "xx"
+}
+
+// RegisterServer exposes the connection level numbers the server keeps in
+// Stats: active connections, bytes in and out, parse errors and recovered
+// panics.
+func RegisterServer(reg *Registry, stats func() server.Stats) {
+	reg.GaugeFunc("http_active_connections", "Connections currently open.", func() float64 {
+		return float64(stats().ActiveConnections)
+	})
+	reg.CounterFunc("http_connections_total", "Connections accepted.", func() float64 {
+		return float64(stats().TotalConnections)
+	})
+	reg.CounterFunc("http_received_bytes_total", "Bytes read from client connections.", func() float64 {
+		return float64(stats().BytesIn)
+	})
+	reg.CounterFunc("http_sent_bytes_total", "Bytes written to client connections.", func() float64 {
+		return float64(stats().BytesOut)
+	})
+	reg.CounterFuncVec("http_parse_errors_total", "Requests rejected by the parser, by error.", "error", func() map[string]float64 {
+		values := map[string]float64{}
+		for name, count := range stats().ParseErrors {
+			values[name] = float64(count)
+		}
+		return values
+	})
+	reg.CounterFunc("http_panics_recovered_total", "Handler panics recovered by the server.", func() float64 {
+		return float64(stats().PanicsRecovered)
+	})
+}
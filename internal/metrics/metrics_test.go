@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"dev.grab-a-byte.network/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	counter := reg.Counter("jobs_total", "Jobs run.\nBy queue.", "queue")
+	counter.Inc("fast")
+	counter.Add(2, `we"ird\`)
+	counter.Add(-5, "fast")
+
+	hist := reg.Histogram("job_seconds", "Job duration.", []float64{0.1, 1})
+	hist.Observe(0.05)
+	hist.Observe(0.5)
+	hist.Observe(3)
+
+	reg.GaugeFunc("queue_depth", "Jobs waiting.", func() float64 { return 7 })
+
+	out := &strings.Builder{}
+	_, err := reg.WriteTo(out)
+	require.NoError(t, err)
+	assert.Equal(t, `# HELP jobs_total Jobs run.\nBy queue.
+# TYPE jobs_total counter
+jobs_total{queue="fast"} 1
+jobs_total{queue="we\"ird\\"} 2
+# HELP job_seconds Job duration.
+# TYPE job_seconds histogram
+job_seconds_bucket{le="0.1"} 1
+job_seconds_bucket{le="1"} 2
+job_seconds_bucket{le="+Inf"} 3
+job_seconds_sum 3.55
+job_seconds_count 3
+# HELP queue_depth Jobs waiting.
+# TYPE queue_depth gauge
+queue_depth 7
+`, out.String())
+
+	assert.Panics(t, func() { reg.Counter("jobs_total", "again") })
+	assert.Panics(t, func() { counter.Inc() })
+}
+
+func TestMiddleware(t *testing.T) {
+	reg := NewRegistry()
+	RegisterServer(reg, func() server.Stats {
+		return server.Stats{ActiveConnections: 3, ParseErrors: map[string]uint64{"ERROR_INVALID_HTTP_METHOD": 2}}
+	})
+	handler := Middleware(reg, Options{Routes: []string{"/httpbin"}})(func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Path == "/httpbin/panic" {
+			panic("boom")
+		}
+		if req.RequestLine.Path == "/missing" {
+			w.WriteStatusLine(response.STATUS_NOT_FOUND)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+			return
+		}
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(2))
+		w.WriteBody([]byte("ok"))
+	})
+
+	call := func(method, path string) *http.Response {
+		builder := &strings.Builder{}
+		req := &request.Request{Headers: headers.NewHeaders(), RequestLine: request.RequestLine{Method: method, Path: path}}
+		handler(response.NewWriter(builder), req)
+		res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(builder.String())), nil)
+		require.NoError(t, err)
+		return res
+	}
+	call("GET", "/httpbin/get")
+	call("GET", "/httpbin/ip")
+	call("BREW", "/missing")
+	call("GET", "/a1")
+	call("GET", "/a2/b")
+	assert.Panics(t, func() {
+		req := &request.Request{Headers: headers.NewHeaders(), RequestLine: request.RequestLine{Method: "GET", Path: "/httpbin/panic"}}
+		handler(response.NewWriter(&strings.Builder{}), req)
+	})
+
+	res := call("GET", "/metrics")
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", res.Header.Get("Content-Type"))
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	text := string(body)
+
+	assert.Contains(t, text, `http_requests_total{method="GET",route="/httpbin",status="2xx"} 2`)
+	// Test: Panicking handlers count as the 500 the server sends
+	assert.Contains(t, text, `http_requests_total{method="GET",route="/httpbin",status="5xx"} 1`)
+	// Test: Unknown methods and routes share one label
+	assert.Contains(t, text, `http_requests_total{method="other",route="other",status="4xx"} 1`)
+	assert.Contains(t, text, `http_requests_total{method="GET",route="other",status="2xx"} 2`)
+	assert.NotContains(t, text, `route="/a1"`)
+	assert.Contains(t, text, `http_request_duration_seconds_count{method="GET",route="/httpbin"} 3`)
+	assert.Contains(t, text, `http_response_body_bytes_total{method="GET",route="/httpbin"} 4`)
+	assert.Contains(t, text, "http_active_connections 3\n")
+	assert.Contains(t, text, `http_parse_errors_total{error="ERROR_INVALID_HTTP_METHOD"} 2`)
+	assert.Contains(t, text, "http_panics_recovered_total 0\n")
+}
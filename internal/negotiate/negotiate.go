@@ -0,0 +1,237 @@
+package negotiate
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+)
+
+var ERROR_NOT_ACCEPTABLE = errors.New("no acceptable representation")
+
+// Offers lists the representations a handler can produce, most preferred
+// first. An empty list leaves that dimension out of the negotiation.
+type Offers struct {
+	Types     []string
+	Languages []string
+	Charsets  []string
+}
+
+// Result holds the chosen value for every dimension that had offers.
+type Result struct {
+	Type     string
+	Language string
+	Charset  string
+}
+
+// Negotiate picks the best offers for the Accept, Accept-Language and
+// Accept-Charset headers of req. ERROR_NOT_ACCEPTABLE is returned when some
+// dimension has no acceptable offer, the handler should then answer with 406
+// or ignore the preference and send its default.
+func Negotiate(req *request.Request, offers Offers) (Result, error) {
+	result := Result{}
+	var ok bool
+
+	if len(offers.Types) > 0 {
+		accept, _ := req.Headers.Get("Accept")
+		result.Type, ok = MediaType(accept, offers.Types...)
+		if !ok {
+			return result, ERROR_NOT_ACCEPTABLE
+		}
+	}
+	if len(offers.Languages) > 0 {
+		acceptLanguage, _ := req.Headers.Get("Accept-Language")
+		result.Language, ok = Language(acceptLanguage, offers.Languages...)
+		if !ok {
+			return result, ERROR_NOT_ACCEPTABLE
+		}
+	}
+	if len(offers.Charsets) > 0 {
+		acceptCharset, _ := req.Headers.Get("Accept-Charset")
+		result.Charset, ok = Charset(acceptCharset, offers.Charsets...)
+		if !ok {
+			return result, ERROR_NOT_ACCEPTABLE
+		}
+	}
+
+	return result, nil
+}
+
+// NotAcceptable answers with 406 and lists the media types on offer.
+func NotAcceptable(w *response.Writer, offers Offers) error {
+	body := "Not Acceptable. Available representations: " + strings.Join(offers.Types, ", ") + "\n"
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	AddVary(h, "Accept")
+
+	err := w.WriteStatusLine(response.STATUS_NOT_ACCEPTABLE)
+	if err != nil {
+		return err
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteBody([]byte(body))
+	return err
+}
+
+// AddVary appends field to the Vary header unless it, or *, is already
+// listed.
+func AddVary(h headers.Headers, field string) {
+	existing, ok := h.Get("Vary")
+	if !ok || existing == "" {
+		h.Set("Vary", field)
+		return
+	}
+	for _, part := range strings.Split(existing, ",") {
+		part = strings.TrimSpace(part)
+		if part == "*" || strings.EqualFold(part, field) {
+			return
+		}
+	}
+	h.Set("Vary", existing+", "+field)
+}
+
+// spec is one element of an Accept* list.
+type spec struct {
+	value  string
+	params map[string]string
+	q      float64
+}
+
+// parse splits an Accept* header into its elements. Elements with an
+// invalid weight are dropped. Parameters following q are extensions and
+// ignored.
+func parse(header string) []spec {
+	specs := []spec{}
+	for _, element := range strings.Split(header, ",") {
+		value, rest, _ := strings.Cut(element, ";")
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+
+		s := spec{value: value, params: map[string]string{}, q: 1}
+		valid := true
+		for _, param := range strings.Split(rest, ";") {
+			key, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok {
+				continue
+			}
+			key = strings.ToLower(strings.TrimSpace(key))
+			v = strings.Trim(strings.TrimSpace(v), `"`)
+			if key == "q" {
+				q, err := strconv.ParseFloat(v, 64)
+				if err != nil || q < 0 || q > 1 {
+					valid = false
+				}
+				s.q = q
+				break
+			}
+			s.params[key] = strings.ToLower(v)
+		}
+		if valid {
+			specs = append(specs, s)
+		}
+	}
+	return specs
+}
+
+// best returns the offer with the highest weight, where match gives the
+// weight of an offer and how specific the range that matched was. Ties go to
+// the earlier offer. An empty header accepts the first offer.
+func best(header string, offers []string, match func(spec, string) int) (string, bool) {
+	if len(offers) == 0 {
+		return "", false
+	}
+	if strings.TrimSpace(header) == "" {
+		return offers[0], true
+	}
+
+	specs := parse(header)
+	chosen, chosenQ := "", 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, s := range specs {
+			if sp := match(s, offer); sp > specificity {
+				q, specificity = s.q, sp
+			}
+		}
+		if specificity >= 0 && q > chosenQ {
+			chosen, chosenQ = offer, q
+		}
+	}
+	return chosen, chosenQ > 0
+}
+
+// MediaType picks from offers using an Accept value. The most specific
+// matching range decides the weight of an offer, so "text/*;q=0.5,
+// text/html" prefers HTML over plain text.
+func MediaType(accept string, offers ...string) (string, bool) {
+	return best(accept, offers, matchMediaType)
+}
+
+func matchMediaType(s spec, offer string) int {
+	offerType, offerParams := splitMediaType(offer)
+	mainType, subType, _ := strings.Cut(offerType, "/")
+	rangeType, rangeSub, _ := strings.Cut(s.value, "/")
+
+	switch {
+	case rangeType == "*" && rangeSub == "*":
+		return 0
+	case rangeType == mainType && rangeSub == "*":
+		return 1
+	case rangeType == mainType && rangeSub == subType:
+		for k, v := range s.params {
+			if offerParams[k] != v {
+				return -1
+			}
+		}
+		return 2 + len(s.params)
+	}
+	return -1
+}
+
+func splitMediaType(mediaType string) (string, map[string]string) {
+	value, rest, _ := strings.Cut(mediaType, ";")
+	params := map[string]string{}
+	for _, param := range strings.Split(rest, ";") {
+		key, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok {
+			params[strings.ToLower(strings.TrimSpace(key))] = strings.ToLower(strings.Trim(strings.TrimSpace(v), `"`))
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(value)), params
+}
+
+// Language picks from offers using an Accept-Language value with the basic
+// filtering of RFC 4647: the range "en" matches "en" and "en-GB".
+func Language(acceptLanguage string, offers ...string) (string, bool) {
+	return best(acceptLanguage, offers, func(s spec, offer string) int {
+		offer = strings.ToLower(offer)
+		switch {
+		case s.value == "*":
+			return 0
+		case s.value == offer || strings.HasPrefix(offer, s.value+"-"):
+			return 1 + strings.Count(s.value, "-")
+		}
+		return -1
+	})
+}
+
+// Charset picks from offers using an Accept-Charset value.
+func Charset(acceptCharset string, offers ...string) (string, bool) {
+	return best(acceptCharset, offers, func(s spec, offer string) int {
+		switch {
+		case s.value == "*":
+			return 0
+		case strings.EqualFold(s.value, offer):
+			return 1
+		}
+		return -1
+	})
+}
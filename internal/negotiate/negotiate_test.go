@@ -0,0 +1,106 @@
+package negotiate
+
+import (
+	"strings"
+	"testing"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMediaType(t *testing.T) {
+	offers := []string{"text/html", "application/json", "text/plain"}
+	tests := []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"", "text/html", true},
+		{"application/json", "application/json", true},
+		{"application/json;q=0.9, text/plain", "text/plain", true},
+		{"text/*, application/json;q=0.5", "text/html", true},
+		{"text/*;q=0.5, text/plain", "text/plain", true},
+		{"*/*;q=0.1, application/json", "application/json", true},
+		{"text/html;q=0, */*", "application/json", true},
+		{"TEXT/PLAIN", "text/plain", true},
+		{"image/png", "", false},
+		{"text/html;q=abc", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := MediaType(tt.accept, offers...)
+		assert.Equal(t, tt.ok, ok, tt.accept)
+		assert.Equal(t, tt.want, got, tt.accept)
+	}
+
+	// Test: Media type parameters must match
+	got, ok := MediaType("text/plain;charset=utf-8", "text/plain;charset=latin1", "text/plain;charset=utf-8")
+	require.True(t, ok)
+	assert.Equal(t, "text/plain;charset=utf-8", got)
+}
+
+func TestLanguage(t *testing.T) {
+	offers := []string{"en-GB", "de", "fr-CA"}
+	tests := []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"", "en-GB", true},
+		{"de-DE, de;q=0.8", "de", true},
+		{"fr", "fr-CA", true},
+		{"en-US, en;q=0.5, de;q=0.6", "de", true},
+		{"*;q=0.1, fr-ca", "fr-CA", true},
+		{"ja", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := Language(tt.accept, offers...)
+		assert.Equal(t, tt.ok, ok, tt.accept)
+		assert.Equal(t, tt.want, got, tt.accept)
+	}
+}
+
+func TestCharset(t *testing.T) {
+	got, ok := Charset("iso-8859-1, UTF-8;q=0.9", "utf-8", "iso-8859-1")
+	assert.True(t, ok)
+	assert.Equal(t, "iso-8859-1", got)
+
+	got, ok = Charset("*;q=0.5, utf-8;q=0", "utf-8", "utf-16")
+	assert.True(t, ok)
+	assert.Equal(t, "utf-16", got)
+
+	_, ok = Charset("utf-16", "utf-8")
+	assert.False(t, ok)
+}
+
+func TestNegotiate(t *testing.T) {
+	req := &request.Request{Headers: headers.NewHeaders()}
+	req.Headers.Set("Accept", "application/json")
+	req.Headers.Set("Accept-Language", "de")
+	offers := Offers{Types: []string{"text/html", "application/json"}, Languages: []string{"en", "de"}}
+
+	result, err := Negotiate(req, offers)
+	require.NoError(t, err)
+	assert.Equal(t, Result{Type: "application/json", Language: "de"}, result)
+
+	req.Headers.Set("Accept-Language", "ja")
+	_, err = Negotiate(req, offers)
+	assert.ErrorIs(t, err, ERROR_NOT_ACCEPTABLE)
+
+	// Test: Accept sent over several lines is one list
+	req, err = request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\nAccept: image/png\r\nAccept: application/json\r\n\r\n"))
+	require.NoError(t, err)
+	result, err = Negotiate(req, offers)
+	require.NoError(t, err)
+	assert.Equal(t, "application/json", result.Type)
+}
+
+func TestAddVary(t *testing.T) {
+	h := headers.NewHeaders()
+	AddVary(h, "Accept")
+	AddVary(h, "Accept-Encoding")
+	AddVary(h, "accept")
+	vary, _ := h.Get("Vary")
+	assert.Equal(t, "Accept, Accept-Encoding", vary)
+}
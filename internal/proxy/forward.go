@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+)
+
+// hopByHop headers only apply to a single connection and must not be
+// forwarded, see RFC 9110 section 7.6.1.
+var hopByHop = []string{
+	"connection",
+	"proxy-connection",
+	"keep-alive",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+var client = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 nil,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var dialTimeout = 10 * time.Second
+
+// Handle serves a request whose target names another server. CONNECT
+// requests are tunnelled, everything else is forwarded.
+func Handle(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method == "CONNECT" {
+		Tunnel(w, req)
+		return
+	}
+	Forward(w, req)
+}
+
+// Forward sends an absolute form request on to its origin and streams the
+// response back as a chunked body.
+func Forward(w *response.Writer, req *request.Request) {
+	rl := req.RequestLine
+	if rl.TargetForm != request.TargetAbsolute {
+		writeStatus(w, response.STATUS_BAD_REQUEST)
+		return
+	}
+
+	var body io.Reader
+	if req.IsStreamed() || len(req.Body) > 0 {
+		body = req.BodyReader()
+	}
+	outReq, err := http.NewRequest(rl.Method, rl.RequestTarget, body)
+	if err != nil {
+		writeStatus(w, response.STATUS_BAD_REQUEST)
+		return
+	}
+	if req.IsStreamed() {
+		// Only buffered bodies have a length NewRequest can see, streamed
+		// ones are sent chunked unless the client declared one
+		value, _ := req.Headers.Get("Content-Length")
+		length, err := strconv.ParseInt(value, 10, 64)
+		if err == nil {
+			outReq.ContentLength = length
+		}
+	}
+	outReq.Host = rl.Authority
+	for key, value := range StripHopByHop(req.Headers) {
+		if key == "host" || key == "content-length" {
+			continue
+		}
+		outReq.Header.Set(key, value)
+	}
+
+	res, err := client.Do(outReq)
+	if err != nil {
+		log.Printf("forward proxy: %s %s: %v", rl.Method, rl.RequestTarget, err)
+		writeStatus(w, response.STATUS_BAD_GATEWAY)
+		return
+	}
+	defer res.Body.Close()
+
+	h := headers.NewHeaders()
+	for key, values := range res.Header {
+		h.Set(key, strings.Join(values, ", "))
+	}
+	h = StripHopByHop(h)
+	h.Remove("Content-Length")
+	h.Set("Connection", "close")
+
+	hasBody := rl.Method != "HEAD" && res.StatusCode != 204 && res.StatusCode != 304
+	if hasBody {
+		h.Set("Transfer-Encoding", "chunked")
+	}
+
+	w.WriteStatusLine(response.StatusCode(res.StatusCode))
+	w.WriteHeaders(h)
+	if !hasBody {
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			_, werr := w.WriteChunkedBody(buf[:n])
+			if werr != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Leaving out the last chunk tells the client the body is cut short
+			log.Printf("forward proxy: %s %s: %v", rl.Method, rl.RequestTarget, err)
+			return
+		}
+	}
+	w.WriteChunkedBodyDone()
+	w.AddCrLf()
+}
+
+// Tunnel dials the authority of a CONNECT request and, once connected,
+// takes over the client connection and copies bytes in both directions
+// until either side closes.
+func Tunnel(w *response.Writer, req *request.Request) {
+	rl := req.RequestLine
+	if rl.TargetForm != request.TargetAuthority {
+		writeStatus(w, response.STATUS_BAD_REQUEST)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", rl.Authority, dialTimeout)
+	if err != nil {
+		log.Printf("connect proxy: %s: %v", rl.Authority, err)
+		writeStatus(w, response.STATUS_BAD_GATEWAY)
+		return
+	}
+
+	w.WriteStatusLine(response.STATUS_OK)
+	w.WriteHeaders(headers.NewHeaders())
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	if len(buffered) > 0 {
+		_, err = upstream.Write(buffered)
+		if err != nil {
+			conn.Close()
+			upstream.Close()
+			return
+		}
+	}
+
+	go pipe(conn, upstream)
+}
+
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		cw, ok := dst.(interface{ CloseWrite() error })
+		if !ok || cw.CloseWrite() != nil {
+			dst.Close()
+		}
+	}
+
+	wg.Add(2)
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+// StripHopByHop returns a copy of h without the hop-by-hop fields, both
+// the standard ones and any listed in Connection.
+func StripHopByHop(h headers.Headers) headers.Headers {
+	out := headers.NewHeaders()
+	for key, value := range h {
+		out.Set(key, value)
+	}
+	if connection, ok := h.Get("Connection"); ok {
+		for _, name := range strings.FieldsFunc(connection, func(r rune) bool { return r == ',' || r == ' ' }) {
+			out.Remove(name)
+		}
+	}
+	for _, name := range hopByHop {
+		out.Remove(name)
+	}
+	return out
+}
+
+func writeStatus(w *response.Writer, statusCode response.StatusCode) {
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(response.GetDefaultHeaders(0))
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"dev.grab-a-byte.network/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startProxy(t *testing.T, opts ...server.Option) string {
+	t.Helper()
+	srv, err := server.Serve(0, Handle, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return srv.Addr().String()
+}
+
+func TestForward(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Proxy-Connection"))
+		w.Header().Set("X-Origin", "yes")
+		if r.URL.Path == "/truncated" {
+			// Returning early cuts the body short of its declared length
+			w.Header().Set("Content-Length", "100")
+		}
+		fmt.Fprintf(w, "hello from %s", r.URL.Path)
+	}))
+	defer origin.Close()
+
+	conn, err := net.Dial("tcp", startProxy(t))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET %s/thing HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\n\r\n", origin.URL, origin.Listener.Addr())
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "yes", res.Header.Get("X-Origin"))
+	assert.Equal(t, "hello from /thing", string(body))
+
+	// Test: Bodies the origin cuts short are not passed on as complete
+	conn, err = net.Dial("tcp", startProxy(t))
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s/truncated HTTP/1.1\r\nHost: %s\r\n\r\n", origin.URL, origin.Listener.Addr())
+	res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	_, err = io.ReadAll(res.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestForwardStreamedBody(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		fmt.Fprintf(w, "%d %d %x", r.ContentLength, len(body), sha256.Sum256(body))
+	}))
+	defer origin.Close()
+
+	conn, err := net.Dial("tcp", startProxy(t, server.WithStreamingBodies(1<<20)))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: Bodies past the buffering limit are streamed to the origin in full
+	body := bytes.Repeat([]byte("0123456789abcdef"), 3<<16)
+	fmt.Fprintf(conn, "POST %s/upload HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\n\r\n", origin.URL, origin.Listener.Addr(), len(body))
+	go conn.Write(body)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	reply, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d %d %x", len(body), len(body), sha256.Sum256(body)), string(reply))
+}
+
+func TestTunnel(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	conn, err := net.Dial("tcp", startProxy(t))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(status, "HTTP/1.1 200"))
+	blank, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", blank)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
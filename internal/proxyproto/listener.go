@@ -0,0 +1,116 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// headerTimeout bounds the wait for the header, so a peer stalling part way
+// through can't hold the connection, or callers of RemoteAddr, forever.
+var headerTimeout = 5 * time.Second
+
+// Listener accepts connections that may start with a PROXY protocol
+// header. Trusted peers, matched by their address against the Trusted
+// prefixes, may send one and their connections report the client address
+// it carries. Headers from anyone else are rejected, their connections
+// fail on the first read, while plain connections from them are passed
+// through untouched.
+//
+// Wrap the listener before TLS, the header comes ahead of the handshake.
+type Listener struct {
+	net.Listener
+	Trusted []netip.Prefix
+}
+
+func NewListener(l net.Listener, trusted []netip.Prefix) *Listener {
+	return &Listener{Listener: l, Trusted: trusted}
+}
+
+// Accept returns a *Conn. The header isn't read until the connection is
+// first used, so a slow peer doesn't hold up other connections.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, trusted: l.trusted(conn.RemoteAddr())}, nil
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := tcp.AddrPort().Addr().Unmap()
+	return slices.ContainsFunc(l.Trusted, func(p netip.Prefix) bool {
+		return p.Contains(ip)
+	})
+}
+
+type Conn struct {
+	net.Conn
+	trusted bool
+
+	once   sync.Once
+	reader *bufio.Reader
+	header *Header
+	err    error
+}
+
+// init reads the header, if there is one, on first use. A peer that is too
+// slow to send one is treated as sending none, one stalling inside it fails.
+func (c *Conn) init() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReaderSize(c.Conn, 256)
+		c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+		c.header, c.err = ReadHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.header != nil && !c.trusted {
+			c.header, c.err = nil, ERROR_UNTRUSTED_PROXY
+		}
+	})
+}
+
+// Header returns the PROXY protocol header the peer sent, nil if there was
+// none.
+func (c *Conn) Header() (*Header, error) {
+	c.init()
+	return c.header, c.err
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	// Bytes peeked past the header come first, then straight from the
+	// connection
+	if c.reader.Buffered() > 0 {
+		return c.reader.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+// RemoteAddr is the client address from the header when there is one,
+// otherwise the peer's. It waits for the header to arrive.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Source != nil && c.header.Command == CommandProxy {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr is the address the client connected to according to the
+// header, otherwise the connection's own.
+func (c *Conn) LocalAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Destination != nil && c.header.Command == CommandProxy {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
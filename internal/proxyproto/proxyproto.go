@@ -0,0 +1,150 @@
+// Package proxyproto reads the HAProxy PROXY protocol header, versions 1
+// and 2, which load balancers put in front of a TCP stream to pass on the
+// address of the client they accepted it from.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var ERROR_INVALID_PROXY_HEADER = errors.New("invalid PROXY protocol header")
+var ERROR_UNTRUSTED_PROXY = errors.New("PROXY protocol header from an untrusted peer")
+
+// signatureV2 starts every version 2 header, it can't be the start of a
+// valid request in any other protocol.
+const signatureV2 = "\r\n\r\n\x00\r\nQUIT\n"
+
+// maxLineV1 is the longest version 1 header including the CRLF.
+const maxLineV1 = 107
+
+type Command byte
+
+const (
+	// CommandLocal is sent for connections the balancer opened itself, such
+	// as health checks. The connection's own addresses apply.
+	CommandLocal Command = 0
+	// CommandProxy carries the addresses of a relayed client connection.
+	CommandProxy Command = 1
+)
+
+type Header struct {
+	Version int
+	Command Command
+	// Source and Destination are nil when the balancer didn't know them or
+	// they weren't IP addresses.
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// ReadHeader reads a header from the start of r. It returns nil without
+// consuming anything when r doesn't start with one.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil
+	}
+	switch first[0] {
+	case 'P':
+		prefix, err := r.Peek(6)
+		if err != nil || string(prefix) != "PROXY " {
+			return nil, nil
+		}
+		return readV1(r)
+	case '\r':
+		prefix, err := r.Peek(len(signatureV2))
+		if err != nil || string(prefix) != signatureV2 {
+			return nil, nil
+		}
+		return readV2(r)
+	}
+	return nil, nil
+}
+
+// readV1 parses the text form, "PROXY TCP4 <src> <dst> <sport> <dport>\r\n"
+// or "PROXY UNKNOWN ...\r\n".
+func readV1(r *bufio.Reader) (*Header, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > maxLineV1 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ERROR_INVALID_PROXY_HEADER
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	h := &Header{Version: 1, Command: CommandProxy}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, ERROR_INVALID_PROXY_HEADER
+	}
+	src, srcErr := netip.ParseAddr(fields[2])
+	dst, dstErr := netip.ParseAddr(fields[3])
+	srcPort, srcPortErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstPortErr := strconv.ParseUint(fields[5], 10, 16)
+	if err := errors.Join(srcErr, dstErr, srcPortErr, dstPortErr); err != nil {
+		return nil, ERROR_INVALID_PROXY_HEADER
+	}
+	if src.Is4() != (fields[1] == "TCP4") || dst.Is4() != src.Is4() {
+		return nil, ERROR_INVALID_PROXY_HEADER
+	}
+	h.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(srcPort)))
+	h.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, uint16(dstPort)))
+	return h, nil
+}
+
+// readV2 parses the binary form. Address families other than TCP over
+// IPv4 and IPv6 are accepted but carry no usable addresses, TLVs are
+// skipped.
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, len(signatureV2)+4)
+	_, err := io.ReadFull(r, fixed)
+	if err != nil {
+		return nil, ERROR_INVALID_PROXY_HEADER
+	}
+	versionCommand, family := fixed[12], fixed[13]
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, ERROR_INVALID_PROXY_HEADER
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, ERROR_INVALID_PROXY_HEADER
+	}
+	h := &Header{Version: 2, Command: Command(versionCommand & 0x0f)}
+	switch h.Command {
+	case CommandLocal:
+		return h, nil
+	case CommandProxy:
+	default:
+		return nil, ERROR_INVALID_PROXY_HEADER
+	}
+
+	var size int
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		size = 4
+	case 0x21:
+		// TCP over IPv6
+		size = 16
+	default:
+		return h, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, ERROR_INVALID_PROXY_HEADER
+	}
+	src, _ := netip.AddrFromSlice(payload[:size])
+	dst, _ := netip.AddrFromSlice(payload[size : 2*size])
+	ports := payload[2*size:]
+	h.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(ports)))
+	h.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, binary.BigEndian.Uint16(ports[2:])))
+	return h, nil
+}
@@ -0,0 +1,169 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadHeaderV1(t *testing.T) {
+	read := func(raw string) (*Header, string, error) {
+		r := bufio.NewReader(strings.NewReader(raw))
+		h, err := ReadHeader(r)
+		rest, _ := io.ReadAll(r)
+		return h, string(rest), err
+	}
+
+	// Test: TCP4 and TCP6 headers, leaving the request after them
+	h, rest, err := read("PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\nGET / HTTP/1.1\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, 1, h.Version)
+	assert.Equal(t, "203.0.113.7:56324", h.Source.String())
+	assert.Equal(t, "192.0.2.1:443", h.Destination.String())
+	assert.Equal(t, "GET / HTTP/1.1\r\n", rest)
+
+	h, _, err = read("PROXY TCP6 2001:db8::1 2001:db8::2 4000 80\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:4000", h.Source.String())
+
+	// Test: UNKNOWN carries no addresses
+	h, _, err = read("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n")
+	require.NoError(t, err)
+	assert.Nil(t, h.Source)
+
+	// Test: Anything else starting with the prefix is rejected
+	for _, raw := range []string{
+		"PROXY TCP4 203.0.113.7 192.0.2.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.0.2.1 1 2\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 1 70000\r\n",
+		"PROXY UDP4 203.0.113.7 192.0.2.1 1 2\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 1 2\n",
+		"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n",
+	} {
+		_, _, err = read(raw)
+		assert.ErrorIs(t, err, ERROR_INVALID_PROXY_HEADER, raw)
+	}
+
+	// Test: Streams without a header are left untouched
+	h, rest, err = read("POST / HTTP/1.1\r\n")
+	require.NoError(t, err)
+	assert.Nil(t, h)
+	assert.Equal(t, "POST / HTTP/1.1\r\n", rest)
+}
+
+func TestReadHeaderV2(t *testing.T) {
+	read := func(hexHeader, after string) (*Header, string, error) {
+		raw, err := hex.DecodeString(strings.ReplaceAll(hexHeader, " ", ""))
+		require.NoError(t, err)
+		r := bufio.NewReader(strings.NewReader(signatureV2 + string(raw) + after))
+		h, err := ReadHeader(r)
+		rest, _ := io.ReadAll(r)
+		return h, string(rest), err
+	}
+
+	// Test: TCP over IPv4
+	h, rest, err := read("21 11 000c cb007107 c0000201 dc04 01bb", "GET")
+	require.NoError(t, err)
+	assert.Equal(t, 2, h.Version)
+	assert.Equal(t, CommandProxy, h.Command)
+	assert.Equal(t, "203.0.113.7:56324", h.Source.String())
+	assert.Equal(t, "192.0.2.1:443", h.Destination.String())
+	assert.Equal(t, "GET", rest)
+
+	// Test: TCP over IPv6, with a TLV that is skipped
+	h, rest, err = read("21 21 0029 20010db8000000000000000000000001 20010db8000000000000000000000002 0fa0 0050 04 0002 abcd", "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:4000", h.Source.String())
+	assert.Equal(t, "GET", rest)
+
+	// Test: LOCAL and other families carry no addresses
+	h, _, err = read("20 00 0000", "")
+	require.NoError(t, err)
+	assert.Equal(t, CommandLocal, h.Command)
+	assert.Nil(t, h.Source)
+	h, _, err = read("21 31 0000", "")
+	require.NoError(t, err)
+	assert.Nil(t, h.Source)
+
+	// Test: Bad versions, commands and truncated addresses are rejected
+	for _, raw := range []string{"11 11 0000", "22 11 0000", "21 11 0004 cb007107", "21 11 000c cb00"} {
+		_, _, err = read(raw, "")
+		assert.ErrorIs(t, err, ERROR_INVALID_PROXY_HEADER, raw)
+	}
+}
+
+func TestListener(t *testing.T) {
+	accept := func(trusted []netip.Prefix, raw string) (net.Conn, net.Conn) {
+		t.Helper()
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { inner.Close() })
+		listener := NewListener(inner, trusted)
+
+		client, err := net.Dial("tcp", inner.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = client.Write([]byte(raw))
+		require.NoError(t, err)
+
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn, client
+	}
+	loopback := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	header := "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n"
+
+	// Test: Trusted peers report the client from the header
+	conn, _ := accept(loopback, header+"GET")
+	assert.Equal(t, "203.0.113.7:56324", conn.RemoteAddr().String())
+	assert.Equal(t, "192.0.2.1:443", conn.LocalAddr().String())
+	buf := make([]byte, 3)
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "GET", string(buf))
+
+	// Test: Trusted peers may leave the header out
+	conn, client := accept(loopback, "GET")
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "GET", string(buf))
+	assert.Equal(t, client.LocalAddr().String(), conn.RemoteAddr().String())
+
+	// Test: Headers from untrusted peers fail the connection
+	conn, client = accept(nil, header+"GET")
+	_, err = conn.Read(buf)
+	assert.ErrorIs(t, err, ERROR_UNTRUSTED_PROXY)
+	assert.Equal(t, client.LocalAddr().String(), conn.RemoteAddr().String())
+
+	// Test: Untrusted peers without a header are served as usual
+	conn, _ = accept(nil, "GET")
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "GET", string(buf))
+
+	// Test: Peers stalling inside the header don't block for long
+	defer func(timeout time.Duration) { headerTimeout = timeout }(headerTimeout)
+	headerTimeout = 50 * time.Millisecond
+	conn, client = accept(loopback, "PROXY TCP4 203.0.113.7")
+	assert.Equal(t, client.LocalAddr().String(), conn.RemoteAddr().String())
+	_, err = conn.Read(buf)
+	assert.ErrorIs(t, err, ERROR_INVALID_PROXY_HEADER)
+
+	// Test: Slow clients without a header keep their connection
+	conn, client = accept(loopback, "")
+	assert.Equal(t, client.LocalAddr().String(), conn.RemoteAddr().String())
+	client.Write([]byte("GET"))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "GET", string(buf))
+}
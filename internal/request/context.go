@@ -0,0 +1,42 @@
+package request
+
+import "context"
+
+type contextKey string
+
+const requestIDKey contextKey = "request_id"
+
+// Context returns the request's context. The server cancels it when the
+// client disconnects, the server shuts down, the request deadline passes or
+// the handler returns.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r using ctx, which is how middleware
+// attaches values such as an authenticated principal for later handlers.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// ID returns the identifier the server assigned to this request.
+func (r *Request) ID() string {
+	return RequestIDFromContext(r.Context())
+}
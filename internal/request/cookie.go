@@ -0,0 +1,28 @@
+package request
+
+import (
+	"errors"
+
+	"dev.grab-a-byte.network/internal/cookie"
+)
+
+var ERROR_NO_COOKIE = errors.New("named cookie not present")
+
+// Cookies returns every cookie sent with the request.
+func (r *Request) Cookies() []*cookie.Cookie {
+	header, ok := r.Headers.Get("Cookie")
+	if !ok {
+		return []*cookie.Cookie{}
+	}
+	return cookie.Parse(header)
+}
+
+// Cookie returns the first cookie with the given name.
+func (r *Request) Cookie(name string) (*cookie.Cookie, error) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, ERROR_NO_COOKIE
+}
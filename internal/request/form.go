@@ -0,0 +1,254 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+)
+
+var ERROR_NOT_MULTIPART = errors.New("request is not multipart/form-data")
+var ERROR_FORM_TOO_LARGE = errors.New("form too large")
+var ERROR_PART_TOO_LARGE = errors.New("form part too large")
+
+// MaxFormSize bounds the urlencoded body read by ParseForm.
+const MaxFormSize = 10 << 20
+
+// Query returns the parsed query string of the request target.
+func (r *Request) Query() url.Values {
+	u, err := url.ParseRequestURI(r.RequestLine.Path)
+	if err != nil {
+		return url.Values{}
+	}
+	return u.Query()
+}
+
+// mediaType returns the lowercase media type of the Content-Type header
+// along with its parameters.
+func (r *Request) mediaType() (string, map[string]string) {
+	contentType, ok := r.Headers.Get("Content-Type")
+	if !ok {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil
+	}
+	return mediaType, params
+}
+
+// ParseForm fills Form and PostForm. Body fields are only parsed for
+// application/x-www-form-urlencoded requests and are listed before query
+// string fields of the same name in Form.
+func (r *Request) ParseForm() error {
+	if r.PostForm == nil {
+		r.PostForm = url.Values{}
+		mediaType, _ := r.mediaType()
+		if mediaType == "application/x-www-form-urlencoded" {
+			body, err := io.ReadAll(io.LimitReader(r.BodyReader(), MaxFormSize+1))
+			if err != nil {
+				return err
+			}
+			if len(body) > MaxFormSize {
+				return ERROR_FORM_TOO_LARGE
+			}
+			values, err := url.ParseQuery(string(body))
+			if err != nil {
+				return err
+			}
+			r.PostForm = values
+		}
+	}
+
+	if r.Form == nil {
+		r.Form = url.Values{}
+		for key, values := range r.PostForm {
+			r.Form[key] = append(r.Form[key], values...)
+		}
+		for key, values := range r.Query() {
+			r.Form[key] = append(r.Form[key], values...)
+		}
+	}
+
+	return nil
+}
+
+// FormValue returns the first value for key from Form, parsing it first if
+// needed. Parse errors are ignored.
+func (r *Request) FormValue(key string) string {
+	if r.Form == nil {
+		r.ParseForm()
+	}
+	return r.Form.Get(key)
+}
+
+type MultipartOptions struct {
+	// MaxMemory is how much of a part is held in memory before it is
+	// spilled to a temporary file. Zero means DefaultMaxMemory.
+	MaxMemory int64
+	// MaxPartSize and MaxTotalSize bound a single part and the sum of all
+	// parts. Zero means no limit.
+	MaxPartSize  int64
+	MaxTotalSize int64
+	// TempDir is where spilled parts are written, defaults to os.TempDir.
+	TempDir string
+}
+
+const DefaultMaxMemory = 1 << 20
+
+// MultipartReader yields the parts of a multipart/form-data body one at a
+// time, reading from the connection as it goes so whole uploads never have
+// to be held in memory.
+type MultipartReader struct {
+	reader *multipart.Reader
+	opts   MultipartOptions
+	total  int64
+}
+
+// MultipartReader returns a reader over the parts of a multipart/form-data
+// body. Use RequestFromReaderStreaming, or the server's streaming option, so
+// large uploads are not buffered by the parser first.
+func (r *Request) MultipartReader(opts MultipartOptions) (*MultipartReader, error) {
+	mediaType, params := r.mediaType()
+	if mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, ERROR_NOT_MULTIPART
+	}
+	if opts.MaxMemory == 0 {
+		opts.MaxMemory = DefaultMaxMemory
+	}
+
+	return &MultipartReader{
+		reader: multipart.NewReader(r.BodyReader(), params["boundary"]),
+		opts:   opts,
+	}, nil
+}
+
+// NextPart reads the next part in full, spilling it to a temporary file when
+// it is larger than MaxMemory. It returns io.EOF after the last part. The
+// caller must call Remove on parts that were spilled once done with them.
+func (mr *MultipartReader) NextPart() (*Part, error) {
+	raw, err := mr.reader.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	part := &Part{
+		FormName:    raw.FormName(),
+		FileName:    raw.FileName(),
+		ContentType: raw.Header.Get("Content-Type"),
+		Header:      raw.Header,
+	}
+
+	limit := int64(-1)
+	if mr.opts.MaxPartSize > 0 {
+		limit = mr.opts.MaxPartSize
+	}
+	if mr.opts.MaxTotalSize > 0 {
+		remaining := max(mr.opts.MaxTotalSize-mr.total, 0)
+		if limit < 0 || remaining < limit {
+			limit = remaining
+		}
+	}
+
+	err = part.fill(raw, mr.opts.MaxMemory, limit, mr.opts.TempDir)
+	mr.total += part.Size
+	if errors.Is(err, errLimit) {
+		part.Remove()
+		if mr.opts.MaxTotalSize > 0 && mr.total > mr.opts.MaxTotalSize {
+			return nil, ERROR_FORM_TOO_LARGE
+		}
+		return nil, ERROR_PART_TOO_LARGE
+	}
+	if err != nil {
+		part.Remove()
+		return nil, err
+	}
+
+	return part, nil
+}
+
+// Part is a single multipart/form-data field or file.
+type Part struct {
+	FormName    string
+	FileName    string
+	ContentType string
+	Header      textproto.MIMEHeader
+	Size        int64
+
+	data []byte
+	path string
+}
+
+var errLimit = errors.New("limit reached")
+
+// fill copies src into memory, switching to a temporary file once more than
+// maxMemory bytes have been seen. A negative limit means the part size is
+// unbounded.
+func (p *Part) fill(src io.Reader, maxMemory, limit int64, tempDir string) error {
+	if limit >= 0 {
+		src = io.LimitReader(src, limit+1)
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := io.CopyN(buf, src, maxMemory+1)
+	p.Size = n
+	if err == io.EOF {
+		p.data = buf.Bytes()
+		return p.checkLimit(limit)
+	}
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(tempDir, "multipart-")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	p.path = file.Name()
+
+	_, err = file.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	n, err = io.Copy(file, src)
+	p.Size += n
+	if err != nil {
+		return err
+	}
+	return p.checkLimit(limit)
+}
+
+func (p *Part) checkLimit(limit int64) error {
+	if limit >= 0 && p.Size > limit {
+		return errLimit
+	}
+	return nil
+}
+
+// InMemory reports whether the part's content is held in memory rather
+// than in a temporary file.
+func (p *Part) InMemory() bool {
+	return p.path == ""
+}
+
+// Open returns a reader over the part's content.
+func (p *Part) Open() (io.ReadCloser, error) {
+	if p.InMemory() {
+		return io.NopCloser(bytes.NewReader(p.data)), nil
+	}
+	return os.Open(p.path)
+}
+
+// Remove deletes the temporary file backing a spilled part.
+func (p *Part) Remove() error {
+	if p.InMemory() {
+		return nil
+	}
+	return os.Remove(p.path)
+}
@@ -0,0 +1,119 @@
+package request
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForm(t *testing.T) {
+	body := "name=ada&lang=go&lang=zig&note=a%20b"
+	reader := &chunkReader{
+		data: "POST /submit?lang=c&page=2 HTTP/1.1\r\n" +
+			"Content-Type: application/x-www-form-urlencoded\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+			"\r\n" + body,
+		numBytesPerRead: 5,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, []string{"go", "zig"}, r.PostForm["lang"])
+	assert.Equal(t, []string{"go", "zig", "c"}, r.Form["lang"])
+	assert.Equal(t, "a b", r.FormValue("note"))
+	assert.Equal(t, "2", r.FormValue("page"))
+	assert.Empty(t, r.PostForm.Get("page"))
+}
+
+func multipartBody(t *testing.T, fileSize int) (string, string) {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	require.NoError(t, mw.WriteField("title", "holiday"))
+	fw, err := mw.CreateFormFile("video", "clip.mp4")
+	require.NoError(t, err)
+	_, err = fw.Write(bytes.Repeat([]byte{'v'}, fileSize))
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+	return buf.String(), mw.FormDataContentType()
+}
+
+func streamedRequest(t *testing.T, body, contentType string) *Request {
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Type: " + contentType + "\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+			"\r\n" + body,
+		numBytesPerRead: 4096,
+	}
+	r, err := RequestFromReaderStreaming(reader, 1024)
+	require.NoError(t, err)
+	return r
+}
+
+func TestMultipartReader(t *testing.T) {
+	body, contentType := multipartBody(t, 10000)
+	r := streamedRequest(t, body, contentType)
+	require.True(t, r.IsStreamed())
+	assert.Nil(t, r.Body)
+
+	mr, err := r.MultipartReader(MultipartOptions{MaxMemory: 4096, TempDir: t.TempDir()})
+	require.NoError(t, err)
+
+	// Test: Small field stays in memory
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "title", part.FormName)
+	assert.True(t, part.InMemory())
+	rc, err := part.Open()
+	require.NoError(t, err)
+	value, _ := io.ReadAll(rc)
+	assert.Equal(t, "holiday", string(value))
+
+	// Test: Large file spills to disk
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "video", part.FormName)
+	assert.Equal(t, "clip.mp4", part.FileName)
+	assert.False(t, part.InMemory())
+	assert.Equal(t, int64(10000), part.Size)
+	rc, err = part.Open()
+	require.NoError(t, err)
+	content, _ := io.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, strings.Repeat("v", 10000), string(content))
+	require.NoError(t, part.Remove())
+
+	_, err = mr.NextPart()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestMultipartLimits(t *testing.T) {
+	body, contentType := multipartBody(t, 10000)
+
+	// Test: Per part limit
+	mr, err := streamedRequest(t, body, contentType).MultipartReader(MultipartOptions{MaxPartSize: 5000, TempDir: t.TempDir()})
+	require.NoError(t, err)
+	_, err = mr.NextPart()
+	require.NoError(t, err)
+	_, err = mr.NextPart()
+	require.ErrorIs(t, err, ERROR_PART_TOO_LARGE)
+
+	// Test: Total limit
+	mr, err = streamedRequest(t, body, contentType).MultipartReader(MultipartOptions{MaxTotalSize: 9000, TempDir: t.TempDir()})
+	require.NoError(t, err)
+	_, err = mr.NextPart()
+	require.NoError(t, err)
+	_, err = mr.NextPart()
+	require.ErrorIs(t, err, ERROR_FORM_TOO_LARGE)
+
+	// Test: Not multipart
+	_, err = streamedRequest(t, "x", "text/plain").MultipartReader(MultipartOptions{})
+	require.ErrorIs(t, err, ERROR_NOT_MULTIPART)
+}
@@ -0,0 +1,48 @@
+package request
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+)
+
+// Peer describes the client certificate presented on a TLS connection.
+type Peer struct {
+	// Certificates is the chain as sent by the client, leaf first.
+	Certificates []*x509.Certificate
+	// VerifiedChains is set when the chain was verified against the
+	// server's client CA pool. Without it the certificate must not be
+	// trusted for authorization.
+	VerifiedChains [][]*x509.Certificate
+
+	Subject        pkix.Name
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+}
+
+// Verified reports whether the client certificate chains up to a trusted CA.
+func (p *Peer) Verified() bool {
+	return len(p.VerifiedChains) > 0
+}
+
+// PeerFromTLS returns the client certificate details of a connection, or
+// nil when the client sent no certificate.
+func PeerFromTLS(state *tls.ConnectionState) *Peer {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	leaf := state.PeerCertificates[0]
+	return &Peer{
+		Certificates:   state.PeerCertificates,
+		VerifiedChains: state.VerifiedChains,
+		Subject:        leaf.Subject,
+		DNSNames:       leaf.DNSNames,
+		EmailAddresses: leaf.EmailAddresses,
+		IPAddresses:    leaf.IPAddresses,
+		URIs:           leaf.URIs,
+	}
+}
@@ -2,9 +2,13 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -15,6 +19,26 @@ var ERROR_INVALID_REQUEST_LINE = errors.New("invalid request line")
 var ERROR_INVLID_HTTP_VERSION = errors.New("invalid http version")
 var ERROR_INVALID_HTTP_METHOD = errors.New("invalid http method")
 var ERROR_REQUEST_IN_ERROR_STATE = errors.New("request in error state")
+var ERROR_INVALID_REQUEST_TARGET = errors.New("invalid request target")
+var ERROR_INCOMPLETE_REQUEST = errors.New("not enough data sent")
+var ERROR_INVALID_CONTENT_LENGTH = errors.New("invalid content length")
+var ERROR_REQUEST_LINE_TOO_LONG = errors.New("request line too long")
+var ERROR_HEADERS_TOO_LARGE = errors.New("header section too large")
+
+// maxHeaderBytes bounds the request line and headers together, a client
+// that never ends them would otherwise grow the buffer without limit.
+const maxHeaderBytes = 1 << 20
+
+// TargetForm is the shape of the request target as defined in RFC 9112
+// section 3.2.
+type TargetForm string
+
+const (
+	TargetOrigin    TargetForm = "origin"
+	TargetAbsolute  TargetForm = "absolute"
+	TargetAuthority TargetForm = "authority"
+	TargetAsterisk  TargetForm = "asterisk"
+)
 
 type requestStatus string
 
@@ -30,8 +54,9 @@ var SEPERATOR = []byte("\r\n")
 
 func newRequest() *Request {
 	return &Request{
-		status:  StatusInit,
-		Headers: headers.NewHeaders(),
+		status:      StatusInit,
+		Headers:     headers.NewHeaders(),
+		maxBuffered: -1,
 	}
 }
 
@@ -39,14 +64,76 @@ type RequestLine struct {
 	HttpVersion   string
 	RequestTarget string
 	Method        string
+	TargetForm    TargetForm
+	// Scheme and Authority are only set for absolute and authority form
+	// targets. Path is the origin form of the target, e.g. "/a?b=c", for
+	// origin and absolute form targets.
+	Scheme    string
+	Authority string
+	Path      string
+}
+
+// IsProxyRequest reports whether the target names another server, which is
+// only meaningful when acting as a forward proxy.
+func (rl *RequestLine) IsProxyRequest() bool {
+	return rl.TargetForm == TargetAbsolute || rl.TargetForm == TargetAuthority
 }
 
 type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
 	Body        []byte
-	status      requestStatus
-	previousContentLength int
+	// Form holds the query string and urlencoded body fields and PostForm
+	// only the body fields. Both are nil until ParseForm is called.
+	Form     url.Values
+	PostForm url.Values
+	// RemoteAddr is the address of the client, set by the server. Behind a
+	// load balancer sending the PROXY protocol it's the client the balancer
+	// reported.
+	RemoteAddr string
+	// TLS is the state of the connection when served over TLS, and Peer
+	// the client certificate if one was presented.
+	TLS      *tls.ConnectionState
+	Peer     *Peer
+	status   requestStatus
+	buffered []byte
+	ctx      context.Context
+	// maxBuffered is the largest body read into Body, larger ones are
+	// streamed through bodyReader instead. Negative means no limit.
+	maxBuffered  int64
+	streamLength int64
+	bodyReader   io.Reader
+	// headerBytes counts the request line and headers parsed so far
+	headerBytes int
+}
+
+// BodyReader returns a reader over the request body. For streamed bodies
+// it reads directly from the connection and can only be consumed once.
+func (r *Request) BodyReader() io.Reader {
+	if r.bodyReader != nil {
+		return r.bodyReader
+	}
+	return bytes.NewReader(r.Body)
+}
+
+// SetBody replaces the body with one read in full elsewhere, such as by
+// middleware decoding it. The body is no longer streamed afterwards.
+func (r *Request) SetBody(body []byte) {
+	r.Body = body
+	r.bodyReader = nil
+}
+
+// IsStreamed reports whether the body was left unread by the parser and
+// must be read through BodyReader.
+func (r *Request) IsStreamed() bool {
+	return r.bodyReader != nil
+}
+
+// Buffered returns any bytes that were read from the underlying reader past
+// the end of this request, e.g. the start of a tunnelled stream sent by the
+// client without waiting for the response.
+func (r *Request) Buffered() []byte {
+	return r.buffered
 }
 
 func (r *Request) String() string {
@@ -92,6 +179,7 @@ outer:
 
 			r.RequestLine = *rl
 			read += n
+			r.headerBytes += n
 
 			r.status = StatusParseHeaders
 		case StatusParseHeaders:
@@ -105,6 +193,7 @@ outer:
 			}
 
 			read += n
+			r.headerBytes += n
 
 			if done {
 				r.status = StatusParseBody
@@ -114,28 +203,31 @@ outer:
 			value, ok := r.Headers.Get("content-length")
 			if !ok {
 				r.status = StatusDone
-				return 0, nil
+				return read, nil
 			}
 
-			if len(data) == r.previousContentLength {
-				return 0, fmt.Errorf("Not enough data sent")
-			}
-			r.previousContentLength = len(data)
-
 			length, err := strconv.Atoi(value)
 			if err != nil {
 				return 0, err
 			}
+			if length < 0 {
+				return 0, ERROR_INVALID_CONTENT_LENGTH
+			}
 
-			if len(data) == 0 {
-				return 0, fmt.Errorf("Not enough data sent as part of body")
+			// Large bodies are left on the reader for BodyReader to stream
+			if r.maxBuffered >= 0 && int64(length) > r.maxBuffered {
+				r.streamLength = int64(length)
+				r.status = StatusDone
+				return read, nil
 			}
-			if len(data) < length {
+
+			remaining := data[read:]
+			if len(remaining) < length {
 				break outer
 			}
-			r.Body = append(r.Body, data[0:length]...)
+			r.Body = append(r.Body, remaining[:length]...)
 
-			read += len(data)
+			read += length
 			r.status = StatusDone
 			return read, nil
 		}
@@ -145,15 +237,49 @@ outer:
 }
 
 func RequestFromReader(r io.Reader) (*Request, error) {
+	return readRequest(r, newRequest())
+}
+
+// RequestFromReaderStreaming parses like RequestFromReader, except bodies
+// with a Content-Length above maxBuffered are not read. Body stays nil and
+// the body must be read from BodyReader, which reads from r.
+func RequestFromReaderStreaming(r io.Reader, maxBuffered int64) (*Request, error) {
 	req := newRequest()
+	req.maxBuffered = maxBuffered
+	return readRequest(r, req)
+}
 
-	//NOTE: Buffer could overrun (e.g. body or auth token)
+// NewRequest builds a request from parts parsed elsewhere, such as the
+// fields of an HTTP/2 stream. A nil bodyReader means body is the whole body,
+// otherwise the body is streamed from bodyReader.
+func NewRequest(line RequestLine, h headers.Headers, body []byte, bodyReader io.Reader) (*Request, error) {
+	err := parseRequestTarget(&line)
+	if err != nil {
+		return nil, err
+	}
+	req := newRequest()
+	req.RequestLine = line
+	req.Headers = h
+	req.Body = body
+	req.bodyReader = bodyReader
+	req.status = StatusDone
+	return req, nil
+}
+
+func readRequest(r io.Reader, req *Request) (*Request, error) {
 	buf := make([]byte, 1024)
 	bufLen := 0
 
 	for !req.done() {
+		if bufLen == len(buf) {
+			grown := make([]byte, len(buf)*2)
+			copy(grown, buf)
+			buf = grown
+		}
+
 		n, err := r.Read(buf[bufLen:])
-		if err != nil && err != io.EOF {
+		eof := err == io.EOF
+		if err != nil && !eof {
 			return nil, err
 		}
 
@@ -166,8 +292,33 @@ func RequestFromReader(r io.Reader) (*Request, error) {
 
 		copy(buf, buf[readN:bufLen])
 		bufLen -= readN
+
+		// What's left unparsed is part of an unfinished line
+		if req.headerBytes+bufLen > maxHeaderBytes {
+			switch req.status {
+			case StatusInit:
+				return nil, ERROR_REQUEST_LINE_TOO_LONG
+			case StatusParseHeaders:
+				return nil, ERROR_HEADERS_TOO_LARGE
+			}
+		}
+
+		if eof && n == 0 && readN == 0 && !req.done() {
+			return nil, ERROR_INCOMPLETE_REQUEST
+		}
+	}
+
+	if req.streamLength > 0 {
+		head := min(int64(bufLen), req.streamLength)
+		req.bodyReader = io.MultiReader(
+			bytes.NewReader(buf[:head]),
+			io.LimitReader(r, req.streamLength-head),
+		)
+		req.buffered = buf[head:bufLen]
+		return req, nil
 	}
 
+	req.buffered = buf[:bufLen]
 	return req, nil
 }
 
@@ -200,12 +351,57 @@ func parseRequestLine(input []byte) (*RequestLine, int, error) {
 		Method:        string(requestLineParts[0]),
 	}
 
+	err := parseRequestTarget(&requestLine)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	return &requestLine, read, nil
 }
 
+func parseRequestTarget(rl *RequestLine) error {
+	target := rl.RequestTarget
+	switch {
+	case target == "":
+		return ERROR_INVALID_REQUEST_TARGET
+	case rl.Method == "CONNECT":
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || host == "" || port == "" {
+			return ERROR_INVALID_REQUEST_TARGET
+		}
+		rl.TargetForm = TargetAuthority
+		rl.Authority = target
+	case target == "*":
+		if rl.Method != "OPTIONS" {
+			return ERROR_INVALID_REQUEST_TARGET
+		}
+		rl.TargetForm = TargetAsterisk
+	case target[0] == '/':
+		rl.TargetForm = TargetOrigin
+		rl.Path = target
+	default:
+		u, err := url.Parse(target)
+		if err != nil || !u.IsAbs() || u.Host == "" || u.User != nil {
+			return ERROR_INVALID_REQUEST_TARGET
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return ERROR_INVALID_REQUEST_TARGET
+		}
+		rl.TargetForm = TargetAbsolute
+		rl.Scheme = u.Scheme
+		rl.Authority = u.Host
+		rl.Path = u.RequestURI()
+	}
+
+	return nil
+}
+
 func allUppercase(bytes []byte) bool {
+	if len(bytes) == 0 {
+		return false
+	}
 	for _, c := range bytes {
-		if c <= 'A' || c >= 'Z' {
+		if c < 'A' || c > 'Z' {
 			return false
 		}
 	}
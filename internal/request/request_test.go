@@ -1,7 +1,10 @@
 package request
 
 import (
+	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -155,3 +158,123 @@ func TestParsingBody(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
 }
+
+func TestRequestTargetForms(t *testing.T) {
+	// Test: Origin form
+	rl, _, err := parseRequestLine([]byte("GET /a?b=c HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, TargetOrigin, rl.TargetForm)
+	assert.Equal(t, "/a?b=c", rl.Path)
+
+	// Test: Absolute form
+	rl, _, err = parseRequestLine([]byte("GET http://example.com:8080/a?b=c HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, TargetAbsolute, rl.TargetForm)
+	assert.Equal(t, "http", rl.Scheme)
+	assert.Equal(t, "example.com:8080", rl.Authority)
+	assert.Equal(t, "/a?b=c", rl.Path)
+	assert.True(t, rl.IsProxyRequest())
+
+	// Test: Absolute form without a path
+	rl, _, err = parseRequestLine([]byte("HEAD http://example.com HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "/", rl.Path)
+
+	// Test: Authority form
+	rl, _, err = parseRequestLine([]byte("CONNECT example.com:443 HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, TargetAuthority, rl.TargetForm)
+	assert.Equal(t, "example.com:443", rl.Authority)
+
+	// Test: Asterisk form
+	rl, _, err = parseRequestLine([]byte("OPTIONS * HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, TargetAsterisk, rl.TargetForm)
+
+	// Test: Authority form is only valid for CONNECT
+	_, _, err = parseRequestLine([]byte("GET example.com:443 HTTP/1.1\r\n"))
+	require.ErrorIs(t, err, ERROR_INVALID_REQUEST_TARGET)
+
+	// Test: CONNECT requires a port
+	_, _, err = parseRequestLine([]byte("CONNECT example.com HTTP/1.1\r\n"))
+	require.ErrorIs(t, err, ERROR_INVALID_REQUEST_TARGET)
+
+	// Test: Asterisk form is only valid for OPTIONS
+	_, _, err = parseRequestLine([]byte("GET * HTTP/1.1\r\n"))
+	require.ErrorIs(t, err, ERROR_INVALID_REQUEST_TARGET)
+
+	// Test: Methods containing A and Z are valid
+	rl, _, err = parseRequestLine([]byte("PATCH /thing HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "PATCH", rl.Method)
+}
+
+func TestBufferedBytes(t *testing.T) {
+	// Test: Bytes past the end of the body are kept
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"helloextra",
+		numBytesPerRead: 64,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.Equal(t, "extra", string(r.Buffered()))
+
+	// Test: Bodies larger than the initial buffer
+	body := strings.Repeat("a", 5000)
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nContent-Length: 5000\r\n\r\n" + body,
+		numBytesPerRead: 700,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(r.Body))
+	assert.Empty(t, r.Buffered())
+}
+
+func TestHeaderLimits(t *testing.T) {
+	// Test: A request line that never ends is cut off
+	reader := &chunkReader{data: "GET /" + strings.Repeat("a", maxHeaderBytes), numBytesPerRead: 4096}
+	_, err := RequestFromReader(reader)
+	assert.ErrorIs(t, err, ERROR_REQUEST_LINE_TOO_LONG)
+
+	// Test: So are headers, whether one long line or many short ones
+	reader = &chunkReader{data: "GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", maxHeaderBytes), numBytesPerRead: 4096}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ERROR_HEADERS_TOO_LARGE)
+	many := &strings.Builder{}
+	many.WriteString("GET / HTTP/1.1\r\n")
+	for i := 0; many.Len() <= maxHeaderBytes; i++ {
+		fmt.Fprintf(many, "X-Short-%d: %s\r\n", i, strings.Repeat("a", 100))
+	}
+	reader = &chunkReader{data: many.String(), numBytesPerRead: 4096}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ERROR_HEADERS_TOO_LARGE)
+
+	// Test: Bodies don't count towards the limit
+	body := strings.Repeat("a", maxHeaderBytes+1)
+	reader = &chunkReader{data: "POST / HTTP/1.1\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body, numBytesPerRead: 4096}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Len(t, r.Body, len(body))
+}
+
+func TestCookies(t *testing.T) {
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nCookie: session=abc; theme=dark\r\nCookie: lang=en\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Len(t, r.Cookies(), 3)
+
+	c, err := r.Cookie("lang")
+	require.NoError(t, err)
+	assert.Equal(t, "en", c.Value)
+
+	_, err = r.Cookie("missing")
+	require.ErrorIs(t, err, ERROR_NO_COOKIE)
+}
@@ -1,21 +1,90 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strconv"
 
+	"dev.grab-a-byte.network/internal/cookie"
 	"dev.grab-a-byte.network/internal/headers"
 )
 
 type StatusCode int
 
 const (
+	STATUS_SWITCHING_PROTOCOLS   StatusCode = 101
 	STATUS_OK                    StatusCode = 200
+	STATUS_CREATED               StatusCode = 201
+	STATUS_NO_CONTENT            StatusCode = 204
+	STATUS_NOT_MODIFIED          StatusCode = 304
 	STATUS_BAD_REQUEST           StatusCode = 400
+	STATUS_NOT_FOUND             StatusCode = 404
+	STATUS_METHOD_NOT_ALLOWED    StatusCode = 405
+	STATUS_NOT_ACCEPTABLE        StatusCode = 406
+	STATUS_PAYLOAD_TOO_LARGE     StatusCode = 413
+	STATUS_URI_TOO_LONG          StatusCode = 414
+	STATUS_UNSUPPORTED_MEDIA     StatusCode = 415
+	STATUS_UPGRADE_REQUIRED      StatusCode = 426
+	STATUS_HEADERS_TOO_LARGE     StatusCode = 431
 	STATUS_INTERNAL_SERVER_ERROR StatusCode = 500
+	STATUS_BAD_GATEWAY           StatusCode = 502
+	STATUS_SERVICE_UNAVAILABLE   StatusCode = 503
+	STATUS_GATEWAY_TIMEOUT       StatusCode = 504
 )
 
+// reasonPhrases also covers codes the server never sends itself but may
+// pass on, such as proxied responses.
+var reasonPhrases = map[StatusCode]string{
+	STATUS_SWITCHING_PROTOCOLS:   "Switching Protocols",
+	STATUS_OK:                    "OK",
+	STATUS_CREATED:               "Created",
+	202:                          "Accepted",
+	STATUS_NO_CONTENT:            "No Content",
+	206:                          "Partial Content",
+	301:                          "Moved Permanently",
+	302:                          "Found",
+	303:                          "See Other",
+	STATUS_NOT_MODIFIED:          "Not Modified",
+	307:                          "Temporary Redirect",
+	308:                          "Permanent Redirect",
+	STATUS_BAD_REQUEST:           "Bad Request",
+	401:                          "Unauthorized",
+	403:                          "Forbidden",
+	STATUS_NOT_FOUND:             "Not Found",
+	STATUS_METHOD_NOT_ALLOWED:    "Method Not Allowed",
+	STATUS_NOT_ACCEPTABLE:        "Not Acceptable",
+	408:                          "Request Timeout",
+	409:                          "Conflict",
+	410:                          "Gone",
+	411:                          "Length Required",
+	STATUS_PAYLOAD_TOO_LARGE:     "Content Too Large",
+	STATUS_URI_TOO_LONG:          "URI Too Long",
+	STATUS_UNSUPPORTED_MEDIA:     "Unsupported Media Type",
+	422:                          "Unprocessable Content",
+	STATUS_UPGRADE_REQUIRED:      "Upgrade Required",
+	429:                          "Too Many Requests",
+	STATUS_HEADERS_TOO_LARGE:     "Request Header Fields Too Large",
+	STATUS_INTERNAL_SERVER_ERROR: "Internal Server Error",
+	501:                          "Not Implemented",
+	STATUS_BAD_GATEWAY:           "Bad Gateway",
+	STATUS_SERVICE_UNAVAILABLE:   "Service Unavailable",
+	STATUS_GATEWAY_TIMEOUT:       "Gateway Timeout",
+}
+
+// ReasonPhrase returns the standard reason phrase for a status code, or an
+// empty string when the code is not known.
+func ReasonPhrase(statusCode StatusCode) string {
+	return reasonPhrases[statusCode]
+}
+
+// WriteStatusLine writes an HTTP/1.1 status line for the given code to w.
+func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", statusCode, ReasonPhrase(statusCode))
+	return err
+}
+
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	h := headers.NewHeaders()
 	h.Set("content-length", strconv.Itoa(contentLen))
@@ -32,33 +101,175 @@ const (
 	done
 )
 
+var ERROR_HIJACK_UNSUPPORTED = errors.New("underlying writer does not support hijacking")
+
+// Hijacker is implemented by connections that allow a handler to take over
+// the raw connection, e.g. for CONNECT tunnels or protocol upgrades.
+type Hijacker interface {
+	Hijack() (net.Conn, []byte, error)
+}
+
+// Framer carries a response over a protocol with its own message framing,
+// such as HTTP/2, in place of the HTTP/1.1 wire format. Body bytes arrive
+// through Write without chunk framing.
+type Framer interface {
+	io.Writer
+	// WriteHeaders sends the status and header fields. Set-Cookie values
+	// are passed separately as they can't share a single field.
+	WriteHeaders(statusCode StatusCode, h headers.Headers, cookies []string) error
+	// WriteTrailers sends trailer fields, which ends the response.
+	WriteTrailers(h headers.Headers) error
+	// End ends the response. Calling it again has no effect.
+	End() error
+}
+
 type Writer struct {
 	writer io.Writer
-	status int
+	// framer is set for responses that aren't sent as HTTP/1.1
+	framer Framer
+	// counter sits between writer and the connection, headerBytes is its
+	// count once the header section was sent
+	counter     *countingWriter
+	headerBytes int64
+	status      int
+	statusCode  StatusCode
+	// headerHooks run, in order, just before the header fields are sent
+	headerHooks []func(StatusCode, headers.Headers)
+	// encoder, when set, transforms body bytes which are then sent as
+	// chunks regardless of whether WriteBody or WriteChunkedBody was used
+	encoder io.WriteCloser
+	// cookies are sent as separate Set-Cookie field lines, which the
+	// map based headers.Headers can't hold
+	cookies []*cookie.Cookie
+}
+
+// SetCookie queues a Set-Cookie field line to be sent with the headers. It
+// must be called before WriteHeaders, or from an OnWriteHeaders hook.
+func (w *Writer) SetCookie(c *cookie.Cookie) error {
+	if w.status >= headersWritten {
+		return fmt.Errorf("Headers already written")
+	}
+	err := c.Valid()
+	if err != nil {
+		return err
+	}
+	w.cookies = append(w.cookies, c)
+	return nil
+}
+
+// OnWriteHeaders registers fn to be called with the status code and header
+// fields just before they are written. Middleware uses this to add, remove
+// or rewrite fields, e.g. to switch a response to a compressed encoding.
+func (w *Writer) OnWriteHeaders(fn func(statusCode StatusCode, h headers.Headers)) {
+	w.headerHooks = append(w.headerHooks, fn)
+}
+
+// StatusCode returns the status code written so far, or 0 before the
+// status line has been written.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// EncodeBody routes every body byte through the encoder returned by
+// newEncoder. The encoded output is always framed as chunks, so this must be
+// called from an OnWriteHeaders hook that also switches the response to
+// chunked transfer coding.
+func (w *Writer) EncodeBody(newEncoder func(io.Writer) io.WriteCloser) {
+	if w.framer != nil {
+		w.encoder = newEncoder(w.writer)
+		return
+	}
+	w.encoder = newEncoder(&chunkWriter{w: w.writer})
+}
+
+// chunkWriter frames every non-empty write as a single chunk.
+type chunkWriter struct {
+	w io.Writer
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	_, err := fmt.Fprintf(cw.w, "%x\r\n", len(p))
+	if err != nil {
+		return 0, err
+	}
+	n, err := cw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, err = cw.w.Write([]byte("\r\n"))
+	return n, err
+}
+
+// Hijack hands the underlying connection to the caller along with any bytes
+// the request parser had already read past the end of the request. Those
+// bytes must be consumed before reading from the connection. The server will
+// no longer write to, close or reuse the connection once it has been
+// hijacked and further writes through w fail.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	h, ok := w.counter.Writer.(Hijacker)
+	if !ok {
+		return nil, nil, ERROR_HIJACK_UNSUPPORTED
+	}
+	conn, buffered, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.status = done
+	return conn, buffered, nil
 }
 
 func NewWriter(w io.Writer) *Writer {
+	counter := &countingWriter{Writer: w}
 	return &Writer{
-		writer: w,
-		status: start}
+		writer:  counter,
+		counter: counter,
+		status:  start}
+}
+
+// NewFramedWriter returns a Writer that hands the response to f. Handlers
+// use it exactly like one from NewWriter, except that it can't be hijacked.
+func NewFramedWriter(f Framer) *Writer {
+	w := NewWriter(f)
+	w.framer = f
+	return w
+}
+
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.Writer.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// BytesWritten returns the number of bytes sent after the header section,
+// i.e. the body as it went over the wire including any chunk framing and
+// trailers.
+func (w *Writer) BytesWritten() int64 {
+	if w.status < headersWritten {
+		return 0
+	}
+	return w.counter.n - w.headerBytes
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 	if w.status > start {
 		return fmt.Errorf("Status line already written")
 	}
-	w.writer.Write([]byte("HTTP/1.1 "))
-	fmt.Fprintf(w.writer, "%d ", statusCode)
-	switch statusCode {
-	case STATUS_OK:
-		w.writer.Write([]byte("OK"))
-	case STATUS_BAD_REQUEST:
-		w.writer.Write([]byte("Bad Request"))
-	case STATUS_INTERNAL_SERVER_ERROR:
-		w.writer.Write([]byte("Internal Server Error"))
+	if w.framer == nil {
+		err := WriteStatusLine(w.writer, statusCode)
+		if err != nil {
+			return err
+		}
 	}
 
-	w.writer.Write([]byte("\r\n"))
+	w.statusCode = statusCode
 	w.status = statusLineWritten
 	return nil
 }
@@ -70,6 +281,47 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 	// if w.status > statusLineWritten {
 	// 	return fmt.Errorf("Headers already written")
 	// }
+	if len(w.headerHooks) > 0 {
+		h := make(map[string]string, len(headers))
+		for k, v := range headers {
+			h[k] = v
+		}
+		headers = h
+		for _, hook := range w.headerHooks {
+			hook(w.statusCode, headers)
+		}
+	}
+
+	if w.framer != nil {
+		cookies := make([]string, len(w.cookies))
+		for i, c := range w.cookies {
+			cookies[i] = c.String()
+		}
+		err := w.framer.WriteHeaders(w.statusCode, headers, cookies)
+		if err != nil {
+			return err
+		}
+		w.status = headersWritten
+		return nil
+	}
+
+	for _, c := range w.cookies {
+		_, err := fmt.Fprintf(w.writer, "Set-Cookie: %s\r\n", c)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := w.writeFields(headers)
+	if err != nil {
+		return err
+	}
+	w.headerBytes = w.counter.n
+	w.status = headersWritten
+	return nil
+}
+
+func (w *Writer) writeFields(headers headers.Headers) error {
 	for k, v := range headers {
 		line := fmt.Sprintf("%s: %s\r\n", k, v)
 		n, err := w.writer.Write([]byte(line))
@@ -78,13 +330,11 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 		}
 
 		if n == 0 {
-			errMsg := fmt.Sprintf("Unable to write header %s", line)
-			return fmt.Errorf(errMsg)
+			return fmt.Errorf("Unable to write header %s", line)
 		}
 	}
-	w.writer.Write([]byte("\r\n"))
-	w.status = headersWritten
-	return nil
+	_, err := w.writer.Write([]byte("\r\n"))
+	return err
 }
 
 func (w *Writer) WriteBody(p []byte) (int, error) {
@@ -94,16 +344,55 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 	if w.status == done {
 		return 0, fmt.Errorf("Already written body")
 	}
+	if w.encoder != nil {
+		return w.writeEncodedBody(p)
+	}
 	n, err := w.writer.Write(p)
 	if err != nil {
 		return 0, err
 	}
+	if w.framer != nil {
+		err = w.framer.End()
+		if err != nil {
+			return 0, err
+		}
+	}
 
 	w.status = done
 	return n, err
 }
 
+// writeEncodedBody sends p through the encoder and terminates the chunked
+// body, as the handler expects WriteBody to be the whole body.
+func (w *Writer) writeEncodedBody(p []byte) (int, error) {
+	n, err := w.encoder.Write(p)
+	if err != nil {
+		return 0, err
+	}
+	err = w.encoder.Close()
+	if err != nil {
+		return 0, err
+	}
+	if w.framer != nil {
+		err = w.framer.End()
+	} else {
+		_, err = w.writer.Write([]byte("0\r\n\r\n"))
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	w.status = done
+	return n, nil
+}
+
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+	if w.framer != nil {
+		return w.writer.Write(p)
+	}
 	count := fmt.Sprintf("%x\r\n", len(p))
 	n, err := w.writer.Write([]byte(count))
 	if err != nil {
@@ -121,15 +410,37 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	return n + c + r, nil
 }
 
-func (w *Writer) AddCrLf(){
+func (w *Writer) AddCrLf() {
+	// After WriteChunkedBodyDone this ends a body without trailers
+	if w.framer != nil {
+		w.framer.End()
+		return
+	}
 	w.writer.Write([]byte("\r\n"))
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if w.encoder != nil {
+		err := w.encoder.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	// The framer ends the body with WriteTrailers or AddCrLf instead
+	if w.framer != nil {
+		return 0, nil
+	}
 	n, err := w.writer.Write([]byte("0\r\n"))
 	return n, err
 }
 
 func (w *Writer) WriteTrailers(h headers.Headers) error {
-	return w.WriteHeaders(h)
+	if w.status < headersWritten {
+		return fmt.Errorf("Need to write headers before trailers")
+	}
+	if w.framer != nil {
+		w.status = done
+		return w.framer.WriteTrailers(h)
+	}
+	return w.writeFields(h)
 }
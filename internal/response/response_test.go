@@ -4,6 +4,8 @@ import (
 	"strings"
 	"testing"
 
+	"dev.grab-a-byte.network/internal/cookie"
+	"dev.grab-a-byte.network/internal/headers"
 	"dev.grab-a-byte.network/internal/response"
 )
 
@@ -14,3 +16,104 @@ func TestResponseWriteHeaderLine(t *testing.T) {
 		t.Error(builder.String())
 	}
 }
+
+func TestResponseSetCookie(t *testing.T) {
+	builder := strings.Builder{}
+	w := response.NewWriter(&builder)
+	w.WriteStatusLine(response.STATUS_OK)
+	if err := w.SetCookie(&cookie.Cookie{Name: "a", Value: "1", HttpOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetCookie(&cookie.Cookie{Name: "b", Value: "2", Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetCookie(&cookie.Cookie{Name: "bad name"}); err == nil {
+		t.Error("expected invalid cookie to be rejected")
+	}
+	w.WriteHeaders(headers.NewHeaders())
+
+	expected := "HTTP/1.1 200 OK\r\nSet-Cookie: a=1; HttpOnly\r\nSet-Cookie: b=2; Path=/\r\n\r\n"
+	if builder.String() != expected {
+		t.Error(builder.String())
+	}
+
+	if err := w.SetCookie(&cookie.Cookie{Name: "late", Value: "1"}); err == nil {
+		t.Error("expected cookie after headers to be rejected")
+	}
+}
+
+func TestResponseBytesWritten(t *testing.T) {
+	builder := strings.Builder{}
+	w := response.NewWriter(&builder)
+	w.WriteStatusLine(response.STATUS_OK)
+	if n := w.BytesWritten(); n != 0 {
+		t.Errorf("expected 0 bytes before headers, got %d", n)
+	}
+	w.WriteHeaders(response.GetDefaultHeaders(5))
+	w.WriteBody([]byte("hello"))
+	if n := w.BytesWritten(); n != 5 {
+		t.Errorf("expected 5 body bytes, got %d", n)
+	}
+}
+
+// recordingFramer keeps what a framed Writer hands over.
+type recordingFramer struct {
+	strings.Builder
+	status   response.StatusCode
+	cookies  []string
+	trailers headers.Headers
+	ends     int
+}
+
+func (rf *recordingFramer) WriteHeaders(statusCode response.StatusCode, h headers.Headers, cookies []string) error {
+	rf.status = statusCode
+	rf.cookies = cookies
+	return nil
+}
+
+func (rf *recordingFramer) WriteTrailers(h headers.Headers) error {
+	rf.trailers = h
+	return nil
+}
+
+func (rf *recordingFramer) End() error {
+	rf.ends++
+	return nil
+}
+
+func TestResponseFramedWriter(t *testing.T) {
+	framer := &recordingFramer{}
+	w := response.NewFramedWriter(framer)
+	w.WriteStatusLine(response.STATUS_CREATED)
+	w.SetCookie(&cookie.Cookie{Name: "a", Value: "1"})
+	w.WriteHeaders(headers.NewHeaders())
+	w.WriteChunkedBody([]byte("hello "))
+	w.WriteChunkedBody([]byte("world"))
+	w.WriteChunkedBodyDone()
+	w.AddCrLf()
+
+	if framer.status != response.STATUS_CREATED || len(framer.cookies) != 1 || framer.cookies[0] != "a=1" {
+		t.Errorf("unexpected headers %d %v", framer.status, framer.cookies)
+	}
+	if framer.String() != "hello world" || framer.ends != 1 {
+		t.Errorf("expected unframed body and one end, got %q and %d", framer.String(), framer.ends)
+	}
+	if n := w.BytesWritten(); n != 11 {
+		t.Errorf("expected 11 body bytes, got %d", n)
+	}
+	if _, _, err := w.Hijack(); err != response.ERROR_HIJACK_UNSUPPORTED {
+		t.Errorf("expected hijacking to be unsupported, got %v", err)
+	}
+
+	framer = &recordingFramer{}
+	w = response.NewFramedWriter(framer)
+	w.WriteStatusLine(response.STATUS_OK)
+	w.WriteHeaders(headers.NewHeaders())
+	w.WriteChunkedBodyDone()
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	w.WriteTrailers(trailers)
+	if framer.trailers["x-checksum"] != "abc" {
+		t.Errorf("expected trailers to reach the framer, got %v", framer.trailers)
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ERROR_NOT_INHERITABLE = errors.New("listener has no file descriptor to pass on")
+var ERROR_CHILD_NOT_READY = errors.New("restarted process did not take over the listeners")
+
+// listenFdsStart is the first passed file descriptor, after stdin, stdout
+// and stderr.
+const listenFdsStart = 3
+
+// reexecReadyTimeout is how long Reexec waits for the child to pick up
+// its listeners.
+const reexecReadyTimeout = 10 * time.Second
+
+// listenEnv are the variables describing passed listeners.
+var listenEnv = []string{"LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES", "LISTEN_PARENT_PID"}
+
+// readyPipe is where NotifyReady tells the parent that started us with
+// Reexec we have taken over, nil when it didn't.
+var readyPipe *os.File
+
+// InheritedListeners returns the listeners passed in by systemd socket
+// activation, in the order of the socket unit's Listen lines, or nil when
+// there are none. Listeners handed over by Reexec are picked up the same
+// way, call NotifyReady once serving on them. The environment variables are
+// cleared so they aren't passed on to child processes.
+func InheritedListeners() ([]net.Listener, error) {
+	fds := os.Getenv("LISTEN_FDS")
+	pid := os.Getenv("LISTEN_PID")
+	parentPid := os.Getenv("LISTEN_PARENT_PID")
+	for _, name := range listenEnv {
+		os.Unsetenv(name)
+	}
+
+	// The variables are only meant for the process they were set up for.
+	// Reexec can't know the pid of the child so names itself instead, it
+	// is still waiting on us so can't have been replaced as our parent.
+	fromParent := pid == "" && parentPid == strconv.Itoa(os.Getppid())
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) && !fromParent {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		file := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+		// FileListener works on a duplicate, marked close on exec
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inherited fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	if fromParent {
+		// Reexec passes a pipe after the listeners for NotifyReady
+		readyPipe = os.NewFile(uintptr(listenFdsStart+n), "reexec-ready")
+	}
+	return listeners, nil
+}
+
+// NotifyReady tells the process that handed us our listeners with Reexec
+// that we're serving on them, after which it stops. Call it once the
+// server is up, anything failing before then leaves the old process
+// serving. It does nothing when the listeners didn't come from Reexec.
+func NotifyReady() {
+	if readyPipe == nil {
+		return
+	}
+	// One byte is the signal, closing without it is a failure
+	readyPipe.Write([]byte{1})
+	readyPipe.Close()
+	readyPipe = nil
+}
+
+// Reexec starts a new copy of the running executable with the same
+// arguments, handing it listeners for InheritedListeners to pick up. It
+// returns once the child calls NotifyReady, after which the caller should
+// Shutdown. Connections arriving in between wait in the shared
+// socket's backlog rather than being refused. If the child exits or
+// hangs first it is killed and the caller keeps serving.
+func Reexec(listeners ...net.Listener) (*os.Process, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return reexec(path, os.Args[1:], listeners)
+}
+
+func reexec(path string, args []string, listeners []net.Listener) (*os.Process, error) {
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		withFile, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("%w: %T", ERROR_NOT_INHERITABLE, l)
+		}
+		f, err := withFile.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+	files = append(files, readyWriter)
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if !slices.Contains(listenEnv, name) {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		"LISTEN_FDS="+strconv.Itoa(len(listeners)),
+		"LISTEN_PARENT_PID="+strconv.Itoa(os.Getpid()),
+	)
+	err = cmd.Start()
+	// Starting the child switched the shared sockets to blocking mode, which
+	// would leave our Accept stuck where Close can't interrupt it
+	for _, l := range listeners {
+		restoreNonblock(l)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Our copy of the write end has to go for a dead child to show as EOF
+	readyWriter.Close()
+	ready.SetReadDeadline(time.Now().Add(reexecReadyTimeout))
+	_, err = io.ReadFull(ready, make([]byte, 1))
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("%w: %v", ERROR_CHILD_NOT_READY, err)
+	}
+
+	// The socket file belongs to the child now
+	for _, l := range listeners {
+		if unix, ok := l.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process, nil
+}
+
+func restoreNonblock(l net.Listener) {
+	conn, ok := l.(syscall.Conn)
+	if !ok {
+		return
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	raw.Control(func(fd uintptr) {
+		setNonblock(fd)
+	})
+}
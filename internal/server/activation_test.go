@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInheritedListeners(t *testing.T) {
+	// Test: Nothing is inherited without the variables
+	t.Setenv("LISTEN_FDS", "")
+	listeners, err := InheritedListeners()
+	require.NoError(t, err)
+	assert.Nil(t, listeners)
+
+	// Test: Variables meant for another process are ignored and cleared
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	listeners, err = InheritedListeners()
+	require.NoError(t, err)
+	assert.Nil(t, listeners)
+	_, set := os.LookupEnv("LISTEN_FDS")
+	assert.False(t, set)
+
+	t.Setenv("LISTEN_FDS", "two")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	_, err = InheritedListeners()
+	assert.Error(t, err)
+
+	// Test: Only listeners backed by a file can be passed on
+	_, err = Reexec(newPipeListener())
+	assert.ErrorIs(t, err, ERROR_NOT_INHERITABLE)
+}
+
+func whoAmI(name string) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(name)))
+		w.WriteBody([]byte(name))
+	}
+}
+
+func TestReexec(t *testing.T) {
+	listener, err := ListenTCP("127.0.0.1", 0)
+	require.NoError(t, err)
+	srv := ServeListener(listener, whoAmI("parent"))
+	url := "http://" + listener.Addr().String() + "/"
+
+	get := func() string {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+		resp, err := client.Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	assert.Equal(t, "parent", get())
+
+	// Test: A child exiting without taking over leaves the parent serving
+	_, err = reexec(os.Args[0], []string{"-test.run=^$"}, []net.Listener{listener})
+	assert.ErrorIs(t, err, ERROR_CHILD_NOT_READY)
+	assert.Equal(t, "parent", get())
+
+	// Test: A child failing after inheriting the listener leaves the parent serving
+	t.Setenv("SERVER_TEST_REEXEC_CHILD", "fail")
+	_, err = reexec(os.Args[0], []string{"-test.run=^TestReexecChild$"}, []net.Listener{listener})
+	assert.ErrorIs(t, err, ERROR_CHILD_NOT_READY)
+	assert.Equal(t, "parent", get())
+
+	// Test: The child takes over the listening socket while the parent drains
+	t.Setenv("SERVER_TEST_REEXEC_CHILD", "serve")
+	process, err := reexec(os.Args[0], []string{"-test.run=^TestReexecChild$"}, []net.Listener{listener})
+	require.NoError(t, err)
+	require.NoError(t, srv.Shutdown(context.Background()))
+	assert.Equal(t, "child", get())
+
+	state, err := process.Wait()
+	require.NoError(t, err)
+	assert.True(t, state.Success())
+}
+
+// TestReexecChild is the process started by TestReexec, it serves one
+// request on the inherited listener or fails before it's ready.
+func TestReexecChild(t *testing.T) {
+	mode := os.Getenv("SERVER_TEST_REEXEC_CHILD")
+	if mode == "" {
+		t.Skip("only run by TestReexec")
+	}
+	listeners, err := InheritedListeners()
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	if mode == "fail" {
+		// Like a bad config found after taking the listeners
+		os.Exit(1)
+	}
+
+	served := make(chan struct{}, 1)
+	srv := ServeListener(listeners[0], Chain(whoAmI("child"), func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			next(w, req)
+			served <- struct{}{}
+		}
+	}))
+	NotifyReady()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request reached the child")
+	}
+	require.NoError(t, srv.Shutdown(context.Background()))
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/http2"
+	"dev.grab-a-byte.network/internal/proxyproto"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+)
+
+var ERROR_CONN_HIJACKED = errors.New("connection has been hijacked")
+var ERROR_CLIENT_GONE = errors.New("client closed the connection")
+var ERROR_SERVER_CLOSED = errors.New("server closed")
+var ERROR_EARLY_OVERFLOW = errors.New("client sent too much before the connection was hijacked")
+
+// maxEarlyBytes bounds how much the background reader holds on to when a
+// client sends data before the response is complete. Reading carries on
+// past it so a hang up is still noticed, the rest is dropped.
+const maxEarlyBytes = 64 * 1024
+
+// backgroundReader watches a connection while the handler runs so the
+// request context can be cancelled as soon as the client hangs up. Any bytes
+// that arrive in the meantime are kept so a hijacker still sees them.
+type backgroundReader struct {
+	conn     net.Conn
+	cancel   context.CancelCauseFunc
+	stopping atomic.Bool
+	done     chan struct{}
+
+	mu    sync.Mutex
+	early []byte
+	// overflowed is set once bytes past maxEarlyBytes were dropped
+	overflowed bool
+}
+
+func startBackgroundReader(conn net.Conn, cancel context.CancelCauseFunc) *backgroundReader {
+	br := &backgroundReader{
+		conn:   conn,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go br.run()
+	return br
+}
+
+func (br *backgroundReader) run() {
+	defer close(br.done)
+	buf := make([]byte, 512)
+	for {
+		n, err := br.conn.Read(buf)
+		if n > 0 {
+			br.mu.Lock()
+			keep := min(n, maxEarlyBytes-len(br.early))
+			br.early = append(br.early, buf[:keep]...)
+			br.overflowed = br.overflowed || keep < n
+			br.mu.Unlock()
+		}
+		if err != nil {
+			if !br.stopping.Load() {
+				br.cancel(ERROR_CLIENT_GONE)
+			}
+			return
+		}
+	}
+}
+
+// stop ends the background read and returns any bytes it collected,
+// ERROR_EARLY_OVERFLOW if some had to be dropped. The connection's read
+// deadline is cleared again afterwards.
+func (br *backgroundReader) stop() ([]byte, error) {
+	if br.stopping.Swap(true) {
+		<-br.done
+		return nil, nil
+	}
+	br.conn.SetReadDeadline(time.Unix(1, 0))
+	<-br.done
+	br.conn.SetReadDeadline(time.Time{})
+
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.overflowed {
+		return nil, ERROR_EARLY_OVERFLOW
+	}
+	return br.early, nil
+}
+
+// hijackableConn lets a handler take ownership of the connection through
+// response.Writer.Hijack. Once hijacked, writes made through the response
+// writer are rejected so they cannot interleave with the new owner's.
+type hijackableConn struct {
+	net.Conn
+	buffered []byte
+	reader   *backgroundReader
+	hijacked atomic.Bool
+}
+
+func (hc *hijackableConn) Hijack() (net.Conn, []byte, error) {
+	if !hc.hijacked.CompareAndSwap(false, true) {
+		return nil, nil, ERROR_CONN_HIJACKED
+	}
+	buffered := hc.buffered
+	if hc.reader != nil {
+		// The new owner can't pick up a stream with a gap in it
+		early, err := hc.reader.stop()
+		if err != nil {
+			hc.hijacked.Store(false)
+			return nil, nil, err
+		}
+		buffered = append(buffered, early...)
+	}
+	return hc.Conn, buffered, nil
+}
+
+func (hc *hijackableConn) Write(p []byte) (int, error) {
+	if hc.hijacked.Load() {
+		return 0, ERROR_CONN_HIJACKED
+	}
+	return hc.Conn.Write(p)
+}
+
+// requestID reuses a sane X-Request-ID from the client, otherwise a random
+// one is generated.
+func requestID(req *request.Request) string {
+	if id, ok := req.Headers.Get("X-Request-ID"); ok && validRequestID(id) {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// countingConn adds the bytes read and written on a connection to the
+// server totals.
+type countingConn struct {
+	net.Conn
+	read    *atomic.Uint64
+	written *atomic.Uint64
+}
+
+func (cc *countingConn) Read(p []byte) (int, error) {
+	n, err := cc.Conn.Read(p)
+	cc.read.Add(uint64(n))
+	return n, err
+}
+
+func (cc *countingConn) Write(p []byte) (int, error) {
+	n, err := cc.Conn.Write(p)
+	cc.written.Add(uint64(n))
+	return n, err
+}
+
+// parseErrors names the request parser errors counted in Stats.
+var parseErrors = []struct {
+	name string
+	err  error
+}{
+	{"ERROR_INVALID_REQUEST_LINE", request.ERROR_INVALID_REQUEST_LINE},
+	{"ERROR_INVLID_HTTP_VERSION", request.ERROR_INVLID_HTTP_VERSION},
+	{"ERROR_INVALID_HTTP_METHOD", request.ERROR_INVALID_HTTP_METHOD},
+	{"ERROR_INVALID_REQUEST_TARGET", request.ERROR_INVALID_REQUEST_TARGET},
+	{"ERROR_INCOMPLETE_REQUEST", request.ERROR_INCOMPLETE_REQUEST},
+	{"ERROR_INVALID_CONTENT_LENGTH", request.ERROR_INVALID_CONTENT_LENGTH},
+	{"ERROR_REQUEST_LINE_TOO_LONG", request.ERROR_REQUEST_LINE_TOO_LONG},
+	{"ERROR_HEADERS_TOO_LARGE", request.ERROR_HEADERS_TOO_LARGE},
+	{"ERROR_INVALID_FIELD_VALUE", headers.ERROR_INVALID_FIELD_VALUE},
+	{"ERROR_INVALID_FIELD_NAME", headers.ERROR_INVALID_FIELD_NAME},
+	{"ERROR_INVALID_PROXY_HEADER", proxyproto.ERROR_INVALID_PROXY_HEADER},
+	{"ERROR_UNTRUSTED_PROXY", proxyproto.ERROR_UNTRUSTED_PROXY},
+}
+
+// rejectRequest answers a request the parser gave up on. Oversized heads
+// get their own status, anything else isn't worth a proper response.
+func rejectRequest(conn net.Conn, err error) {
+	var status response.StatusCode
+	switch {
+	case errors.Is(err, request.ERROR_REQUEST_LINE_TOO_LONG):
+		status = response.STATUS_URI_TOO_LONG
+	case errors.Is(err, request.ERROR_HEADERS_TOO_LARGE):
+		status = response.STATUS_HEADERS_TOO_LARGE
+	default:
+		conn.Write([]byte("Failed to read request"))
+		return
+	}
+	w := response.NewWriter(conn)
+	w.WriteStatusLine(status)
+	w.WriteHeaders(response.GetDefaultHeaders(0))
+}
+
+func parseErrorName(err error) string {
+	for _, pe := range parseErrors {
+		if errors.Is(err, pe.err) {
+			return pe.name
+		}
+	}
+	return "other"
+}
+
+// peekPreface reads just enough of conn to tell whether it starts with the
+// HTTP/2 connection preface. Reads are a byte at a time so nothing past the
+// first mismatch is consumed, the bytes read are returned for replaying.
+func peekPreface(conn net.Conn) ([]byte, bool) {
+	peeked := make([]byte, 0, len(http2.Preface))
+	b := make([]byte, 1)
+	for len(peeked) < len(http2.Preface) {
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return peeked, false
+		}
+		peeked = append(peeked, b[0])
+		if b[0] != http2.Preface[len(peeked)-1] {
+			return peeked, false
+		}
+	}
+	return peeked, true
+}
+
+// replayConn reads from reader, which starts with bytes already taken off
+// the connection, so the next owner sees the whole stream.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (rc *replayConn) Read(p []byte) (int, error) {
+	return rc.reader.Read(p)
+}
+
+// CloseWrite keeps half-closing available to hijackers when the underlying
+// connection supports it, otherwise it fails with errors.ErrUnsupported and
+// leaves closing to the caller.
+func (cc *countingConn) CloseWrite() error {
+	if cw, ok := cc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+var ERROR_SOCKET_IN_USE = errors.New("unix socket is in use by another process")
+var ERROR_NOT_A_SOCKET = errors.New("path exists and is not a unix socket")
+
+// ListenTCP listens on host and port, where host is a name, an IPv4 or an
+// IPv6 address without brackets. An empty host means all interfaces.
+func ListenTCP(host string, port int) (net.Listener, error) {
+	return net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// ListenTCP6 is ListenTCP restricted to IPv6, so an empty host doesn't also
+// accept IPv4 connections.
+func ListenTCP6(host string, port int) (net.Listener, error) {
+	return net.Listen("tcp6", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// ListenUnix listens on a unix domain socket at path and sets its file mode,
+// which is what controls who may connect. A socket file left behind by a
+// process that died is removed first, one with a live listener is an
+// error. The file is removed again when the listener is closed.
+func ListenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	err := removeStaleSocket(path)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%w: %s", ERROR_NOT_A_SOCKET, path)
+	}
+
+	// Nobody answering is the only sign the socket is stale
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%w: %s", ERROR_SOCKET_IN_USE, path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dev.grab-a-byte.network/internal/proxyproto"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pipeListener is an in-memory listener handing out net.Pipe connections.
+type pipeListener struct {
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (l *pipeListener) Dial() net.Conn {
+	client, server := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func okHandler(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.STATUS_OK)
+	w.WriteHeaders(response.GetDefaultHeaders(0))
+}
+
+// statusLine sends a request over conn and returns the response status line.
+func statusLine(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	return line
+}
+
+func TestServeListener(t *testing.T) {
+	listener := newPipeListener()
+	srv := ServeListener(listener, okHandler)
+	defer srv.Close()
+
+	// Test: Any listener can be served, including in-memory ones
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine(t, listener.Dial()))
+	assert.Equal(t, "pipe", srv.Addr().String())
+
+	// Test: Specific hosts, and IPv6 without brackets
+	tcp, err := ListenTCP("127.0.0.1", 0)
+	require.NoError(t, err)
+	srv = ServeListener(tcp, okHandler)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine(t, conn))
+
+	tcp6, err := ListenTCP6("::1", 0)
+	if err != nil {
+		t.Skip("IPv6 loopback not available")
+	}
+	srv = ServeListener(tcp6, okHandler)
+	defer srv.Close()
+	conn, err = net.Dial("tcp6", srv.Addr().String())
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine(t, conn))
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.sock")
+
+	// Test: Requests are served over the socket with the given mode
+	listener, err := ListenUnix(path, 0o660)
+	require.NoError(t, err)
+	srv := ServeListener(listener, okHandler)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o660), info.Mode().Perm())
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine(t, conn))
+
+	// Test: A socket with a live listener isn't taken over
+	_, err = ListenUnix(path, 0o660)
+	assert.ErrorIs(t, err, ERROR_SOCKET_IN_USE)
+
+	// Test: The socket file is removed on close
+	require.NoError(t, srv.Close())
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Test: Stale sockets from a dead process are replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err = ListenUnix(path, 0o600)
+	require.NoError(t, err)
+	listener.Close()
+
+	// Test: Other files are never removed
+	other := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(other, nil, 0o600))
+	_, err = ListenUnix(other, 0o600)
+	assert.ErrorIs(t, err, ERROR_NOT_A_SOCKET)
+	_, err = os.Stat(other)
+	assert.NoError(t, err)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	serve := func(trusted []netip.Prefix) *Server {
+		listener, err := ListenTCP("127.0.0.1", 0)
+		require.NoError(t, err)
+		srv := ServeListener(proxyproto.NewListener(listener, trusted), func(w *response.Writer, req *request.Request) {
+			w.WriteStatusLine(response.STATUS_OK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(req.RemoteAddr)))
+			w.WriteBody([]byte(req.RemoteAddr))
+		})
+		t.Cleanup(func() { srv.Close() })
+		return srv
+	}
+	send := func(srv *Server, raw string) string {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte(raw))
+		require.NoError(t, err)
+		reply, _ := io.ReadAll(conn)
+		return string(reply)
+	}
+	header := "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n"
+	get := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+	// Test: The client address from a trusted balancer reaches the request
+	srv := serve([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	reply := send(srv, header+get)
+	assert.Contains(t, reply, "HTTP/1.1 200 OK")
+	assert.True(t, strings.HasSuffix(reply, "\r\n\r\n203.0.113.7:56324"), reply)
+
+	// Test: Malformed headers are rejected
+	reply = send(srv, "PROXY TCP4 nonsense\r\n"+get)
+	assert.NotContains(t, reply, "200 OK")
+	assert.Equal(t, uint64(1), srv.Stats().ParseErrors["ERROR_INVALID_PROXY_HEADER"])
+
+	// Test: Headers from peers outside the allowlist are rejected
+	srv = serve(nil)
+	reply = send(srv, header+get)
+	assert.NotContains(t, reply, "200 OK")
+	assert.Equal(t, uint64(1), srv.Stats().ParseErrors["ERROR_UNTRUSTED_PROXY"])
+	assert.Contains(t, send(srv, get), "\r\n\r\n127.0.0.1:")
+}
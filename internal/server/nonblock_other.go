@@ -0,0 +1,9 @@
+//go:build !unix
+
+package server
+
+// setNonblock has nothing to undo where listeners can't be passed to a
+// child process.
+func setNonblock(fd uintptr) error {
+	return nil
+}
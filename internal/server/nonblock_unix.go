@@ -0,0 +1,9 @@
+//go:build unix
+
+package server
+
+import "syscall"
+
+func setNonblock(fd uintptr) error {
+	return syscall.SetNonblock(int(fd), true)
+}
@@ -1,10 +1,20 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"dev.grab-a-byte.network/internal/http2"
 	"dev.grab-a-byte.network/internal/request"
 	"dev.grab-a-byte.network/internal/response"
 )
@@ -13,30 +23,117 @@ type Server struct {
 	listener net.Listener
 	closed   atomic.Bool
 	handler  Handler
+
+	// requestTimeout is the deadline for the context of each request, zero
+	// means no deadline.
+	requestTimeout time.Duration
+	// maxBufferedBody is the largest request body read before the handler
+	// runs, larger ones are streamed. Negative buffers every body.
+	maxBufferedBody int64
+	// h2c serves cleartext HTTP/2 alongside HTTP/1.1
+	h2c bool
+
+	baseCtx    context.Context
+	cancelBase context.CancelCauseFunc
+	// drain is closed by Shutdown to wind down HTTP/2 connections
+	drain chan struct{}
+
+	activeConns atomic.Int64
+	totalConns  atomic.Uint64
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	panics      atomic.Uint64
+
+	parseErrorsMu sync.Mutex
+	parseErrors   map[string]uint64
+
+	statsMu      sync.Mutex
+	statsSources map[string]func() any
+}
+
+// Stats is a point in time snapshot of the server. Sources holds the output
+// of every function registered through RegisterStats, keyed by name.
+type Stats struct {
+	ActiveConnections int64  `json:"active_connections"`
+	TotalConnections  uint64 `json:"total_connections"`
+	BytesIn           uint64 `json:"bytes_in"`
+	BytesOut          uint64 `json:"bytes_out"`
+	// ParseErrors counts requests rejected by the parser, keyed by the name
+	// of the error variable such as ERROR_INVALID_HTTP_METHOD.
+	ParseErrors     map[string]uint64 `json:"parse_errors,omitempty"`
+	PanicsRecovered uint64            `json:"panics_recovered"`
+	Sources         map[string]any    `json:"sources,omitempty"`
+}
+
+type Option func(*Server)
+
+// WithRequestTimeout sets a deadline on every request context.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.requestTimeout = d
+	}
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+// WithStreamingBodies leaves request bodies larger than maxBuffered bytes on
+// the connection for the handler to read through Request.BodyReader, so big
+// uploads are never held in memory. While such a body is being streamed the
+// request context is not cancelled on disconnect, reads fail instead.
+func WithStreamingBodies(maxBuffered int64) Option {
+	return func(s *Server) {
+		s.maxBufferedBody = maxBuffered
+	}
+}
+
+// WithH2C serves HTTP/2 without TLS to clients that either start with the
+// HTTP/2 connection preface or upgrade an HTTP/1.1 request with
+// "Upgrade: h2c". Handlers see the same Request and Writer either way.
+func WithH2C() Option {
+	return func(s *Server) {
+		s.h2c = true
+	}
+}
+
+// Serve listens for TCP on port on all interfaces, see ListenTCP and
+// ListenUnix to bind somewhere more specific.
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
+	listener, err := ListenTCP("", port)
 	if err != nil {
 		return nil, err
 	}
 
+	return ServeListener(listener, handler, opts...), nil
+}
+
+// ServeListener starts accepting connections on listener, which the server
+// closes on Close.
+func ServeListener(listener net.Listener, handler Handler, opts ...Option) *Server {
+	baseCtx, cancelBase := context.WithCancelCause(context.Background())
 	ser := &Server{
-		listener: listener,
-		closed:   atomic.Bool{},
-		handler:  handler,
+		listener:        listener,
+		closed:          atomic.Bool{},
+		handler:         handler,
+		maxBufferedBody: -1,
+		baseCtx:         baseCtx,
+		cancelBase:      cancelBase,
+		drain:           make(chan struct{}),
+		statsSources:    map[string]func() any{},
+		parseErrors:     map[string]uint64{},
 	}
 
 	ser.closed.Store(false)
+	for _, opt := range opts {
+		opt(ser)
+	}
 
 	go ser.listen()
-	return ser, nil
+	return ser
 }
 
 func (s *Server) Close() error {
-	if s.closed.Load() {
+	if s.closed.Swap(true) {
 		return fmt.Errorf("Server already closed")
 	}
+	s.cancelBase(ERROR_SERVER_CLOSED)
 	err := s.listener.Close()
 	if err != nil {
 		return err
@@ -45,31 +142,163 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// Shutdown stops accepting connections and waits for the open ones to
+// finish. HTTP/2 clients are sent GOAWAY so they stop opening streams. If
+// ctx ends first the remaining requests are cancelled as with Close and
+// the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.closed.Swap(true) {
+		return fmt.Errorf("Server already closed")
+	}
+	defer s.cancelBase(ERROR_SERVER_CLOSED)
+	close(s.drain)
+	err := s.listener.Close()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for s.activeConns.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return err
+}
+
+// Addr returns the address the server is listening on, which is useful when
+// serving on port 0.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// RegisterStats adds a named source whose result is included in Stats. This
+// lets components such as upstream circuit breakers report their state.
+func (s *Server) RegisterStats(name string, source func() any) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	s.statsSources[name] = source
+}
+
+func (s *Server) Stats() Stats {
+	s.statsMu.Lock()
+	sources := make(map[string]func() any, len(s.statsSources))
+	for name, source := range s.statsSources {
+		sources[name] = source
+	}
+	s.statsMu.Unlock()
+
+	stats := Stats{
+		ActiveConnections: s.activeConns.Load(),
+		TotalConnections:  s.totalConns.Load(),
+		BytesIn:           s.bytesIn.Load(),
+		BytesOut:          s.bytesOut.Load(),
+		ParseErrors:       map[string]uint64{},
+		PanicsRecovered:   s.panics.Load(),
+		Sources:           make(map[string]any, len(sources)),
+	}
+	s.parseErrorsMu.Lock()
+	for name, count := range s.parseErrors {
+		stats.ParseErrors[name] = count
+	}
+	s.parseErrorsMu.Unlock()
+	for name, source := range sources {
+		stats.Sources[name] = source()
+	}
+
+	return stats
+}
+
 func (s *Server) listen() {
 	for {
 		conn, err := s.listener.Accept()
-		if err != nil {
-			panic("Unable to accept connection")
-		}
 		if s.closed.Load() {
 			fmt.Println("Server closed, ending accepting connections")
 			break
 		}
+		if err != nil {
+			panic("Unable to accept connection")
+		}
 		go s.handle(conn)
 	}
 }
 
 func (s *Server) handle(conn net.Conn) {
-	req, err := request.RequestFromReader(conn)
+	s.activeConns.Add(1)
+	s.totalConns.Add(1)
+	defer s.activeConns.Add(-1)
+	tlsConn, _ := conn.(*tls.Conn)
+	conn = &countingConn{Conn: conn, read: &s.bytesIn, written: &s.bytesOut}
+
+	// A failed handshake is left for the request parser to report, the
+	// error comes back from every read
+	if tlsConn != nil && tlsConn.Handshake() == nil && tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		s.serveHTTP2(conn, tlsConn, nil)
+		return
+	}
+
+	var input io.Reader = conn
+	h2c := s.h2c && tlsConn == nil
+	if h2c {
+		peeked, ok := peekPreface(conn)
+		if ok {
+			s.serveHTTP2(&replayConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(peeked), conn)}, nil, nil)
+			return
+		}
+		input = io.MultiReader(bytes.NewReader(peeked), conn)
+	}
+
+	req, err := request.RequestFromReaderStreaming(input, s.maxBufferedBody)
 	if err != nil {
-		conn.Write([]byte("Failed to read request"))
+		s.parseErrorsMu.Lock()
+		s.parseErrors[parseErrorName(err)]++
+		s.parseErrorsMu.Unlock()
+		rejectRequest(conn, err)
 		conn.Close()
 		return
 	}
 
-	w := response.NewWriter(conn)
+	setConnInfo(req, conn, tlsConn)
+
+	if h2c && !req.IsStreamed() && http2.IsUpgrade(req) {
+		err = response.WriteStatusLine(conn, response.STATUS_SWITCHING_PROTOCOLS)
+		if err == nil {
+			_, err = conn.Write([]byte("Connection: Upgrade\r\nUpgrade: h2c\r\n\r\n"))
+		}
+		if err != nil {
+			conn.Close()
+			return
+		}
+		s.serveHTTP2(conn, nil, req)
+		return
+	}
+
+	ctx, cancel := context.WithCancelCause(s.baseCtx)
+	defer cancel(nil)
+	if s.requestTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, s.requestTimeout)
+		defer cancelTimeout()
+	}
+	ctx = request.ContextWithRequestID(ctx, requestID(req))
+	req = req.WithContext(ctx)
+
+	// A background read would steal bytes from a body still being streamed
+	var reader *backgroundReader
+	if !req.IsStreamed() {
+		reader = startBackgroundReader(conn, cancel)
+	}
+	hc := &hijackableConn{Conn: conn, buffered: req.Buffered(), reader: reader}
+	w := response.NewWriter(hc)
 	// w := response.NewWriter(&strings.Builder{})
-	s.handler(w, req)
+	s.serveRequest(w, req)
+
+	if hc.hijacked.Load() {
+		return
+	}
+	if reader != nil {
+		reader.stop()
+	}
 
 	err = conn.Close()
 	if err != nil {
@@ -77,6 +306,63 @@ func (s *Server) handle(conn net.Conn) {
 	}
 }
 
+func setConnInfo(req *request.Request, conn net.Conn, tlsConn *tls.Conn) {
+	req.RemoteAddr = conn.RemoteAddr().String()
+	if tlsConn != nil {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+		req.Peer = request.PeerFromTLS(&state)
+	}
+}
+
+// serveHTTP2 runs conn as an HTTP/2 connection until the client goes away.
+// upgrade is the HTTP/1.1 request that switched to h2c, if any, which is
+// answered as the first stream.
+func (s *Server) serveHTTP2(conn net.Conn, tlsConn *tls.Conn, upgrade *request.Request) {
+	handler := func(w *response.Writer, req *request.Request) {
+		setConnInfo(req, conn, tlsConn)
+		ctx := req.Context()
+		if s.requestTimeout > 0 {
+			var cancelTimeout context.CancelFunc
+			ctx, cancelTimeout = context.WithTimeout(ctx, s.requestTimeout)
+			defer cancelTimeout()
+		}
+		ctx = request.ContextWithRequestID(ctx, requestID(req))
+		s.serveRequest(w, req.WithContext(ctx))
+	}
+
+	opts := http2.Options{MaxBufferedBody: s.maxBufferedBody, Drain: s.drain}
+	var err error
+	if upgrade != nil {
+		err = http2.ServeUpgrade(s.baseCtx, conn, upgrade, handler, opts)
+	} else {
+		err = http2.ServeConn(s.baseCtx, conn, handler, opts)
+	}
+	var connErr *http2.ConnectionError
+	if errors.As(err, &connErr) {
+		log.Printf("HTTP/2 connection from %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// serveRequest runs the handler, recovering from a panic so one bad request
+// can't take the server down. A 500 is sent if the handler hadn't started
+// the response yet.
+func (s *Server) serveRequest(w *response.Writer, req *request.Request) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		s.panics.Add(1)
+		log.Printf("panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, v, debug.Stack())
+		if w.StatusCode() == 0 {
+			w.WriteStatusLine(response.STATUS_INTERNAL_SERVER_ERROR)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+		}
+	}()
+	s.handler(w, req)
+}
+
 type HandlerError struct {
 	StatusCode   int
 	ErrorMessage string
@@ -87,3 +373,15 @@ func (he *HandlerError) Error() string {
 }
 
 type Handler func(w *response.Writer, req *request.Request)
+
+// Middleware wraps a Handler to add behaviour before or after it runs.
+type Middleware func(Handler) Handler
+
+// Chain wraps handler in middleware so that the first middleware given is
+// the outermost and sees the request first.
+func Chain(handler Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"dev.grab-a-byte.network/internal/http2"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHijack(t *testing.T) {
+	hijackErr := make(chan error, 1)
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		conn, buffered, err := w.Hijack()
+		if err != nil {
+			hijackErr <- err
+			return
+		}
+
+		// Writes through the response writer must fail after hijacking
+		_, err = w.WriteChunkedBody([]byte("nope"))
+		hijackErr <- err
+
+		go func() {
+			defer conn.Close()
+			conn.Write([]byte("buffered:"))
+			conn.Write(buffered)
+			conn.Write([]byte("\n"))
+			io.Copy(conn, conn)
+		}()
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /upgrade HTTP/1.1\r\nHost: localhost\r\n\r\nearly"))
+	require.NoError(t, err)
+
+	select {
+	case err := <-hijackErr:
+		require.ErrorIs(t, err, ERROR_CONN_HIJACKED)
+	case <-time.After(time.Second):
+		t.Fatal("handler did not run")
+	}
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "buffered:early\n", line)
+
+	// Test: Connection stays open and usable after the handler returns
+	_, err = conn.Write([]byte("echo"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "echo", string(buf))
+
+	// Test: Half-closing fails rather than closing connections that can't
+	listener := newPipeListener()
+	halfClosed := make(chan error, 1)
+	srv = ServeListener(listener, func(w *response.Writer, req *request.Request) {
+		conn, _, err := w.Hijack()
+		if err != nil {
+			halfClosed <- err
+			return
+		}
+		halfClosed <- conn.(interface{ CloseWrite() error }).CloseWrite()
+		conn.Write([]byte("still open"))
+		conn.Close()
+	})
+	defer srv.Close()
+	pipe := listener.Dial()
+	defer pipe.Close()
+	pipe.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = pipe.Write([]byte("GET /upgrade HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	require.ErrorIs(t, <-halfClosed, errors.ErrUnsupported)
+	rest, err := io.ReadAll(pipe)
+	require.NoError(t, err)
+	assert.Equal(t, "still open", string(rest))
+}
+
+func TestRequestContext(t *testing.T) {
+	started := make(chan struct{}, 2)
+	cause := make(chan error, 2)
+	ids := make(chan string, 2)
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		ids <- req.ID()
+		started <- struct{}{}
+		<-req.Context().Done()
+		cause <- context.Cause(req.Context())
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nX-Request-ID: abc-123\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+	assert.Equal(t, "abc-123", <-ids)
+
+	// Test: Client hanging up cancels the request context
+	conn.Close()
+	select {
+	case err := <-cause:
+		require.ErrorIs(t, err, ERROR_CLIENT_GONE)
+	case <-time.After(time.Second):
+		t.Fatal("context was not cancelled")
+	}
+
+	// Test: Still noticed after more early data than is kept
+	conn, err = net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+	<-ids
+	_, err = conn.Write(make([]byte, 2*maxEarlyBytes))
+	require.NoError(t, err)
+	conn.Close()
+	select {
+	case err := <-cause:
+		require.ErrorIs(t, err, ERROR_CLIENT_GONE)
+	case <-time.After(time.Second):
+		t.Fatal("context was not cancelled")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	require.NoError(t, err)
+
+	send := func() *bufio.Reader {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		<-started
+		return bufio.NewReader(conn)
+	}
+
+	// Test: Requests in flight finish, new connections are refused
+	reader := send()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown returned with a request in flight")
+	default:
+	}
+	close(release)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+	assert.NoError(t, <-shutdown)
+
+	// Test: Requests still running when the context ends are cancelled
+	cause := make(chan error, 1)
+	srv, err = Serve(0, func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		<-req.Context().Done()
+		cause <- context.Cause(req.Context())
+	})
+	require.NoError(t, err)
+	send()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, srv.Shutdown(ctx), context.DeadlineExceeded)
+	assert.ErrorIs(t, <-cause, ERROR_SERVER_CLOSED)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	cause := make(chan error, 1)
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		cause <- req.Context().Err()
+	}, WithRequestTimeout(20*time.Millisecond))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	select {
+	case err := <-cause:
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("context deadline did not pass")
+	}
+}
+
+func TestStatsCounters(t *testing.T) {
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Path == "/panic" {
+			panic("boom")
+		}
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	send := func(raw string) string {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(raw))
+		require.NoError(t, err)
+		reply, _ := io.ReadAll(conn)
+		return string(reply)
+	}
+
+	// Test: Panics are recovered and answered with a 500
+	reply := send("GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, reply, "HTTP/1.1 500 Internal Server Error")
+	reply = send("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, reply, "HTTP/1.1 200 OK")
+
+	// Test: Parse errors are counted by type
+	send("get / HTTP/1.1\r\n\r\n")
+
+	// Test: Oversized heads are answered with their own status
+	reply = send("GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", 2<<20))
+	assert.True(t, strings.HasPrefix(reply, "HTTP/1.1 431 "), reply[:min(len(reply), 40)])
+
+	stats := srv.Stats()
+	assert.Equal(t, uint64(1), stats.PanicsRecovered)
+	assert.Equal(t, uint64(1), stats.ParseErrors["ERROR_INVALID_HTTP_METHOD"])
+	assert.Equal(t, uint64(1), stats.ParseErrors["ERROR_HEADERS_TOO_LARGE"])
+	assert.Greater(t, stats.BytesIn, uint64(80))
+	assert.Greater(t, stats.BytesOut, uint64(30))
+}
+
+func TestH2C(t *testing.T) {
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}, WithH2C())
+	require.NoError(t, err)
+	defer srv.Close()
+
+	dial := func(raw string) *bufio.Reader {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte(raw))
+		require.NoError(t, err)
+		return bufio.NewReader(conn)
+	}
+	// settingsFrame is an empty SETTINGS frame
+	settingsFrame := "\x00\x00\x00\x04\x00\x00\x00\x00\x00"
+
+	// Test: HTTP/1.1 requests, including ones sharing a prefix with the preface, still work
+	line, err := dial("PUT / HTTP/1.1\r\nHost: localhost\r\n\r\n").ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+
+	// Test: Prior knowledge connections are answered with SETTINGS
+	head := make([]byte, 9)
+	_, err = io.ReadFull(dial(http2.Preface+settingsFrame), head)
+	require.NoError(t, err)
+	assert.Equal(t, byte(http2.FrameSettings), head[3])
+
+	// Test: Upgrades switch protocols before the HTTP/2 preface
+	reader := dial("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAoAAAAAIAAAAA\r\n\r\n")
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", line)
+	for line != "\r\n" {
+		line, err = reader.ReadString('\n')
+		require.NoError(t, err)
+	}
+	_, err = io.ReadFull(reader, head)
+	require.NoError(t, err)
+	assert.Equal(t, byte(http2.FrameSettings), head[3])
+}
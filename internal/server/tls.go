@@ -0,0 +1,336 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"dev.grab-a-byte.network/internal/http2"
+)
+
+var ERROR_NO_CERTIFICATES = errors.New("at least one certificate is required")
+var ERROR_INSECURE_TLS_VERSION = errors.New("TLS versions before 1.2 are not allowed")
+var ERROR_INSECURE_CIPHER_SUITE = errors.New("cipher suite is not allowed")
+var ERROR_NO_CLIENT_CAS = errors.New("client certificate verification needs client CAs")
+
+// ClientAuth is how client certificates are handled.
+type ClientAuth int
+
+const (
+	// ClientAuthNone doesn't ask for a certificate.
+	ClientAuthNone ClientAuth = iota
+	// ClientAuthRequest asks for a certificate but neither requires nor
+	// verifies it, Request.Peer is filled in for the handler to decide.
+	ClientAuthRequest
+	// ClientAuthRequire refuses connections without a certificate signed by
+	// one of the client CAs.
+	ClientAuthRequire
+	// ClientAuthVerifyIfGiven allows anonymous clients but refuses
+	// certificates that don't verify.
+	ClientAuthVerifyIfGiven
+)
+
+// ParseClientAuth accepts the mode names used on the command line: none,
+// request, require and verify-if-given.
+func ParseClientAuth(name string) (ClientAuth, error) {
+	switch name {
+	case "", "none":
+		return ClientAuthNone, nil
+	case "request":
+		return ClientAuthRequest, nil
+	case "require":
+		return ClientAuthRequire, nil
+	case "verify-if-given":
+		return ClientAuthVerifyIfGiven, nil
+	}
+	return 0, fmt.Errorf("unknown client auth mode %q", name)
+}
+
+func (ca ClientAuth) tlsType() tls.ClientAuthType {
+	switch ca {
+	case ClientAuthRequest:
+		return tls.RequestClientCert
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	case ClientAuthVerifyIfGiven:
+		return tls.VerifyClientCertIfGiven
+	}
+	return tls.NoClientCert
+}
+
+// DefaultCipherSuites are the TLS 1.2 suites allowed by default: forward
+// secret and AEAD only. TLS 1.3 suites are not configurable in crypto/tls.
+var DefaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// CertFile is a PEM certificate chain and its private key on disk.
+type CertFile struct {
+	CertFile string
+	KeyFile  string
+}
+
+type TLSOptions struct {
+	// Certificates are picked by the SNI server name. The first one is
+	// used when the client sends no name or no certificate matches.
+	Certificates []CertFile
+	// MinVersion defaults to TLS 1.2, older versions are rejected.
+	MinVersion uint16
+	// CipherSuites for TLS 1.2, defaults to DefaultCipherSuites. Suites
+	// crypto/tls considers insecure are rejected. HTTP/2 isn't offered when
+	// any of them is one RFC 9113 section 9.2.2 prohibits, such as CBC.
+	CipherSuites []uint16
+	// ReloadInterval is how often the files are checked for changes, zero
+	// means only reloading on SIGHUP.
+	ReloadInterval time.Duration
+
+	ClientAuth ClientAuth
+	// ClientCAFiles are PEM files with the CAs client certificates are
+	// verified against. Required for ClientAuthRequire and
+	// ClientAuthVerifyIfGiven.
+	ClientCAFiles []string
+}
+
+// ServeTLS is Serve over TLS, offering HTTP/2 and HTTP/1.1 through ALPN.
+// Certificates are reloaded from disk on SIGHUP and, when ReloadInterval
+// is set, whenever one of the files changes. A failed reload keeps the
+// certificates already loaded.
+func ServeTLS(port int, handler Handler, tlsOpts TLSOptions, opts ...Option) (*Server, error) {
+	listener, err := ListenTCP("", port)
+	if err != nil {
+		return nil, err
+	}
+	return ServeTLSListener(listener, handler, tlsOpts, opts...)
+}
+
+// ServeTLSListener is ServeTLS on an existing listener. The listener is
+// closed if the options are invalid.
+func ServeTLSListener(listener net.Listener, handler Handler, tlsOpts TLSOptions, opts ...Option) (*Server, error) {
+	config, certs, err := tlsConfig(tlsOpts)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	s := ServeListener(tls.NewListener(listener, config), handler, opts...)
+	go certs.watch(s.baseCtx, tlsOpts.ReloadInterval)
+	return s, nil
+}
+
+// prohibitedForHTTP2 reports whether HTTP/2 forbids a TLS 1.2 suite, which
+// is anything without both ephemeral key exchange and an AEAD cipher.
+func prohibitedForHTTP2(id uint16) bool {
+	name := tls.CipherSuiteName(id)
+	ephemeral := strings.HasPrefix(name, "TLS_ECDHE_") || strings.HasPrefix(name, "TLS_DHE_")
+	aead := strings.Contains(name, "_GCM_") || strings.Contains(name, "_CHACHA20_POLY1305")
+	return !ephemeral || !aead
+}
+
+func tlsConfig(opts TLSOptions) (*tls.Config, *certStore, error) {
+	if opts.MinVersion == 0 {
+		opts.MinVersion = tls.VersionTLS12
+	}
+	if opts.MinVersion < tls.VersionTLS12 {
+		return nil, nil, ERROR_INSECURE_TLS_VERSION
+	}
+	if opts.CipherSuites == nil {
+		opts.CipherSuites = DefaultCipherSuites
+	}
+	for _, id := range opts.CipherSuites {
+		if !slices.ContainsFunc(tls.CipherSuites(), func(cs *tls.CipherSuite) bool { return cs.ID == id }) {
+			return nil, nil, fmt.Errorf("%w: %s", ERROR_INSECURE_CIPHER_SUITE, tls.CipherSuiteName(id))
+		}
+	}
+
+	certs, err := newCertStore(opts.Certificates)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     opts.MinVersion,
+		CipherSuites:   opts.CipherSuites,
+		GetCertificate: certs.getCertificate,
+		ClientAuth:     opts.ClientAuth.tlsType(),
+		NextProtos:     []string{"http/1.1"},
+	}
+	// A client picking a prohibited suite would have to fail HTTP/2 with
+	// INADEQUATE_SECURITY, so it is only offered when none can be picked
+	if !slices.ContainsFunc(opts.CipherSuites, prohibitedForHTTP2) {
+		config.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+	if len(opts.ClientCAFiles) > 0 {
+		config.ClientCAs, err = loadCertPool(opts.ClientCAFiles)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if config.ClientCAs == nil && (opts.ClientAuth == ClientAuthRequire || opts.ClientAuth == ClientAuthVerifyIfGiven) {
+		return nil, nil, ERROR_NO_CLIENT_CAS
+	}
+	return config, certs, nil
+}
+
+func loadCertPool(files []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", file)
+		}
+	}
+	return pool, nil
+}
+
+// certStore holds the loaded certificates, indexed by the names they are
+// valid for, and swaps them out atomically on reload.
+type certStore struct {
+	files []CertFile
+
+	mu       sync.RWMutex
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+	modTimes []time.Time
+}
+
+func newCertStore(files []CertFile) (*certStore, error) {
+	if len(files) == 0 {
+		return nil, ERROR_NO_CERTIFICATES
+	}
+	cs := &certStore{files: files}
+	err := cs.reload()
+	if err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (cs *certStore) reload() error {
+	byName := map[string]*tls.Certificate{}
+	var fallback *tls.Certificate
+	modTimes := make([]time.Time, len(cs.files))
+
+	for i, file := range cs.files {
+		cert, err := tls.LoadX509KeyPair(file.CertFile, file.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading %s: %w", file.CertFile, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("parsing %s: %w", file.CertFile, err)
+		}
+		cert.Leaf = leaf
+
+		if fallback == nil {
+			fallback = &cert
+		}
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, taken := byName[name]; !taken {
+				byName[name] = &cert
+			}
+		}
+		modTimes[i] = modTime(file)
+	}
+
+	cs.mu.Lock()
+	cs.byName, cs.fallback, cs.modTimes = byName, fallback, modTimes
+	cs.mu.Unlock()
+	return nil
+}
+
+func modTime(file CertFile) time.Time {
+	latest := time.Time{}
+	for _, path := range []string{file.CertFile, file.KeyFile} {
+		info, err := os.Stat(path)
+		if err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// getCertificate matches the SNI name exactly, then against a wildcard
+// for its parent domain.
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := cs.byName[name]; ok {
+		return cert, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := cs.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+	return cs.fallback, nil
+}
+
+// changed reports whether any file was modified since the last reload.
+func (cs *certStore) changed() bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for i, file := range cs.files {
+		if !modTime(file).Equal(cs.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads on SIGHUP and on file changes until ctx is done.
+func (cs *certStore) watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+			if !cs.changed() {
+				continue
+			}
+		}
+		err := cs.reload()
+		if err != nil {
+			log.Printf("Keeping current certificates, reload failed: %v", err)
+			continue
+		}
+		log.Println("Reloaded TLS certificates")
+	}
+}
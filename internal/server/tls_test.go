@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSelfSigned creates a self-signed certificate for names in dir and
+// returns where it was written.
+func writeSelfSigned(t *testing.T, dir, base string, serial int64, names ...string) CertFile {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	files := CertFile{CertFile: filepath.Join(dir, base+".crt"), KeyFile: filepath.Join(dir, base+".key")}
+	require.NoError(t, os.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return files
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	first := writeSelfSigned(t, dir, "first", 1, "first.test")
+	second := writeSelfSigned(t, dir, "second", 2, "second.test", "*.wild.test")
+
+	srv, err := ServeTLS(0, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}, TLSOptions{Certificates: []CertFile{first, second}, ReloadInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	serial := func(serverName string, config *tls.Config) int64 {
+		t.Helper()
+		if config == nil {
+			config = &tls.Config{}
+		}
+		config.ServerName = serverName
+		config.InsecureSkipVerify = true
+		conn, err := tls.Dial("tcp", srv.Addr().String(), config)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+		require.NoError(t, err)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	// Test: Certificates selected by SNI, with wildcards and a fallback
+	assert.Equal(t, int64(1), serial("first.test", nil))
+	assert.Equal(t, int64(2), serial("second.test", nil))
+	assert.Equal(t, int64(2), serial("api.wild.test", nil))
+	assert.Equal(t, int64(1), serial("unknown.test", nil))
+
+	// Test: Old protocol versions are refused
+	conn, err := tls.Dial("tcp", srv.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11})
+	if err == nil {
+		conn.Close()
+	}
+	assert.Error(t, err)
+
+	// Test: Changed files are picked up without a restart
+	time.Sleep(20 * time.Millisecond)
+	writeSelfSigned(t, dir, "first", 3, "first.test")
+	require.Eventually(t, func() bool {
+		return serial("first.test", nil) == 3
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestTLSOptions(t *testing.T) {
+	files := writeSelfSigned(t, t.TempDir(), "cert", 1, "localhost")
+
+	_, _, err := tlsConfig(TLSOptions{})
+	assert.ErrorIs(t, err, ERROR_NO_CERTIFICATES)
+
+	_, _, err = tlsConfig(TLSOptions{Certificates: []CertFile{files}, MinVersion: tls.VersionTLS10})
+	assert.ErrorIs(t, err, ERROR_INSECURE_TLS_VERSION)
+
+	_, _, err = tlsConfig(TLSOptions{Certificates: []CertFile{files}, CipherSuites: []uint16{tls.TLS_RSA_WITH_RC4_128_SHA}})
+	assert.ErrorIs(t, err, ERROR_INSECURE_CIPHER_SUITE)
+
+	config, _, err := tlsConfig(TLSOptions{Certificates: []CertFile{files}})
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+	assert.Equal(t, DefaultCipherSuites, config.CipherSuites)
+	assert.Equal(t, []string{"h2", "http/1.1"}, config.NextProtos)
+
+	// Test: Suites HTTP/2 prohibits take it off the ALPN list
+	config, _, err = tlsConfig(TLSOptions{Certificates: []CertFile{files}, CipherSuites: []uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http/1.1"}, config.NextProtos)
+}
+
+func TestALPN(t *testing.T) {
+	files := writeSelfSigned(t, t.TempDir(), "cert", 1, "localhost")
+	srv, err := ServeTLS(0, func(w *response.Writer, req *request.Request) {
+		body := []byte(req.RequestLine.HttpVersion)
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("x-tls", fmt.Sprint(req.TLS != nil))
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+	}, TLSOptions{Certificates: []CertFile{files}})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	get := func(nextProtos ...string) (*http.Response, string) {
+		t.Helper()
+		transport := &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, NextProtos: nextProtos},
+			ForceAttemptHTTP2: slices.Contains(nextProtos, "h2"),
+		}
+		defer transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport}).Get("https://" + srv.Addr().String() + "/")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	// Test: Clients offering h2 get HTTP/2, through the same handler
+	resp, body := get("h2", "http/1.1")
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "2", body)
+	assert.Equal(t, "true", resp.Header.Get("x-tls"))
+	assert.Equal(t, "h2", resp.TLS.NegotiatedProtocol)
+
+	// Test: Clients without h2 stay on HTTP/1.1
+	resp, body = get("http/1.1")
+	assert.Equal(t, 1, resp.ProtoMajor)
+	assert.Equal(t, "1.1", body)
+	assert.Equal(t, "true", resp.Header.Get("x-tls"))
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(100),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) writePEM(t *testing.T, path string) {
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600))
+}
+
+func (ca *testCA) clientCert(t *testing.T, name string, uri string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	parsed, err := url.Parse(uri)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(101),
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"Internal"}},
+		URIs:         []*url.URL{parsed},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	serverCert := writeSelfSigned(t, dir, "server", 1, "localhost")
+	trusted := newTestCA(t, "Trusted CA")
+	trusted.writePEM(t, filepath.Join(dir, "ca.pem"))
+	untrusted := newTestCA(t, "Someone Else")
+
+	good := trusted.clientCert(t, "billing", "spiffe://internal/billing")
+	bad := untrusted.clientCert(t, "billing", "spiffe://internal/billing")
+
+	start := func(mode ClientAuth) (*Server, chan *request.Request) {
+		seen := make(chan *request.Request, 1)
+		srv, err := ServeTLS(0, func(w *response.Writer, req *request.Request) {
+			seen <- req
+			w.WriteStatusLine(response.STATUS_OK)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+		}, TLSOptions{
+			Certificates:  []CertFile{serverCert},
+			ClientAuth:    mode,
+			ClientCAFiles: []string{filepath.Join(dir, "ca.pem")},
+		})
+		require.NoError(t, err)
+		return srv, seen
+	}
+
+	// get sends a request and returns an error if the server refused the
+	// connection. With TLS 1.3 a rejected client certificate only shows up
+	// when reading. The certificate is always sent, crypto/tls would
+	// otherwise leave out one the server's CA list doesn't cover.
+	get := func(srv *Server, certs ...tls.Certificate) error {
+		conn, err := tls.Dial("tcp", srv.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if len(certs) == 0 {
+					return &tls.Certificate{}, nil
+				}
+				return &certs[0], nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		if err != nil {
+			return err
+		}
+		_, err = bufio.NewReader(conn).ReadString('\n')
+		return err
+	}
+
+	// Test: Require refuses anonymous and untrusted clients
+	srv, seen := start(ClientAuthRequire)
+	assert.Error(t, get(srv))
+	assert.Error(t, get(srv, bad))
+	require.NoError(t, get(srv, good))
+	req := <-seen
+	require.NotNil(t, req.Peer)
+	assert.True(t, req.Peer.Verified())
+	assert.Equal(t, "billing", req.Peer.Subject.CommonName)
+	assert.Equal(t, "spiffe://internal/billing", req.Peer.URIs[0].String())
+	assert.NotNil(t, req.TLS)
+	srv.Close()
+
+	// Test: Verify if given lets anonymous clients through
+	srv, seen = start(ClientAuthVerifyIfGiven)
+	require.NoError(t, get(srv))
+	assert.Nil(t, (<-seen).Peer)
+	assert.Error(t, get(srv, bad))
+	srv.Close()
+
+	// Test: Request passes on unverified certificates
+	srv, seen = start(ClientAuthRequest)
+	require.NoError(t, get(srv, bad))
+	req = <-seen
+	require.NotNil(t, req.Peer)
+	assert.False(t, req.Peer.Verified())
+	srv.Close()
+
+	_, _, err := tlsConfig(TLSOptions{Certificates: []CertFile{serverCert}, ClientAuth: ClientAuthRequire})
+	assert.ErrorIs(t, err, ERROR_NO_CLIENT_CAS)
+}
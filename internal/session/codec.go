@@ -0,0 +1,128 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ERROR_NO_KEYS = errors.New("at least one key is required")
+var ERROR_INVALID_VALUE = errors.New("invalid session cookie value")
+var ERROR_SHORT_KEY = errors.New("keys must be at least 32 bytes")
+
+// minKeyLength matches the HMAC-SHA256 output and the AES-256 key size.
+const minKeyLength = 32
+
+var encoding = base64.RawURLEncoding
+
+// Codec signs, or encrypts and authenticates, cookie values. Keys are
+// ordered newest first: the first key is used for new values and every key
+// is tried when decoding, which allows keys to be rotated without logging
+// everybody out.
+type Codec struct {
+	keys    [][]byte
+	aeads   []cipher.AEAD
+	encrypt bool
+}
+
+// NewCodec creates a codec using HMAC-SHA256 signatures, or AES-256-GCM
+// when encrypt is set. Keys must be at least 32 bytes long, and exactly 32
+// for AES.
+func NewCodec(keys [][]byte, encrypt bool) (*Codec, error) {
+	if len(keys) == 0 {
+		return nil, ERROR_NO_KEYS
+	}
+	for _, key := range keys {
+		if len(key) < minKeyLength {
+			return nil, ERROR_SHORT_KEY
+		}
+	}
+
+	c := &Codec{keys: keys, encrypt: encrypt}
+	if encrypt {
+		for _, key := range keys {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid encryption key: %w", err)
+			}
+			aead, err := cipher.NewGCM(block)
+			if err != nil {
+				return nil, err
+			}
+			c.aeads = append(c.aeads, aead)
+		}
+	}
+
+	return c, nil
+}
+
+// Encode protects payload for a cookie called name. The name is bound into
+// the signature so a value can't be replayed under a different cookie.
+func (c *Codec) Encode(name string, payload []byte) (string, error) {
+	if c.encrypt {
+		aead := c.aeads[0]
+		nonce := make([]byte, aead.NonceSize())
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return "", err
+		}
+		sealed := aead.Seal(nonce, nonce, payload, []byte(name))
+		return encoding.EncodeToString(sealed), nil
+	}
+
+	data := encoding.EncodeToString(payload)
+	return data + "." + encoding.EncodeToString(c.mac(c.keys[0], name, data)), nil
+}
+
+func (c *Codec) Decode(name, value string) ([]byte, error) {
+	if c.encrypt {
+		sealed, err := encoding.DecodeString(value)
+		if err != nil {
+			return nil, ERROR_INVALID_VALUE
+		}
+		for _, aead := range c.aeads {
+			if len(sealed) < aead.NonceSize() {
+				return nil, ERROR_INVALID_VALUE
+			}
+			nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+			payload, err := aead.Open(nil, nonce, ciphertext, []byte(name))
+			if err == nil {
+				return payload, nil
+			}
+		}
+		return nil, ERROR_INVALID_VALUE
+	}
+
+	data, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, ERROR_INVALID_VALUE
+	}
+	mac, err := encoding.DecodeString(sig)
+	if err != nil {
+		return nil, ERROR_INVALID_VALUE
+	}
+	for _, key := range c.keys {
+		if hmac.Equal(mac, c.mac(key, name, data)) {
+			payload, err := encoding.DecodeString(data)
+			if err != nil {
+				return nil, ERROR_INVALID_VALUE
+			}
+			return payload, nil
+		}
+	}
+	return nil, ERROR_INVALID_VALUE
+}
+
+func (c *Codec) mac(key []byte, name, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,276 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"dev.grab-a-byte.network/internal/cookie"
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"dev.grab-a-byte.network/internal/server"
+)
+
+// maxCookieSize is the smallest limit browsers are required to support.
+const maxCookieSize = 4096
+
+type Options struct {
+	// CookieName defaults to "session".
+	CookieName string
+	// Keys sign or encrypt the cookie, newest first. See Codec.
+	Keys    [][]byte
+	Encrypt bool
+	// MaxAge is how long a session lives after it was last saved. Defaults
+	// to 24 hours.
+	MaxAge time.Duration
+	// Sliding renews the expiry on requests made in the second half of a
+	// session's lifetime, so active users stay logged in.
+	Sliding bool
+	// Store keeps values server side, the cookie then only holds the id.
+	// When nil the values themselves are kept in the cookie.
+	Store Store
+
+	Path     string
+	Domain   string
+	Secure   bool
+	SameSite cookie.SameSite
+}
+
+// Session holds the values for one client. It is safe for concurrent use.
+type Session struct {
+	mu        sync.Mutex
+	id        string
+	values    map[string]string
+	expires   time.Time
+	isNew     bool
+	modified  bool
+	destroyed bool
+}
+
+func (s *Session) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+func (s *Session) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	s.modified = true
+}
+
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	s.modified = true
+}
+
+// Destroy clears the session and expires its cookie.
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = map[string]string{}
+	s.destroyed = true
+}
+
+// IsNew reports whether the client did not present a valid session.
+func (s *Session) IsNew() bool {
+	return s.isNew
+}
+
+func (s *Session) Expires() time.Time {
+	return s.expires
+}
+
+type contextKey string
+
+const sessionKey contextKey = "session"
+
+func FromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey).(*Session)
+	return s
+}
+
+// FromRequest returns the session attached by Middleware, or nil when the
+// middleware is not installed.
+func FromRequest(req *request.Request) *Session {
+	return FromContext(req.Context())
+}
+
+// payload is what gets encoded into the cookie.
+type payload struct {
+	ID      string            `json:"i,omitempty"`
+	Values  map[string]string `json:"v,omitempty"`
+	Expires int64             `json:"e"`
+}
+
+type manager struct {
+	opts  Options
+	codec *Codec
+	now   func() time.Time
+}
+
+// Middleware loads the session for each request and saves it, setting the
+// cookie, just before the response headers are written.
+func Middleware(opts Options) (server.Middleware, error) {
+	m, err := newManager(opts)
+	if err != nil {
+		return nil, err
+	}
+	return m.middleware, nil
+}
+
+func newManager(opts Options) (*manager, error) {
+	codec, err := NewCodec(opts.Keys, opts.Encrypt)
+	if err != nil {
+		return nil, err
+	}
+	if opts.CookieName == "" {
+		opts.CookieName = "session"
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = 24 * time.Hour
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.SameSite == cookie.SameSiteDefault {
+		opts.SameSite = cookie.SameSiteLax
+	}
+
+	return &manager{opts: opts, codec: codec, now: time.Now}, nil
+}
+
+func (m *manager) middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		s, hadCookie := m.load(req)
+		w.OnWriteHeaders(func(response.StatusCode, headers.Headers) {
+			m.save(w, s, hadCookie)
+		})
+
+		ctx := context.WithValue(req.Context(), sessionKey, s)
+		next(w, req.WithContext(ctx))
+	}
+}
+
+func (m *manager) load(req *request.Request) (*Session, bool) {
+	fresh := &Session{values: map[string]string{}, isNew: true}
+
+	c, err := req.Cookie(m.opts.CookieName)
+	if err != nil {
+		return fresh, false
+	}
+	raw, err := m.codec.Decode(m.opts.CookieName, c.Value)
+	if err != nil {
+		return fresh, true
+	}
+	var p payload
+	err = json.Unmarshal(raw, &p)
+	if err != nil {
+		return fresh, true
+	}
+
+	expires := time.Unix(p.Expires, 0)
+	if !m.now().Before(expires) {
+		if m.opts.Store != nil && p.ID != "" {
+			m.opts.Store.Delete(p.ID)
+		}
+		return fresh, true
+	}
+
+	s := &Session{id: p.ID, values: p.Values, expires: expires}
+	if m.opts.Store != nil {
+		values, storeExpires, err := m.opts.Store.Load(p.ID)
+		if err != nil {
+			return fresh, true
+		}
+		s.values = values
+		s.expires = storeExpires
+	}
+	if s.values == nil {
+		s.values = map[string]string{}
+	}
+
+	return s, true
+}
+
+func (m *manager) save(w *response.Writer, s *Session, hadCookie bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.destroyed {
+		if m.opts.Store != nil && s.id != "" {
+			m.opts.Store.Delete(s.id)
+		}
+		if hadCookie {
+			w.SetCookie(m.cookie("", -1, time.Unix(0, 0)))
+		}
+		return
+	}
+
+	now := m.now()
+	renew := m.opts.Sliding && !s.isNew && s.expires.Sub(now) < m.opts.MaxAge/2
+	if !s.modified && !renew {
+		return
+	}
+
+	s.expires = now.Add(m.opts.MaxAge).Truncate(time.Second)
+	p := payload{Expires: s.expires.Unix()}
+	if m.opts.Store != nil {
+		if s.id == "" {
+			s.id = newID()
+		}
+		err := m.opts.Store.Save(s.id, s.values, s.expires)
+		if err != nil {
+			log.Printf("session: saving %s: %v", s.id, err)
+			return
+		}
+		p.ID = s.id
+	} else {
+		p.Values = s.values
+	}
+
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	value, err := m.codec.Encode(m.opts.CookieName, raw)
+	if err != nil {
+		log.Printf("session: encoding cookie: %v", err)
+		return
+	}
+	c := m.cookie(value, int(m.opts.MaxAge.Seconds()), s.expires)
+	if len(c.String()) > maxCookieSize {
+		log.Printf("session: cookie is %d bytes, over the %d byte limit", len(c.String()), maxCookieSize)
+		return
+	}
+	w.SetCookie(c)
+}
+
+func (m *manager) cookie(value string, maxAge int, expires time.Time) *cookie.Cookie {
+	return &cookie.Cookie{
+		Name:     m.opts.CookieName,
+		Value:    value,
+		Path:     m.opts.Path,
+		Domain:   m.opts.Domain,
+		Expires:  expires,
+		MaxAge:   maxAge,
+		Secure:   m.opts.Secure,
+		HttpOnly: true,
+		SameSite: m.opts.SameSite,
+	}
+}
+
+func newID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,197 @@
+package session
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"dev.grab-a-byte.network/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	oldKey = []byte("0123456789abcdef0123456789abcdef")
+	newKey = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func TestCodec(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		old, err := NewCodec([][]byte{oldKey}, encrypt)
+		require.NoError(t, err)
+		rotated, err := NewCodec([][]byte{newKey, oldKey}, encrypt)
+		require.NoError(t, err)
+
+		// Test: Round trip
+		value, err := old.Encode("session", []byte("hello"))
+		require.NoError(t, err)
+		payload, err := old.Decode("session", value)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(payload))
+		if encrypt {
+			assert.NotContains(t, value, encoding.EncodeToString([]byte("hello")))
+		}
+
+		// Test: Values from a retired key still decode after rotation
+		payload, err = rotated.Decode("session", value)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(payload))
+
+		// Test: New values can't be read with only the old key
+		value, err = rotated.Encode("session", []byte("hello"))
+		require.NoError(t, err)
+		_, err = old.Decode("session", value)
+		assert.ErrorIs(t, err, ERROR_INVALID_VALUE)
+
+		// Test: Value can't be moved to a different cookie
+		_, err = rotated.Decode("other", value)
+		assert.ErrorIs(t, err, ERROR_INVALID_VALUE)
+
+		// Test: Tampering is detected
+		tampered := []byte(value)
+		tampered[2] ^= 1
+		_, err = rotated.Decode("session", string(tampered))
+		assert.ErrorIs(t, err, ERROR_INVALID_VALUE)
+	}
+
+	_, err := NewCodec(nil, false)
+	assert.ErrorIs(t, err, ERROR_NO_KEYS)
+
+	// Test: Short keys are rejected for both modes, empty ones included
+	for _, encrypt := range []bool{false, true} {
+		_, err = NewCodec([][]byte{[]byte("0123456789abcdef")}, encrypt)
+		assert.ErrorIs(t, err, ERROR_SHORT_KEY)
+		_, err = NewCodec([][]byte{newKey, {}}, encrypt)
+		assert.ErrorIs(t, err, ERROR_SHORT_KEY)
+	}
+	_, err = NewCodec([][]byte{append(newKey, 'x')}, true)
+	assert.Error(t, err)
+}
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+
+	require.NoError(t, store.Save("a", map[string]string{"user": "ada"}, now.Add(time.Minute)))
+	require.NoError(t, store.Save("b", map[string]string{}, now.Add(time.Hour)))
+
+	values, _, err := store.Load("a")
+	require.NoError(t, err)
+	assert.Equal(t, "ada", values["user"])
+
+	now = now.Add(2 * time.Minute)
+	_, _, err = store.Load("a")
+	assert.ErrorIs(t, err, ERROR_NOT_FOUND)
+
+	now = now.Add(2 * time.Hour)
+	store.Sweep()
+	assert.Equal(t, 0, store.Len())
+}
+
+// run sends one request carrying cookieHeader through mw and returns the
+// response.
+func run(t *testing.T, mw server.Middleware, cookieHeader string, handler func(s *Session)) *http.Response {
+	t.Helper()
+	builder := &strings.Builder{}
+	w := response.NewWriter(builder)
+	req := &request.Request{Headers: headers.NewHeaders(), RequestLine: request.RequestLine{Method: "GET"}}
+	if cookieHeader != "" {
+		req.Headers.Set("Cookie", cookieHeader)
+	}
+
+	mw(func(w *response.Writer, req *request.Request) {
+		handler(FromRequest(req))
+		w.WriteStatusLine(response.STATUS_OK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})(w, req)
+
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(builder.String())), nil)
+	require.NoError(t, err)
+	return res
+}
+
+func sessionCookie(res *http.Response) string {
+	for _, c := range res.Cookies() {
+		if c.Name == "session" {
+			return c.Name + "=" + c.Value
+		}
+	}
+	return ""
+}
+
+func TestMiddleware(t *testing.T) {
+	for name, store := range map[string]Store{"cookie": nil, "memory": NewMemoryStore()} {
+		t.Run(name, func(t *testing.T) {
+			mw, err := Middleware(Options{Keys: [][]byte{newKey}, Store: store})
+			require.NoError(t, err)
+
+			// Test: Untouched new session sets no cookie
+			res := run(t, mw, "", func(s *Session) {
+				assert.True(t, s.IsNew())
+			})
+			assert.Empty(t, res.Cookies())
+
+			// Test: Modified session is sent back
+			res = run(t, mw, "", func(s *Session) { s.Set("user", "ada") })
+			cookie := sessionCookie(res)
+			require.NotEmpty(t, cookie)
+			assert.True(t, res.Cookies()[0].HttpOnly)
+			assert.Equal(t, 86400, res.Cookies()[0].MaxAge)
+
+			// Test: Next request sees the values
+			res = run(t, mw, cookie, func(s *Session) {
+				assert.False(t, s.IsNew())
+				user, _ := s.Get("user")
+				assert.Equal(t, "ada", user)
+			})
+			assert.Empty(t, res.Cookies())
+
+			// Test: Tampered cookie starts a new session
+			run(t, mw, cookie+"x", func(s *Session) {
+				assert.True(t, s.IsNew())
+			})
+
+			// Test: Destroy expires the cookie
+			res = run(t, mw, cookie, func(s *Session) { s.Destroy() })
+			require.Len(t, res.Cookies(), 1)
+			assert.Equal(t, -1, res.Cookies()[0].MaxAge)
+			if store != nil {
+				run(t, mw, cookie, func(s *Session) {
+					assert.True(t, s.IsNew())
+				})
+			}
+		})
+	}
+}
+
+func TestSlidingExpiry(t *testing.T) {
+	now := time.Now()
+	manager, err := newManager(Options{Keys: [][]byte{newKey}, MaxAge: time.Hour, Sliding: true})
+	require.NoError(t, err)
+	mw := manager.middleware
+
+	res := run(t, mw, "", func(s *Session) { s.Set("user", "ada") })
+	cookie := sessionCookie(res)
+
+	// Test: Early in the session nothing is renewed
+	res = run(t, mw, cookie, func(s *Session) {})
+	assert.Empty(t, res.Cookies())
+
+	// Test: Past half way the expiry is pushed back
+	manager.now = func() time.Time { return now.Add(40 * time.Minute) }
+	res = run(t, mw, cookie, func(s *Session) {})
+	require.NotEmpty(t, sessionCookie(res))
+	assert.True(t, res.Cookies()[0].Expires.After(now.Add(90*time.Minute)))
+
+	// Test: Expired session is not loaded
+	manager.now = func() time.Time { return now.Add(2 * time.Hour) }
+	run(t, mw, cookie, func(s *Session) {
+		assert.True(t, s.IsNew())
+	})
+}
@@ -0,0 +1,92 @@
+package session
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ERROR_NOT_FOUND = errors.New("session not found")
+
+// Store keeps session data on the server, in which case the cookie only
+// carries the signed session id.
+type Store interface {
+	Load(id string) (map[string]string, time.Time, error)
+	Save(id string, values map[string]string, expires time.Time) error
+	Delete(id string) error
+}
+
+type memoryEntry struct {
+	values  map[string]string
+	expires time.Time
+}
+
+// MemoryStore is a Store for a single process. Expired sessions are removed
+// lazily when loaded and by Sweep.
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]memoryEntry
+	now      func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions: map[string]memoryEntry{},
+		now:      time.Now,
+	}
+}
+
+func (ms *MemoryStore) Load(id string) (map[string]string, time.Time, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, ok := ms.sessions[id]
+	if !ok {
+		return nil, time.Time{}, ERROR_NOT_FOUND
+	}
+	if !ms.now().Before(entry.expires) {
+		delete(ms.sessions, id)
+		return nil, time.Time{}, ERROR_NOT_FOUND
+	}
+	return copyValues(entry.values), entry.expires, nil
+}
+
+func (ms *MemoryStore) Save(id string, values map[string]string, expires time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.sessions[id] = memoryEntry{values: copyValues(values), expires: expires}
+	return nil
+}
+
+func (ms *MemoryStore) Delete(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.sessions, id)
+	return nil
+}
+
+// Sweep removes every expired session.
+func (ms *MemoryStore) Sweep() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := ms.now()
+	for id, entry := range ms.sessions {
+		if !now.Before(entry.expires) {
+			delete(ms.sessions, id)
+		}
+	}
+}
+
+func (ms *MemoryStore) Len() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return len(ms.sessions)
+}
+
+func copyValues(values map[string]string) map[string]string {
+	out := make(map[string]string, len(values))
+	for k, v := range values {
+		out[k] = v
+	}
+	return out
+}
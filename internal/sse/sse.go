@@ -0,0 +1,224 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+)
+
+var ERROR_STREAM_CLOSED = errors.New("event stream closed")
+var ERROR_INVALID_FIELD = errors.New("event field contains a line break")
+
+// Event is a single server-sent event. Data may span multiple lines, each
+// one is sent as its own data field and joined back together by the client.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry tells the client how long to wait before reconnecting. Zero
+	// leaves the client's current value alone.
+	Retry time.Duration
+}
+
+type Options struct {
+	// HeartbeatInterval is how often a comment line is sent to keep
+	// intermediaries from timing out an idle stream. Zero means
+	// DefaultHeartbeatInterval, negative disables heartbeats.
+	HeartbeatInterval time.Duration
+}
+
+const DefaultHeartbeatInterval = 15 * time.Second
+
+// Stream writes events to a client as a chunked text/event-stream body.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+
+	mu     sync.Mutex
+	closed bool
+	err    error
+	done   chan struct{}
+}
+
+// NewStream writes the response head for an event stream and starts the
+// heartbeat. The caller must call Close once it has finished sending.
+func NewStream(w *response.Writer, req *request.Request, opts Options) (*Stream, error) {
+	h := response.GetDefaultHeaders(0)
+	h.Remove("Content-Length")
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Transfer-Encoding", "chunked")
+	// Ask reverse proxies such as nginx not to buffer the stream
+	h.Set("X-Accel-Buffering", "no")
+
+	err := w.WriteStatusLine(response.STATUS_OK)
+	if err != nil {
+		return nil, err
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return nil, err
+	}
+
+	lastEventID, _ := req.Headers.Get("Last-Event-ID")
+	s := &Stream{
+		w:           w,
+		lastEventID: lastEventID,
+		done:        make(chan struct{}),
+	}
+
+	interval := opts.HeartbeatInterval
+	if interval == 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	go s.watch(req.Context(), interval)
+
+	return s, nil
+}
+
+// LastEventID is the id the client last saw before reconnecting, or an
+// empty string for a fresh connection. Handlers should resume after it.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once the stream can no longer be written to, either
+// because the client went away, the request context ended or Close was
+// called.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the write error that ended the stream, if any.
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Stream) Send(ev Event) error {
+	if strings.ContainsAny(ev.ID, "\r\n\x00") || strings.ContainsAny(ev.Event, "\r\n") {
+		return ERROR_INVALID_FIELD
+	}
+
+	builder := strings.Builder{}
+	if ev.Event != "" {
+		fmt.Fprintf(&builder, "event: %s\n", ev.Event)
+	}
+	if ev.ID != "" {
+		fmt.Fprintf(&builder, "id: %s\n", ev.ID)
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(&builder, "retry: %d\n", ev.Retry.Milliseconds())
+	}
+	for _, line := range splitLines(ev.Data) {
+		fmt.Fprintf(&builder, "data: %s\n", line)
+	}
+	builder.WriteString("\n")
+
+	return s.write(builder.String())
+}
+
+// Comment sends a comment line, which clients ignore.
+func (s *Stream) Comment(text string) error {
+	builder := strings.Builder{}
+	for _, line := range splitLines(text) {
+		fmt.Fprintf(&builder, ": %s\n", line)
+	}
+	builder.WriteString("\n")
+	return s.write(builder.String())
+}
+
+// Close stops the heartbeat and terminates the chunked body.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return s.err
+	}
+
+	err := s.end()
+	s.finish(nil)
+	return err
+}
+
+// end terminates the chunked body, must be called with mu held.
+func (s *Stream) end() error {
+	_, err := s.w.WriteChunkedBodyDone()
+	if err == nil {
+		s.w.AddCrLf()
+	}
+	return err
+}
+
+func (s *Stream) write(chunk string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		if s.err != nil {
+			return s.err
+		}
+		return ERROR_STREAM_CLOSED
+	}
+
+	_, err := s.w.WriteChunkedBody([]byte(chunk))
+	if err != nil {
+		s.finish(err)
+		return err
+	}
+	return nil
+}
+
+// finish marks the stream as closed, must be called with mu held.
+func (s *Stream) finish(err error) {
+	s.closed = true
+	s.err = err
+	close(s.done)
+}
+
+// watch sends heartbeats and ends the stream when the request context is
+// done. A negative interval disables heartbeats.
+func (s *Stream) watch(ctx context.Context, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ctx.Done():
+			s.mu.Lock()
+			// A client that is still there can tell the stream ended
+			// rather than broke off
+			if !s.closed {
+				s.end()
+				s.finish(context.Cause(ctx))
+			}
+			s.mu.Unlock()
+			return
+		case <-tick:
+			err := s.write(": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// splitLines splits on any of the line endings the event stream format
+// accepts so a stray \r can't end a field early.
+func splitLines(data string) []string {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	return strings.Split(data, "\n")
+}
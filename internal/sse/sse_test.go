@@ -0,0 +1,124 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(h map[string]string) *request.Request {
+	req := &request.Request{Headers: headers.NewHeaders()}
+	for k, v := range h {
+		req.Headers.Set(k, v)
+	}
+	return req
+}
+
+func TestStreamFormat(t *testing.T) {
+	builder := &strings.Builder{}
+	w := response.NewWriter(builder)
+	s, err := NewStream(w, newRequest(map[string]string{"Last-Event-ID": "41"}), Options{HeartbeatInterval: -1})
+	require.NoError(t, err)
+	assert.Equal(t, "41", s.LastEventID())
+
+	require.NoError(t, s.Send(Event{ID: "42", Event: "update", Data: "line one\nline two\r\nline three", Retry: 3 * time.Second}))
+	require.NoError(t, s.Comment("hi"))
+	require.NoError(t, s.Close())
+
+	// Test: Invalid ids are rejected
+	require.ErrorIs(t, s.Send(Event{ID: "4\n2"}), ERROR_INVALID_FIELD)
+
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(builder.String())), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	assert.Empty(t, res.Header.Get("Content-Length"))
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "event: update\nid: 42\nretry: 3000\ndata: line one\ndata: line two\ndata: line three\n\n: hi\n\n", string(body))
+
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("stream should be done after close")
+	}
+}
+
+type failingWriter struct {
+	strings.Builder
+	fail atomic.Bool
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if fw.fail.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	return fw.Builder.Write(p)
+}
+
+func TestStreamClientGone(t *testing.T) {
+	fw := &failingWriter{}
+	s, err := NewStream(response.NewWriter(fw), newRequest(nil), Options{HeartbeatInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+
+	fw.fail.Store(true)
+	select {
+	case <-s.Done():
+		require.ErrorIs(t, s.Err(), io.ErrClosedPipe)
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat did not notice the client went away")
+	}
+	require.Error(t, s.Send(Event{Data: "late"}))
+}
+
+func TestStreamContextDone(t *testing.T) {
+	builder := &lockedBuilder{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	s, err := NewStream(response.NewWriter(builder), newRequest(nil).WithContext(ctx), Options{HeartbeatInterval: -1})
+	require.NoError(t, err)
+	require.NoError(t, s.Send(Event{Data: "only"}))
+
+	// Test: An ended request context still terminates the body
+	select {
+	case <-s.Done():
+		require.ErrorIs(t, s.Err(), context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("stream did not end with the request context")
+	}
+	assert.ErrorIs(t, s.Close(), context.DeadlineExceeded)
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(builder.String())), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: only\n\n", string(body))
+}
+
+// lockedBuilder is written by the stream's watcher and read by the test.
+type lockedBuilder struct {
+	mu sync.Mutex
+	strings.Builder
+}
+
+func (lb *lockedBuilder) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.Builder.Write(p)
+}
+
+func (lb *lockedBuilder) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.Builder.String()
+}
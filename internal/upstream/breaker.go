@@ -0,0 +1,128 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+)
+
+type BreakerState string
+
+const (
+	StateClosed   BreakerState = "closed"
+	StateOpen     BreakerState = "open"
+	StateHalfOpen BreakerState = "half_open"
+)
+
+// Breaker is a circuit breaker guarding a single upstream. It opens after
+// FailureThreshold consecutive failures, rejects calls for OpenTimeout and
+// then lets up to HalfOpenProbes calls through to decide whether to close
+// again.
+type Breaker struct {
+	FailureThreshold int
+	OpenTimeout      time.Duration
+	HalfOpenProbes   int
+
+	mu          sync.Mutex
+	state       BreakerState
+	failures    int
+	probes      int
+	openedAt    time.Time
+	totalOpened int
+	now         func() time.Time
+}
+
+func NewBreaker(failureThreshold int, openTimeout time.Duration) *Breaker {
+	return &Breaker{
+		FailureThreshold: failureThreshold,
+		OpenTimeout:      openTimeout,
+		HalfOpenProbes:   1,
+		state:            StateClosed,
+		now:              time.Now,
+	}
+}
+
+// Allow reports whether a call may proceed. When the breaker is open it
+// returns an *OpenError carrying how long until the next probe is allowed.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		elapsed := b.now().Sub(b.openedAt)
+		if elapsed < b.OpenTimeout {
+			return &OpenError{RetryAfter: b.OpenTimeout - elapsed}
+		}
+		b.state = StateHalfOpen
+		b.probes = 0
+		fallthrough
+	case StateHalfOpen:
+		if b.probes >= b.HalfOpenProbes {
+			return &OpenError{RetryAfter: b.OpenTimeout}
+		}
+		b.probes++
+	}
+
+	return nil
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.state == StateHalfOpen {
+		b.state = StateClosed
+		b.probes = 0
+	}
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == StateHalfOpen || b.failures >= b.FailureThreshold {
+		b.trip()
+	}
+}
+
+// Abandon gives back a half-open probe whose outcome is unknown, such as a
+// request cancelled by the caller.
+func (b *Breaker) Abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+func (b *Breaker) trip() {
+	b.state = StateOpen
+	b.openedAt = b.now()
+	b.probes = 0
+	b.totalOpened++
+}
+
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+type BreakerStats struct {
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	TimesOpened         int          `json:"times_opened"`
+}
+
+func (b *Breaker) Stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStats{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		TimesOpened:         b.totalOpened,
+	}
+}
@@ -0,0 +1,187 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ERROR_UPSTREAM_UNAVAILABLE = errors.New("upstream unavailable")
+
+// OpenError is returned when a call is rejected because the breaker is open.
+type OpenError struct {
+	RetryAfter time.Duration
+}
+
+func (oe *OpenError) Error() string {
+	return fmt.Sprintf("circuit open, retry after %s", oe.RetryAfter)
+}
+
+type Policy struct {
+	// Timeout bounds each individual attempt, including reading the
+	// response body.
+	Timeout     time.Duration
+	MaxRetries  int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+}
+
+var DefaultPolicy = Policy{
+	Timeout:     5 * time.Second,
+	MaxRetries:  2,
+	BaseBackoff: 100 * time.Millisecond,
+	MaxBackoff:  2 * time.Second,
+}
+
+// Upstream is a remote origin requests are proxied to. Calls go through a
+// per-upstream circuit breaker and are retried according to Policy when the
+// method is idempotent.
+type Upstream struct {
+	Name    string
+	BaseURL string
+	Policy  Policy
+	Breaker *Breaker
+	client  *http.Client
+	sleep   func(context.Context, time.Duration) error
+}
+
+func New(name, baseURL string, policy Policy) *Upstream {
+	return &Upstream{
+		Name:    name,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Policy:  policy,
+		Breaker: NewBreaker(5, 30*time.Second),
+		client:  &http.Client{},
+		sleep:   sleepCtx,
+	}
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Do sends a request for path with header to the upstream. The returned
+// response body must be closed by the caller. A response with a 5xx status
+// counts as a failure for the breaker but is still returned once retries
+// are exhausted. Requests ended by ctx are neither retried nor counted.
+func (u *Upstream) Do(ctx context.Context, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	attempts := 1
+	if isIdempotent(method) {
+		attempts += u.Policy.MaxRetries
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			err := u.sleep(ctx, u.backoff(attempt))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err := u.Breaker.Allow()
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := u.attempt(ctx, method, path, header, body)
+		if err != nil && ctx.Err() != nil {
+			// The caller gave up, which says nothing about the upstream
+			u.Breaker.Abandon()
+			return nil, ctx.Err()
+		}
+		if err == nil && res.StatusCode < 500 {
+			u.Breaker.Success()
+			return res, nil
+		}
+
+		u.Breaker.Failure()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if attempt == attempts-1 {
+			return res, nil
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		lastErr = fmt.Errorf("upstream %s returned %d", u.Name, res.StatusCode)
+	}
+
+	return nil, errors.Join(ERROR_UPSTREAM_UNAVAILABLE, lastErr)
+}
+
+func (u *Upstream) attempt(ctx context.Context, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.Policy.Timeout)
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.BaseURL+"/"+strings.TrimPrefix(path, "/"), reader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if header != nil {
+		req.Header = header.Clone()
+	}
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// backoff returns a full-jitter delay for the given retry attempt.
+func (u *Upstream) backoff(attempt int) time.Duration {
+	d := u.Policy.BaseBackoff << (attempt - 1)
+	if d <= 0 || d > u.Policy.MaxBackoff {
+		d = u.Policy.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d)
+}
+
+func (u *Upstream) Stats() BreakerStats {
+	return u.Breaker.Stats()
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cb *cancelBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.cancel()
+	return err
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,109 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreakerStates(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBreaker(2, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	// Test: Stays closed below threshold
+	require.NoError(t, b.Allow())
+	b.Failure()
+	assert.Equal(t, StateClosed, b.State())
+
+	// Test: Opens at threshold and rejects calls
+	b.Failure()
+	assert.Equal(t, StateOpen, b.State())
+	err := b.Allow()
+	var openErr *OpenError
+	require.ErrorAs(t, err, &openErr)
+	assert.Equal(t, 10*time.Second, openErr.RetryAfter)
+
+	// Test: Half open after timeout allows a single probe
+	now = now.Add(10 * time.Second)
+	require.NoError(t, b.Allow())
+	assert.Equal(t, StateHalfOpen, b.State())
+	require.Error(t, b.Allow())
+
+	// Test: An abandoned probe lets another one through
+	b.Abandon()
+	require.NoError(t, b.Allow())
+	assert.Equal(t, StateHalfOpen, b.State())
+
+	// Test: Failed probe opens again
+	b.Failure()
+	assert.Equal(t, StateOpen, b.State())
+
+	// Test: Successful probe closes
+	now = now.Add(10 * time.Second)
+	require.NoError(t, b.Allow())
+	b.Success()
+	assert.Equal(t, StateClosed, b.State())
+	assert.Equal(t, 2, b.Stats().TimesOpened)
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "yes", r.Header.Get("X-Forwarded"))
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	u := New("test", srv.URL, Policy{Timeout: time.Second, MaxRetries: 2})
+	u.sleep = func(context.Context, time.Duration) error { return nil }
+
+	// Test: Idempotent method is retried until success
+	// Test: Headers are sent on every attempt
+	header := http.Header{"X-Forwarded": {"yes"}}
+	res, err := u.Do(context.Background(), "GET", "/get", header, nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, int32(3), calls.Load())
+
+	// Test: Non idempotent method is not retried
+	calls.Store(0)
+	res, err = u.Do(context.Background(), "POST", "/post", header, []byte("body"))
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 503, res.StatusCode)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	u := New("slow", srv.URL, Policy{Timeout: 20 * time.Millisecond})
+	_, err := u.Do(context.Background(), "GET", "/", nil, nil)
+	require.ErrorIs(t, err, ERROR_UPSTREAM_UNAVAILABLE)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, u.Stats().ConsecutiveFailures)
+
+	// Test: Callers giving up are neither retried nor counted as failures
+	u = New("slow", srv.URL, Policy{Timeout: time.Second, MaxRetries: 2})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = u.Do(ctx, "GET", "/", nil, nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotErrorIs(t, err, ERROR_UPSTREAM_UNAVAILABLE)
+	assert.Zero(t, u.Stats().ConsecutiveFailures)
+}
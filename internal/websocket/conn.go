@@ -0,0 +1,316 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type CloseCode uint16
+
+const (
+	CloseNormal          CloseCode = 1000
+	CloseGoingAway       CloseCode = 1001
+	CloseProtocolError   CloseCode = 1002
+	CloseUnsupportedData CloseCode = 1003
+	CloseNoStatus        CloseCode = 1005
+	CloseInvalidPayload  CloseCode = 1007
+	ClosePolicyViolation CloseCode = 1008
+	CloseMessageTooBig   CloseCode = 1009
+	CloseInternalError   CloseCode = 1011
+)
+
+// CloseError is returned from ReadMessage once the peer has started or
+// completed the close handshake.
+type CloseError struct {
+	Code   CloseCode
+	Reason string
+}
+
+func (ce *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", ce.Code, ce.Reason)
+}
+
+var ERROR_CONN_CLOSED = errors.New("websocket connection closed")
+
+type Options struct {
+	// ReadLimit is the maximum size of a complete message, after joining
+	// fragments. Zero means DefaultReadLimit.
+	ReadLimit int64
+	// WriteFragmentSize splits outgoing messages into frames of at most
+	// this many bytes. Zero sends every message as a single frame.
+	WriteFragmentSize int
+	// CloseTimeout bounds how long Close waits for the peer's close frame.
+	CloseTimeout time.Duration
+	Subprotocols []string
+}
+
+const DefaultReadLimit = 1 << 20
+
+// Conn is a websocket connection. Reads must come from a single goroutine,
+// writes may be made concurrently.
+type Conn struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	isServer bool
+	opts     Options
+
+	writeMu    sync.Mutex
+	closeSent  bool
+	closedOnce sync.Once
+	recvOnce   sync.Once
+	// closeRecv is closed when the peer's close frame has been read.
+	closeRecv chan struct{}
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, isServer bool, opts Options) *Conn {
+	if opts.ReadLimit == 0 {
+		opts.ReadLimit = DefaultReadLimit
+	}
+	if opts.CloseTimeout == 0 {
+		opts.CloseTimeout = 5 * time.Second
+	}
+	return &Conn{
+		conn:      conn,
+		reader:    reader,
+		isServer:  isServer,
+		opts:      opts,
+		closeRecv: make(chan struct{}),
+	}
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ReadMessage returns the next complete text or binary message. Ping frames
+// are answered automatically and pongs are discarded. When the peer closes
+// the connection a *CloseError is returned.
+func (c *Conn) ReadMessage() (Opcode, []byte, error) {
+	var (
+		opcode  Opcode
+		message []byte
+		started bool
+	)
+
+	for {
+		f, err := readFrame(c.reader, c.opts.ReadLimit)
+		if err != nil {
+			return 0, nil, c.failRead(err)
+		}
+
+		// RFC 6455 section 5.1, clients must mask and servers must not
+		if f.masked != c.isServer {
+			return 0, nil, c.failRead(ERROR_PROTOCOL)
+		}
+
+		switch f.opcode {
+		case OpPing:
+			err = c.writeControl(OpPong, f.payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			return 0, nil, c.handleClose(f.payload)
+		case OpContinuation:
+			if !started {
+				return 0, nil, c.failRead(ERROR_PROTOCOL)
+			}
+		default:
+			if started {
+				return 0, nil, c.failRead(ERROR_PROTOCOL)
+			}
+			started = true
+			opcode = f.opcode
+		}
+
+		if int64(len(message)+len(f.payload)) > c.opts.ReadLimit {
+			return 0, nil, c.failRead(ERROR_MESSAGE_TOO_BIG)
+		}
+		message = append(message, f.payload...)
+
+		if f.fin {
+			break
+		}
+	}
+
+	if opcode == OpText && !utf8.Valid(message) {
+		c.writeClose(CloseInvalidPayload, "invalid utf-8")
+		c.closeConn()
+		return 0, nil, &CloseError{Code: CloseInvalidPayload, Reason: "invalid utf-8"}
+	}
+
+	return opcode, message, nil
+}
+
+// failRead sends a close frame matching err and drops the connection
+// before returning err.
+func (c *Conn) failRead(err error) error {
+	switch {
+	case errors.Is(err, ERROR_MESSAGE_TOO_BIG):
+		c.writeClose(CloseMessageTooBig, "message too big")
+	case errors.Is(err, ERROR_PROTOCOL):
+		c.writeClose(CloseProtocolError, "protocol error")
+	}
+	c.closeConn()
+	return err
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	ce := &CloseError{Code: CloseNoStatus}
+	if len(payload) == 1 {
+		ce.Code = CloseProtocolError
+	} else if len(payload) >= 2 {
+		ce.Code = CloseCode(binary.BigEndian.Uint16(payload))
+		ce.Reason = string(payload[2:])
+		if !validCloseCode(ce.Code) {
+			ce.Code = CloseProtocolError
+		} else if !utf8.ValidString(ce.Reason) {
+			ce.Code = CloseInvalidPayload
+		}
+	}
+
+	c.recvOnce.Do(func() { close(c.closeRecv) })
+
+	// Echo the close frame unless we started the handshake, after which
+	// neither side may send anything else so the connection is dropped.
+	c.writeMu.Lock()
+	sent := c.closeSent
+	c.writeMu.Unlock()
+	if !sent {
+		reply := ce.Code
+		if reply == CloseNoStatus {
+			reply = CloseNormal
+		}
+		c.writeClose(reply, "")
+	}
+	c.closeConn()
+
+	return ce
+}
+
+// validCloseCode reports whether a peer may send code in a close frame, RFC
+// 6455 section 7.4. 1005, 1006 and 1015 only report a closure locally and
+// the rest of 1000 to 2999 is reserved for the protocol.
+func validCloseCode(code CloseCode) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code < 1000 || code > 1014:
+		return false
+	}
+	return code != 1004 && code != CloseNoStatus && code != 1006
+}
+
+// WriteMessage sends data as a single message, fragmenting it when
+// Options.WriteFragmentSize is set.
+func (c *Conn) WriteMessage(opcode Opcode, data []byte) error {
+	if opcode != OpText && opcode != OpBinary {
+		return fmt.Errorf("WriteMessage only supports text and binary messages")
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ERROR_CONN_CLOSED
+	}
+
+	size := c.opts.WriteFragmentSize
+	if size <= 0 || len(data) <= size {
+		return writeFrame(c.conn, c.newFrame(true, opcode, data))
+	}
+
+	for start := 0; start < len(data); start += size {
+		end := min(start+size, len(data))
+		op := OpContinuation
+		if start == 0 {
+			op = opcode
+		}
+		err := writeFrame(c.conn, c.newFrame(end == len(data), op, data[start:end]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Conn) WriteText(text string) error {
+	return c.WriteMessage(OpText, []byte(text))
+}
+
+func (c *Conn) Ping(data []byte) error {
+	return c.writeControl(OpPing, data)
+}
+
+// Close starts the close handshake and waits for the peer to answer or for
+// Options.CloseTimeout to pass before closing the underlying connection.
+// Another goroutine must be reading for the peer's reply to be seen.
+func (c *Conn) Close(code CloseCode, reason string) error {
+	err := c.writeClose(code, reason)
+	if err != nil {
+		c.closeConn()
+		return err
+	}
+
+	select {
+	case <-c.closeRecv:
+	case <-time.After(c.opts.CloseTimeout):
+	}
+	return c.closeConn()
+}
+
+func (c *Conn) writeClose(code CloseCode, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+	return writeFrame(c.conn, c.newFrame(true, OpClose, payload))
+}
+
+func (c *Conn) writeControl(opcode Opcode, payload []byte) error {
+	if len(payload) > maxControlPayload {
+		return ERROR_PROTOCOL
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ERROR_CONN_CLOSED
+	}
+	return writeFrame(c.conn, c.newFrame(true, opcode, payload))
+}
+
+func (c *Conn) newFrame(fin bool, opcode Opcode, payload []byte) *frame {
+	f := &frame{fin: fin, opcode: opcode, payload: payload}
+	if !c.isServer {
+		f.masked = true
+		rand.Read(f.maskKey[:])
+	}
+	return f
+}
+
+// closeConn closes the underlying connection, only the first call reports
+// an error.
+func (c *Conn) closeConn() error {
+	var err error
+	c.recvOnce.Do(func() { close(c.closeRecv) })
+	c.closedOnce.Do(func() { err = c.conn.Close() })
+	return err
+}
@@ -0,0 +1,152 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+type Opcode byte
+
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+func (o Opcode) isControl() bool {
+	return o&0x8 != 0
+}
+
+var ERROR_PROTOCOL = errors.New("websocket protocol error")
+var ERROR_MESSAGE_TOO_BIG = errors.New("websocket message too big")
+
+const maxControlPayload = 125
+
+type frame struct {
+	fin     bool
+	opcode  Opcode
+	masked  bool
+	maskKey [4]byte
+	payload []byte
+}
+
+// readFrame reads a single frame. limit bounds the payload length so a peer
+// can't make us allocate arbitrarily large buffers from a forged header.
+func readFrame(r io.Reader, limit int64) (*frame, error) {
+	var head [2]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return nil, err
+	}
+
+	f := &frame{
+		fin:    head[0]&0x80 != 0,
+		opcode: Opcode(head[0] & 0x0F),
+		masked: head[1]&0x80 != 0,
+	}
+
+	// No extensions are negotiated so RSV bits must be clear
+	if head[0]&0x70 != 0 {
+		return nil, ERROR_PROTOCOL
+	}
+
+	switch f.opcode {
+	case OpContinuation, OpText, OpBinary, OpClose, OpPing, OpPong:
+	default:
+		return nil, ERROR_PROTOCOL
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(r, ext[:])
+		if err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(r, ext[:])
+		if err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length&(1<<63) != 0 {
+			return nil, ERROR_PROTOCOL
+		}
+	}
+
+	if f.opcode.isControl() && (length > maxControlPayload || !f.fin) {
+		return nil, ERROR_PROTOCOL
+	}
+	if limit > 0 && length > uint64(limit) {
+		return nil, ERROR_MESSAGE_TOO_BIG
+	}
+
+	if f.masked {
+		_, err = io.ReadFull(r, f.maskKey[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f.payload = make([]byte, length)
+	_, err = io.ReadFull(r, f.payload)
+	if err != nil {
+		return nil, err
+	}
+	if f.masked {
+		maskBytes(f.maskKey, f.payload)
+	}
+
+	return f, nil
+}
+
+func writeFrame(w io.Writer, f *frame) error {
+	buf := make([]byte, 0, 14+len(f.payload))
+
+	b0 := byte(f.opcode)
+	if f.fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+
+	var maskBit byte
+	if f.masked {
+		maskBit = 0x80
+	}
+	length := len(f.payload)
+	switch {
+	case length <= 125:
+		buf = append(buf, maskBit|byte(length))
+	case length <= 0xFFFF:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+
+	if f.masked {
+		buf = append(buf, f.maskKey[:]...)
+		start := len(buf)
+		buf = append(buf, f.payload...)
+		maskBytes(f.maskKey, buf[start:])
+	} else {
+		buf = append(buf, f.payload...)
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
@@ -0,0 +1,162 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"dev.grab-a-byte.network/internal/headers"
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+)
+
+var ERROR_BAD_HANDSHAKE = errors.New("websocket bad handshake")
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ComputeAcceptKey returns the Sec-WebSocket-Accept value for a client's
+// Sec-WebSocket-Key as defined in RFC 6455 section 4.2.2.
+func ComputeAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// IsUpgrade reports whether req asks to switch to the websocket protocol.
+func IsUpgrade(req *request.Request) bool {
+	upgrade, _ := req.Headers.Get("Upgrade")
+	connection, _ := req.Headers.Get("Connection")
+	return headerContainsToken(upgrade, "websocket") && headerContainsToken(connection, "upgrade")
+}
+
+// Upgrade validates the opening handshake, replies with 101 Switching
+// Protocols and takes over the connection. On failure an error response has
+// already been written and the returned error describes why.
+func Upgrade(w *response.Writer, req *request.Request, opts Options) (*Conn, error) {
+	fail := func(statusCode response.StatusCode, reason string) (*Conn, error) {
+		h := response.GetDefaultHeaders(0)
+		if statusCode == response.STATUS_UPGRADE_REQUIRED {
+			h.Set("Sec-WebSocket-Version", "13")
+		}
+		w.WriteStatusLine(statusCode)
+		w.WriteHeaders(h)
+		return nil, fmt.Errorf("%w: %s", ERROR_BAD_HANDSHAKE, reason)
+	}
+
+	if req.RequestLine.Method != "GET" {
+		return fail(response.STATUS_METHOD_NOT_ALLOWED, "method must be GET")
+	}
+	if !IsUpgrade(req) {
+		return fail(response.STATUS_BAD_REQUEST, "missing upgrade headers")
+	}
+	if version, _ := req.Headers.Get("Sec-WebSocket-Version"); version != "13" {
+		return fail(response.STATUS_UPGRADE_REQUIRED, "unsupported version")
+	}
+	key, _ := req.Headers.Get("Sec-WebSocket-Key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 16 {
+		return fail(response.STATUS_BAD_REQUEST, "invalid Sec-WebSocket-Key")
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", ComputeAcceptKey(key))
+	if protocol := selectSubprotocol(req, opts.Subprotocols); protocol != "" {
+		h.Set("Sec-WebSocket-Protocol", protocol)
+	}
+
+	err = w.WriteStatusLine(response.STATUS_SWITCHING_PROTOCOLS)
+	if err != nil {
+		return nil, err
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := io.MultiReader(bytes.NewReader(buffered), conn)
+	return newConn(conn, bufio.NewReader(reader), true, opts), nil
+}
+
+// Dial performs a client handshake against url's host and path, e.g.
+// "ws://localhost:42069/ws". It is primarily intended for tests and tools.
+func Dial(url string, opts Options) (*Conn, error) {
+	hostPath, ok := strings.CutPrefix(url, "ws://")
+	if !ok {
+		return nil, fmt.Errorf("unsupported websocket url %q", url)
+	}
+	host, path, _ := strings.Cut(hostPath, "/")
+	path = "/" + path
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", path, host, key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.StatusCode != int(response.STATUS_SWITCHING_PROTOCOLS) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: status %d", ERROR_BAD_HANDSHAKE, res.StatusCode)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != ComputeAcceptKey(key) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: accept key mismatch", ERROR_BAD_HANDSHAKE)
+	}
+
+	return newConn(conn, reader, false, opts), nil
+}
+
+func selectSubprotocol(req *request.Request, supported []string) string {
+	requested, ok := req.Headers.Get("Sec-WebSocket-Protocol")
+	if !ok {
+		return ""
+	}
+	for _, want := range strings.Split(requested, ",") {
+		want = strings.TrimSpace(want)
+		for _, have := range supported {
+			if want == have {
+				return have
+			}
+		}
+	}
+	return ""
+}
+
+// headerContainsToken reports whether a comma separated header value holds
+// token, compared case-insensitively.
+func headerContainsToken(value, token string) bool {
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if strings.EqualFold(part, token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package websocket
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"dev.grab-a-byte.network/internal/request"
+	"dev.grab-a-byte.network/internal/response"
+	"dev.grab-a-byte.network/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputeAcceptKey(t *testing.T) {
+	// Example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", ComputeAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 65535, 65536} {
+		payload := bytes.Repeat([]byte{'x'}, size)
+		buf := &bytes.Buffer{}
+		err := writeFrame(buf, &frame{fin: true, opcode: OpBinary, masked: true, maskKey: [4]byte{1, 2, 3, 4}, payload: payload})
+		require.NoError(t, err)
+
+		f, err := readFrame(buf, 0)
+		require.NoError(t, err)
+		assert.True(t, f.fin)
+		assert.Equal(t, OpBinary, f.opcode)
+		assert.Equal(t, payload, f.payload)
+	}
+
+	// Test: Masked example from RFC 6455 section 5.7
+	f, err := readFrame(bytes.NewReader([]byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}), 0)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", string(f.payload))
+
+	// Test: Fragmented control frames are rejected
+	_, err = readFrame(bytes.NewReader([]byte{0x09, 0x00}), 0)
+	require.ErrorIs(t, err, ERROR_PROTOCOL)
+
+	// Test: Oversized frames are rejected before reading the payload
+	_, err = readFrame(bytes.NewReader([]byte{0x82, 0x7F, 0, 0, 0, 0, 0, 1, 0, 0}), 1024)
+	require.ErrorIs(t, err, ERROR_MESSAGE_TOO_BIG)
+}
+
+func startEcho(t *testing.T, opts Options) string {
+	t.Helper()
+	srv, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		conn, err := Upgrade(w, req, opts)
+		if err != nil {
+			return
+		}
+		go func() {
+			for {
+				op, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				conn.WriteMessage(op, msg)
+			}
+		}()
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return "ws://" + srv.Addr().String() + "/echo"
+}
+
+func TestEcho(t *testing.T) {
+	url := startEcho(t, Options{WriteFragmentSize: 4})
+
+	client, err := Dial(url, Options{WriteFragmentSize: 3})
+	require.NoError(t, err)
+
+	// Test: Fragmented text messages are reassembled both ways
+	require.NoError(t, client.WriteText("hello websocket"))
+	op, msg, err := client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, OpText, op)
+	assert.Equal(t, "hello websocket", string(msg))
+
+	// Test: Pings are answered without surfacing as messages
+	require.NoError(t, client.Ping([]byte("are you there")))
+	require.NoError(t, client.WriteMessage(OpBinary, []byte{1, 2, 3}))
+	op, msg, err = client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, OpBinary, op)
+	assert.Equal(t, []byte{1, 2, 3}, msg)
+
+	// Test: Close handshake is echoed by the server
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := client.ReadMessage()
+		done <- err
+	}()
+	require.NoError(t, client.Close(CloseNormal, "bye"))
+	select {
+	case err := <-done:
+		var ce *CloseError
+		require.ErrorAs(t, err, &ce)
+		assert.Equal(t, CloseNormal, ce.Code)
+	case <-time.After(time.Second):
+		t.Fatal("close was not echoed")
+	}
+
+	// Test: Codes a peer must not send are answered with a protocol error
+	for _, code := range []CloseCode{999, 1004, CloseNoStatus, 1006, 1015, 2000, 5000} {
+		client, err := Dial(url, Options{})
+		require.NoError(t, err)
+		go client.Close(code, "")
+		_, _, err = client.ReadMessage()
+		var ce *CloseError
+		require.ErrorAs(t, err, &ce)
+		assert.Equal(t, CloseProtocolError, ce.Code, code)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	url := startEcho(t, Options{ReadLimit: 8})
+
+	client, err := Dial(url, Options{WriteFragmentSize: 4})
+	require.NoError(t, err)
+	defer client.conn.Close()
+
+	require.NoError(t, client.WriteText(strings.Repeat("a", 12)))
+	_, _, err = client.ReadMessage()
+	var ce *CloseError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, CloseMessageTooBig, ce.Code)
+}
+
+func TestBadHandshake(t *testing.T) {
+	url := startEcho(t, Options{})
+	addr := strings.TrimSuffix(strings.TrimPrefix(url, "ws://"), "/echo")
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 8\r\n\r\n"))
+	require.NoError(t, err)
+	buf := make([]byte, 64)
+	n, _ := conn.Read(buf)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "HTTP/1.1 426 Upgrade Required"))
+}